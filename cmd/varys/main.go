@@ -53,8 +53,16 @@ func main() {
 		Version:   fmt.Sprintf("%s (%s)", version, commit),
 		Flags:     flagset.ExtractPrefix("varys", cfg),
 		Commands: []*cli.Command{
+			commands.Audit,
+			commands.Authz,
+			commands.Connector,
+			commands.Kinds,
+			commands.Login,
+			commands.Roles,
+			commands.RootKeys,
 			commands.Run,
 			commands.Services,
+			commands.SSH,
 			commands.Users,
 			commands.Version,
 		},
@@ -11,13 +11,17 @@ require (
 
 require (
 	github.com/casbin/casbin/v2 v2.41.0
+	github.com/coreos/go-oidc/v3 v3.1.0
 	github.com/dgraph-io/badger/v3 v3.2103.2
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.4
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/zap v1.21.0
+	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	gopkg.in/square/go-jose.v2 v2.5.1
 )
 
 require (
@@ -47,7 +51,6 @@ require (
 	go.opencensus.io v0.23.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2 // indirect
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
 	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
 	golang.org/x/text v0.3.7 // indirect
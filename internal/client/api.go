@@ -3,10 +3,14 @@ package client
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"golang.org/x/oauth2"
 
@@ -39,25 +43,55 @@ func WithContext(ctx context.Context, api *API) context.Context {
 }
 
 type Config struct {
-	BaseURL string                 `json:"base_url" usage:"the base url that points to a varys instance"`
-	Basic   basicauth.ClientConfig `json:"basic"`
+	BaseURL    string                 `json:"base_url" usage:"the base url that points to a varys instance"`
+	Basic      basicauth.ClientConfig `json:"basic"`
+	TokenCache string                 `json:"token_cache" usage:"the path to the token cache written by varys login"`
 }
 
-func NewAPI(cfg Config) (*API, error) {
+// NewAPI constructs an API client. Explicitly configured basic credentials take precedence over any token cached by
+// varys login.
+func NewAPI(ctx context.Context, cfg Config) (*API, error) {
 	token, err := cfg.Basic.Token()
 	if err != nil {
 		return nil, err
 	}
 
-	return &API{
+	api := &API{
 		baseURL: cfg.BaseURL,
-		token:   token,
-	}, nil
+	}
+
+	if token != nil {
+		api.tokens = oauth2.StaticTokenSource(token)
+		return api, nil
+	}
+
+	path := cfg.TokenCache
+	if path == "" {
+		if path, err = DefaultTokenCache(); err != nil {
+			return api, nil
+		}
+	}
+
+	cached, err := LoadToken(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return api, nil
+	case err != nil:
+		return nil, err
+	}
+
+	api.tokens = &cachedTokenSource{
+		ctx:    ctx,
+		path:   path,
+		cached: cached,
+	}
+
+	return api, nil
 }
 
 type API struct {
 	baseURL string
-	token   *oauth2.Token
+	tokens  oauth2.TokenSource
 }
 
 func (api *API) Do(ctx context.Context, method, path string, req interface{}, res interface{}) error {
@@ -75,8 +109,13 @@ func (api *API) Do(ctx context.Context, method, path string, req interface{}, re
 		return err
 	}
 
-	if api.token != nil {
-		api.token.SetAuthHeader(r)
+	if api.tokens != nil {
+		token, err := api.tokens.Token()
+		if err != nil {
+			return err
+		}
+
+		token.SetAuthHeader(r)
 	}
 
 	resp, err := http.DefaultClient.Do(r)
@@ -104,6 +143,30 @@ func (api *API) Do(ctx context.Context, method, path string, req interface{}, re
 	return nil
 }
 
+func (api *API) Audit() *Audit {
+	return &Audit{api}
+}
+
+func (api *API) Authz() *Authz {
+	return &Authz{api}
+}
+
+func (api *API) Credentials() *Credentials {
+	return &Credentials{api}
+}
+
+func (api *API) Kinds() *Kinds {
+	return &Kinds{api}
+}
+
+func (api *API) Roles() *Roles {
+	return &Roles{api}
+}
+
+func (api *API) RootKeys() *RootKeys {
+	return &RootKeys{api}
+}
+
 func (api *API) Services() *Services {
 	return &Services{api}
 }
@@ -112,6 +175,182 @@ func (api *API) Users() *Users {
 	return &Users{api}
 }
 
+type Audit struct {
+	api *API
+}
+
+// List returns entries from the audit log. Zero values in the filter are ignored.
+func (a *Audit) List(ctx context.Context, filter engine.AuditFilter) ([]engine.AuditEntry, error) {
+	q := url.Values{}
+
+	if !filter.Since.IsZero() {
+		q.Set("since", filter.Since.Format(time.RFC3339))
+	}
+
+	if !filter.Until.IsZero() {
+		q.Set("until", filter.Until.Format(time.RFC3339))
+	}
+
+	if filter.Actor != "" {
+		q.Set("actor", filter.Actor)
+	}
+
+	path := "/api/v1/audit"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	entries := make([]engine.AuditEntry, 0)
+	err := a.api.Do(ctx, http.MethodGet, path, nil, &entries)
+
+	return entries, err
+}
+
+// Verify checks the hash chain of the audit log. When provided, the head from an earlier verification must still be
+// part of the log.
+func (a *Audit) Verify(ctx context.Context, head *engine.AuditHead) (engine.AuditVerification, error) {
+	path := "/api/v1/audit/verify"
+	if head != nil {
+		q := url.Values{}
+		q.Set("sequence", strconv.FormatUint(head.Sequence, 10))
+		q.Set("hash", head.Hash)
+
+		path += "?" + q.Encode()
+	}
+
+	verification := engine.AuditVerification{}
+	err := a.api.Do(ctx, http.MethodGet, path, nil, &verification)
+
+	return verification, err
+}
+
+type Credentials struct {
+	api *API
+}
+
+func (c *Credentials) List(ctx context.Context, kind, name string) ([]engine.UserCredential, error) {
+	path := fmt.Sprintf("/api/v1/credentials/%s/%s", url.PathEscape(kind), url.PathEscape(name))
+
+	credentials := make([]engine.UserCredential, 0)
+	err := c.api.Do(ctx, http.MethodGet, path, nil, &credentials)
+
+	return credentials, err
+}
+
+type Kinds struct {
+	api *API
+}
+
+func (k *Kinds) Grants() *KindGrants {
+	return &KindGrants{k.api}
+}
+
+type KindGrants struct {
+	api *API
+}
+
+func (a *KindGrants) List(ctx context.Context, kind string) ([]engine.UserGrant, error) {
+	path := fmt.Sprintf("/api/v1/kinds/%s/grants", url.PathEscape(kind))
+
+	resp := engine.ListGrantsResponse{}
+	err := a.api.Do(ctx, http.MethodGet, path, nil, &resp)
+
+	return resp.Grants, err
+}
+
+func (a *KindGrants) Update(ctx context.Context, kind string, grant engine.UserGrant) error {
+	path := fmt.Sprintf("/api/v1/kinds/%s/grants", url.PathEscape(kind))
+
+	return a.api.Do(ctx, http.MethodPut, path, grant, nil)
+}
+
+func (a *KindGrants) Delete(ctx context.Context, kind string, grant engine.UserGrant) error {
+	path := fmt.Sprintf("/api/v1/kinds/%s/grants", url.PathEscape(kind))
+
+	return a.api.Do(ctx, http.MethodDelete, path, grant, nil)
+}
+
+type Roles struct {
+	api *API
+}
+
+func (r *Roles) List(ctx context.Context) ([]engine.Role, error) {
+	roles := make([]engine.Role, 0)
+	err := r.api.Do(ctx, http.MethodGet, "/api/v1/roles", nil, &roles)
+
+	return roles, err
+}
+
+func (r *Roles) Get(ctx context.Context, name string) (engine.Role, error) {
+	path := fmt.Sprintf("/api/v1/roles/%s", url.PathEscape(name))
+
+	role := engine.Role{}
+	err := r.api.Do(ctx, http.MethodGet, path, nil, &role)
+
+	return role, err
+}
+
+func (r *Roles) Update(ctx context.Context, name string, req engine.PutRoleRequest) error {
+	path := fmt.Sprintf("/api/v1/roles/%s", url.PathEscape(name))
+
+	return r.api.Do(ctx, http.MethodPut, path, req, nil)
+}
+
+func (r *Roles) Delete(ctx context.Context, name string) error {
+	path := fmt.Sprintf("/api/v1/roles/%s", url.PathEscape(name))
+
+	return r.api.Do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+func (r *Roles) Assign(ctx context.Context, name string, assignment engine.RoleAssignment) error {
+	path := fmt.Sprintf("/api/v1/roles/%s/assignments", url.PathEscape(name))
+
+	return r.api.Do(ctx, http.MethodPut, path, assignment, nil)
+}
+
+func (r *Roles) Unassign(ctx context.Context, name string, assignment engine.RoleAssignment) error {
+	path := fmt.Sprintf("/api/v1/roles/%s/assignments", url.PathEscape(name))
+
+	return r.api.Do(ctx, http.MethodDelete, path, assignment, nil)
+}
+
+type Authz struct {
+	api *API
+}
+
+func (a *Authz) Check(ctx context.Context, req engine.AuthzCheckRequest) (engine.AuthzCheckResponse, error) {
+	resp := engine.AuthzCheckResponse{}
+	err := a.api.Do(ctx, http.MethodPost, "/api/v1/authz/check", req, &resp)
+
+	return resp, err
+}
+
+type RootKeys struct {
+	api *API
+}
+
+func (k *RootKeys) List(ctx context.Context) ([]engine.RootKeyVersion, error) {
+	versions := make([]engine.RootKeyVersion, 0)
+	err := k.api.Do(ctx, http.MethodGet, "/api/v1/root-keys", nil, &versions)
+
+	return versions, err
+}
+
+func (k *RootKeys) Activate(ctx context.Context, version string) error {
+	req := engine.UpdateActiveRootKeyRequest{Version: version}
+
+	return k.api.Do(ctx, http.MethodPut, "/api/v1/root-keys/active", req, nil)
+}
+
+func (k *RootKeys) Migrate(ctx context.Context, version string, req engine.MigrateServicesRequest) ([]engine.Service, error) {
+	path := fmt.Sprintf("/api/v1/root-keys/%s/services", url.PathEscape(version))
+
+	services := make([]engine.Service, 0)
+	err := k.api.Do(ctx, http.MethodPut, path, req, &services)
+
+	return services, err
+}
+
 type Services struct {
 	api *API
 }
@@ -120,6 +359,10 @@ func (s *Services) Grants() *Grants {
 	return &Grants{s.api}
 }
 
+func (s *Services) Requests() *Requests {
+	return &Requests{s.api}
+}
+
 func (s *Services) List(ctx context.Context) ([]engine.Service, error) {
 	services := make([]engine.Service, 0)
 	err := s.api.Do(ctx, http.MethodGet, "/api/v1/services", nil, &services)
@@ -145,6 +388,51 @@ func (s *Services) Credentials(ctx context.Context, kind, name string) (engine.S
 	return credentials, err
 }
 
+func (s *Services) TOTP(ctx context.Context, kind, name string) (engine.TOTP, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/totp", url.PathEscape(kind), url.PathEscape(name))
+
+	totp := engine.TOTP{}
+	err := s.api.Do(ctx, http.MethodGet, path, nil, &totp)
+
+	return totp, err
+}
+
+func (s *Services) SSHCertificateAuthority(ctx context.Context, kind, name string) (engine.SSHCertificateAuthority, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/ssh/ca", url.PathEscape(kind), url.PathEscape(name))
+
+	ca := engine.SSHCertificateAuthority{}
+	err := s.api.Do(ctx, http.MethodGet, path, nil, &ca)
+
+	return ca, err
+}
+
+func (s *Services) SignSSHKey(ctx context.Context, kind, name string, req engine.SignSSHKeyRequest) (engine.SSHCertificate, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/ssh/sign", url.PathEscape(kind), url.PathEscape(name))
+
+	certificate := engine.SSHCertificate{}
+	err := s.api.Do(ctx, http.MethodPost, path, req, &certificate)
+
+	return certificate, err
+}
+
+func (s *Services) CertificateAuthority(ctx context.Context, kind, name string) (engine.CertificateAuthority, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/x509/ca", url.PathEscape(kind), url.PathEscape(name))
+
+	ca := engine.CertificateAuthority{}
+	err := s.api.Do(ctx, http.MethodGet, path, nil, &ca)
+
+	return ca, err
+}
+
+func (s *Services) IssueCertificate(ctx context.Context, kind, name string, req engine.IssueCertificateRequest) (engine.ClientCertificate, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/x509/sign", url.PathEscape(kind), url.PathEscape(name))
+
+	certificate := engine.ClientCertificate{}
+	err := s.api.Do(ctx, http.MethodPost, path, req, &certificate)
+
+	return certificate, err
+}
+
 func (s *Services) Create(ctx context.Context, req engine.CreateServiceRequest) error {
 	return s.api.Do(ctx, http.MethodPost, "/api/v1/services", req, nil)
 }
@@ -186,6 +474,46 @@ func (a *Grants) Delete(ctx context.Context, kind, name string, grant engine.Use
 	return a.api.Do(ctx, http.MethodDelete, path, grant, nil)
 }
 
+type Requests struct {
+	api *API
+}
+
+func (a *Requests) List(ctx context.Context, kind, name string) ([]engine.AccessRequest, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/requests", url.PathEscape(kind), url.PathEscape(name))
+
+	requests := make([]engine.AccessRequest, 0)
+	err := a.api.Do(ctx, http.MethodGet, path, nil, &requests)
+
+	return requests, err
+}
+
+func (a *Requests) Create(ctx context.Context, kind, name string, req engine.CreateAccessRequestRequest) (engine.AccessRequest, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/requests", url.PathEscape(kind), url.PathEscape(name))
+
+	accessRequest := engine.AccessRequest{}
+	err := a.api.Do(ctx, http.MethodPost, path, req, &accessRequest)
+
+	return accessRequest, err
+}
+
+func (a *Requests) Get(ctx context.Context, kind, name, id string) (engine.AccessRequest, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/requests/%s", url.PathEscape(kind), url.PathEscape(name), url.PathEscape(id))
+
+	accessRequest := engine.AccessRequest{}
+	err := a.api.Do(ctx, http.MethodGet, path, nil, &accessRequest)
+
+	return accessRequest, err
+}
+
+func (a *Requests) Update(ctx context.Context, kind, name, id string, req engine.UpdateAccessRequestRequest) (engine.AccessRequest, error) {
+	path := fmt.Sprintf("/api/v1/services/%s/%s/requests/%s", url.PathEscape(kind), url.PathEscape(name), url.PathEscape(id))
+
+	accessRequest := engine.AccessRequest{}
+	err := a.api.Do(ctx, http.MethodPut, path, req, &accessRequest)
+
+	return accessRequest, err
+}
+
 type Users struct {
 	api *API
 }
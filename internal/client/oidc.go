@@ -0,0 +1,328 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
+
+	myagooidc "github.com/mjpitz/myago/auth/oidc"
+)
+
+// DefaultScopes defines the scopes requested during login when none are provided. The offline_access scope allows us
+// to obtain a refresh token so users aren't prompted to log in every time their ID token expires.
+var DefaultScopes = []string{oidc.ScopeOpenID, "profile", "email", oidc.ScopeOfflineAccess}
+
+// ErrLoginRequired is returned when the cached session can no longer be refreshed.
+var ErrLoginRequired = errors.New("session expired, please run varys login")
+
+// OIDCConfig defines the options used to log in to varys using an OIDC identity provider.
+type OIDCConfig struct {
+	Issuer       myagooidc.Issuer `json:"issuer"`
+	ClientID     string           `json:"client_id"     usage:"the client_id used when authenticating with the issuer"`
+	ClientSecret string           `json:"client_secret" usage:"the client_secret used when authenticating with the issuer (if required)"`
+	Scopes       *cli.StringSlice `json:"scopes"        usage:"the scopes requested during login [default: openid,profile,email,offline_access]"`
+}
+
+// DefaultTokenCache returns the default location of the token cache. Tokens are stored within the users' configuration
+// directory.
+func DefaultTokenCache() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "varys", "token.json"), nil
+}
+
+// CachedToken defines the information persisted to disk after a successful login. We persist the issuer information
+// alongside the token so subsequent commands are able to refresh the token without needing additional configuration.
+type CachedToken struct {
+	Issuer       myagooidc.Issuer `json:"issuer"`
+	ClientID     string           `json:"client_id"`
+	ClientSecret string           `json:"client_secret,omitempty"`
+	Token        *oauth2.Token    `json:"token"`
+	IDToken      string           `json:"id_token"`
+}
+
+// expiry parses the expiration from the ID token. The ID token is what's presented to varys, so its expiration is what
+// matters (not the access token's).
+func (c *CachedToken) expiry() time.Time {
+	parts := strings.Split(c.IDToken, ".")
+	if len(parts) < 2 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	claims := struct {
+		Expiry int64 `json:"exp"`
+	}{}
+
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Expiry, 0)
+}
+
+func (c *CachedToken) valid() bool {
+	return c.IDToken != "" && time.Now().Add(30*time.Second).Before(c.expiry())
+}
+
+// LoadToken reads a cached token from disk.
+func LoadToken(path string) (*CachedToken, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &CachedToken{}
+	if err = json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// SaveToken writes the cached token to disk. The file is only readable and writable by the current user.
+func SaveToken(path string, token *CachedToken) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	// WriteFile only applies permissions when creating the file
+	if err = os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// cachedTokenSource presents the cached ID token to varys, refreshing it and updating the cache once it expires.
+type cachedTokenSource struct {
+	ctx  context.Context
+	path string
+
+	mu     sync.Mutex
+	cached *CachedToken
+}
+
+func (s *cachedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.cached.valid() {
+		if s.cached.Token == nil || s.cached.Token.RefreshToken == "" {
+			return nil, ErrLoginRequired
+		}
+
+		provider, err := s.cached.Issuer.Provider(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &oauth2.Config{
+			ClientID:     s.cached.ClientID,
+			ClientSecret: s.cached.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+		}
+
+		// the access token may outlive the id token, so force the refresh
+		expired := *s.cached.Token
+		expired.Expiry = time.Now().Add(-time.Minute)
+
+		token, err := config.TokenSource(s.ctx, &expired).Token()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrLoginRequired, err)
+		}
+
+		idToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return nil, ErrLoginRequired
+		}
+
+		s.cached.Token = token
+		s.cached.IDToken = idToken
+
+		if err = SaveToken(s.path, s.cached); err != nil {
+			return nil, err
+		}
+	}
+
+	return &oauth2.Token{
+		TokenType:   "bearer",
+		AccessToken: s.cached.IDToken,
+		Expiry:      s.cached.expiry(),
+	}, nil
+}
+
+func randomString(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Login performs an OIDC authorization code flow using a loopback redirect (RFC 8252) and PKCE. The authorize function
+// is called with the URL the user must visit to complete the login.
+func Login(ctx context.Context, cfg OIDCConfig, authorize func(url string) error) (*CachedToken, error) {
+	if cfg.Issuer.ServerURL == "" || cfg.ClientID == "" {
+		return nil, fmt.Errorf("an issuer server_url and client_id are required to login")
+	}
+
+	provider, err := cfg.Issuer.Provider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	scopes := DefaultScopes
+	if cfg.Scopes != nil && len(cfg.Scopes.Value()) > 0 {
+		scopes = cfg.Scopes.Value()
+	}
+
+	config := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  fmt.Sprintf("http://%s/callback", listener.Addr().String()),
+		Scopes:       scopes,
+	}
+
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	type result struct {
+		token *oauth2.Token
+		err   error
+	}
+
+	results := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		switch {
+		case query.Get("error") != "":
+			http.Error(w, query.Get("error")+": "+query.Get("error_description"), http.StatusBadRequest)
+			results <- result{err: fmt.Errorf("%s: %s", query.Get("error"), query.Get("error_description"))}
+			return
+		case query.Get("state") != state:
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		token, err := config.Exchange(r.Context(), query.Get("code"),
+			oauth2.SetAuthURLParam("code_verifier", verifier))
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			results <- result{err: err}
+			return
+		}
+
+		_, _ = w.Write([]byte("You have successfully logged in. You may now close this tab in your browser."))
+		results <- result{token: token}
+	})
+
+	svr := &http.Server{Handler: mux}
+	go func() { _ = svr.Serve(listener) }()
+	defer svr.Close()
+
+	url := config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	if err = authorize(url); err != nil {
+		return nil, err
+	}
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res = <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+	}
+
+	idToken, ok := res.token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("issuer did not return an id_token")
+	}
+
+	_, err = provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}).Verify(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedToken{
+		Issuer:       cfg.Issuer,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Token:        res.token,
+		IDToken:      idToken,
+	}, nil
+}
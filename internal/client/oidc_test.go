@@ -0,0 +1,177 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	myagooidc "github.com/mjpitz/myago/auth/oidc"
+)
+
+// idToken produces an unsigned ID token that expires at the provided time. The client only inspects the claims, so
+// the signature is never checked.
+func idToken(t *testing.T, expiry time.Time) string {
+	payload, err := json.Marshal(map[string]interface{}{"exp": expiry.Unix()})
+	require.NoError(t, err)
+
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln"
+}
+
+// issuer starts an OIDC provider whose token endpoint exchanges the refresh token for a new ID token. The returned
+// counter tracks the number of refreshes performed.
+func issuer(t *testing.T, refreshToken, token string) (myagooidc.Issuer, *int) {
+	refreshes := 0
+
+	mux := http.NewServeMux()
+	svr := httptest.NewServer(mux)
+	t.Cleanup(svr.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 svr.URL,
+			"authorization_endpoint": svr.URL + "/authorize",
+			"token_endpoint":         svr.URL + "/token",
+			"jwks_uri":               svr.URL + "/keys",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != refreshToken {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		refreshes++
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"token_type":    "bearer",
+			"refresh_token": refreshToken,
+			"expires_in":    3600,
+			"id_token":      token,
+		})
+	})
+
+	return myagooidc.Issuer{ServerURL: svr.URL}, &refreshes
+}
+
+func TestTokenCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "varys", "token.json")
+
+	token := &CachedToken{
+		ClientID: "varys",
+		Token:    &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"},
+		IDToken:  idToken(t, time.Now().Add(time.Hour)),
+	}
+
+	// permissions must be restricted even when the cache was previously written with looser ones
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path+".tmp", nil, 0644))
+
+	require.NoError(t, SaveToken(path, token))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := LoadToken(path)
+	require.NoError(t, err)
+	require.Equal(t, token.ClientID, loaded.ClientID)
+	require.Equal(t, token.IDToken, loaded.IDToken)
+	require.Equal(t, "refresh", loaded.Token.RefreshToken)
+	require.True(t, loaded.valid())
+
+	// corrupt caches are reported instead of being treated as a missing session
+	require.NoError(t, ioutil.WriteFile(path, []byte("{not json"), 0600))
+
+	_, err = LoadToken(path)
+	require.Error(t, err)
+
+	_, err = NewAPI(context.Background(), Config{TokenCache: path})
+	require.Error(t, err)
+}
+
+func TestCachedTokenSource(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "token.json")
+
+	current := idToken(t, time.Now().Add(time.Hour))
+	refreshed := idToken(t, time.Now().Add(2*time.Hour))
+
+	iss, refreshes := issuer(t, "refresh", refreshed)
+
+	source := &cachedTokenSource{
+		ctx:  ctx,
+		path: path,
+		cached: &CachedToken{
+			Issuer:   iss,
+			ClientID: "varys",
+			Token:    &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)},
+			IDToken:  current,
+		},
+	}
+
+	// valid id tokens are presented without refreshing
+	token, err := source.Token()
+	require.NoError(t, err)
+	require.Equal(t, current, token.AccessToken)
+	require.Equal(t, 0, *refreshes)
+
+	// id tokens are refreshed as they near expiry, even when the access token is still valid
+	source.cached.IDToken = idToken(t, time.Now().Add(10*time.Second))
+
+	token, err = source.Token()
+	require.NoError(t, err)
+	require.Equal(t, refreshed, token.AccessToken)
+	require.Equal(t, 1, *refreshes)
+
+	// the refreshed token is written back to the cache
+	cached, err := LoadToken(path)
+	require.NoError(t, err)
+	require.Equal(t, refreshed, cached.IDToken)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// sessions that can no longer be refreshed require the user to log in again
+	source.cached.IDToken = idToken(t, time.Now().Add(-time.Minute))
+	source.cached.Token.RefreshToken = "revoked"
+
+	_, err = source.Token()
+	require.ErrorIs(t, err, ErrLoginRequired)
+
+	source.cached.Token.RefreshToken = ""
+
+	_, err = source.Token()
+	require.ErrorIs(t, err, ErrLoginRequired)
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent starts an ephemeral ssh-agent that holds the provided keys. The agent listens on a unix socket within the
+// provided directory and stops once the context is canceled. The path to the socket is returned so it can be provided
+// to programs using SSH_AUTH_SOCK.
+func serveAgent(ctx context.Context, dir string, keys ...agent.AddedKey) (string, error) {
+	keyring := agent.NewKeyring()
+
+	for _, key := range keys {
+		if err := keyring.Add(key); err != nil {
+			return "", err
+		}
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socket, nil
+}
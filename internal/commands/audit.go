@@ -0,0 +1,128 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+type AuditListConfig struct {
+	Since time.Duration `json:"since" usage:"only show entries recorded within the given duration (e.g. 24h)"`
+	Actor string        `json:"actor" usage:"only show entries for the given actor (e.g. /_user/basic/...)"`
+}
+
+// AuditVerifyConfig accepts the head reported by an earlier verification. Keeping a copy of the head outside of varys
+// allows verification to detect the log being truncated or rolled back.
+type AuditVerifyConfig struct {
+	Sequence int    `json:"sequence" usage:"the sequence of the head reported by an earlier verification"`
+	Hash     string `json:"hash"     usage:"the hash of the head reported by an earlier verification"`
+}
+
+var (
+	auditListConfig   = &AuditListConfig{}
+	auditVerifyConfig = &AuditVerifyConfig{}
+
+	Audit = &cli.Command{
+		Name:  "audit",
+		Usage: "Inspect the audit log.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List entries in the audit log.",
+				ArgsUsage: " ",
+				Flags:     flagset.ExtractPrefix("varys_audit", auditListConfig),
+				Action: func(ctx *cli.Context) error {
+					filter := engine.AuditFilter{
+						Actor: auditListConfig.Actor,
+					}
+
+					if auditListConfig.Since > 0 {
+						filter.Since = time.Now().Add(-auditListConfig.Since)
+					}
+
+					api := client.Extract(ctx.Context)
+
+					entries, err := api.Audit().List(ctx.Context, filter)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+					table.SetHeader([]string{"Sequence", "Timestamp", "Actor", "Action", "Target", "Source", "Outcome", "Details"})
+
+					for _, entry := range entries {
+						table.Append([]string{
+							strconv.FormatUint(entry.Sequence, 10),
+							entry.Timestamp.Local().Format(time.RFC3339),
+							entry.Actor, entry.Action, entry.Target, entry.SourceIP,
+							fmt.Sprintf("%s (%d)", entry.Outcome, entry.Status),
+							string(entry.Details),
+						})
+					}
+
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Verify the hash chain of the audit log, detecting entries that were modified or removed.",
+				ArgsUsage: " ",
+				Flags:     flagset.ExtractPrefix("varys_audit", auditVerifyConfig),
+				Action: func(ctx *cli.Context) error {
+					api := client.Extract(ctx.Context)
+
+					var head *engine.AuditHead
+					if auditVerifyConfig.Sequence > 0 {
+						head = &engine.AuditHead{Sequence: uint64(auditVerifyConfig.Sequence), Hash: auditVerifyConfig.Hash}
+					}
+
+					verification, err := api.Audit().Verify(ctx.Context, head)
+					if err != nil {
+						return err
+					} else if verification.Error != "" {
+						return errors.New(verification.Error)
+					}
+
+					_, err = fmt.Fprintf(ctx.App.Writer, "verified %d entries, head %d %s\n",
+						verification.Entries, verification.Head.Sequence, verification.Head.Hash)
+					return err
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -0,0 +1,105 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+type authzCheckConfig struct {
+	User    user   `json:"user"`
+	Subject string `json:"subject" usage:"check a specific subject (e.g. a role or /_group/{name}) in place of a user"`
+}
+
+var (
+	checkAuthzConfig = authzCheckConfig{}
+
+	Authz = &cli.Command{
+		Name:  "authz",
+		Usage: "Debug access to varys and the services it manages.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "check",
+				Usage:     "Explain whether a user or subject is allowed to perform an action on an object.",
+				ArgsUsage: "<object> <action>",
+				Description: "Objects are either API paths (e.g. /api/v1/audit with an action of GET) or services " +
+					"(e.g. /_service/postgres/prod with an action of read).",
+				Flags: flagset.ExtractPrefix("varys_authz_check", &checkAuthzConfig),
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+
+					req := engine.AuthzCheckRequest{
+						User: engine.User{
+							Kind: checkAuthzConfig.User.Kind,
+							ID:   checkAuthzConfig.User.ID,
+						},
+						Subject: checkAuthzConfig.Subject,
+						Object:  args.Get(0),
+						Action:  args.Get(1),
+					}
+
+					switch {
+					case req.Object == "" || req.Action == "":
+						return fmt.Errorf("expecting two arguments: <object> <action>")
+					case req.Subject == "" && (req.User.Kind == "" || req.User.ID == ""):
+						return fmt.Errorf("must provide a user kind and id, or a subject")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					resp, err := api.Authz().Check(ctx.Context, req)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+
+					table.Append([]string{"ALLOWED", strconv.FormatBool(resp.Allowed)})
+					table.Append([]string{"SUBJECTS", strings.Join(resp.Subjects, ", ")})
+
+					if resp.Allowed {
+						table.Append([]string{"SUBJECT", resp.Subject})
+						table.Append([]string{"POLICY", strings.Join(resp.Policy, ", ")})
+						table.Append([]string{"ROLES", strings.Join(resp.Roles, " -> ")})
+					}
+
+					table.Render()
+					return nil
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
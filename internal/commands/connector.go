@@ -0,0 +1,111 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/connector"
+	"github.com/mjpitz/varys/internal/connector/postgres"
+	"github.com/mjpitz/varys/internal/connector/redis"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+type ConnectorConfig struct {
+	Type     string          `json:"type"     usage:"the type of connector to run (defaults to the kind of the service) [options: postgres,redis]"`
+	Interval time.Duration   `json:"interval" usage:"how frequently credentials are polled and reconciled" default:"1m"`
+	DryRun   bool            `json:"dry_run"  usage:"log the changes that would be made without applying them"`
+	Postgres postgres.Config `json:"postgres"`
+	Redis    redis.Config    `json:"redis"`
+}
+
+// newConnector constructs the connector for the provided type.
+func newConnector(ctx context.Context, kind string) (connector.Connector, error) {
+	switch kind {
+	case "postgres":
+		return postgres.Open(ctx, connectorConfig.Postgres)
+	case "redis":
+		return redis.Open(ctx, connectorConfig.Redis)
+	default:
+		return nil, fmt.Errorf("unsupported connector type: %s", kind)
+	}
+}
+
+var (
+	connectorConfig = &ConnectorConfig{}
+
+	Connector = &cli.Command{
+		Name:  "connector",
+		Usage: "Provision user accounts within services managed by varys.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "run",
+				Usage:     "Reconcile the credentials granted for a service into the target system.",
+				ArgsUsage: "<kind> <name>",
+				Flags:     flagset.ExtractPrefix("varys_connector", connectorConfig),
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+
+					kind := args.Get(0)
+					name := args.Get(1)
+
+					if kind == "" || name == "" {
+						return fmt.Errorf("expecting two arguments: <kind> <name>")
+					}
+
+					kindType := connectorConfig.Type
+					if kindType == "" {
+						kindType = kind
+					}
+
+					conn, err := newConnector(ctx.Context, kindType)
+					if err != nil {
+						return err
+					}
+
+					api := client.Extract(ctx.Context)
+
+					reconciler := &connector.Reconciler{
+						Connector: conn,
+						DryRun:    connectorConfig.DryRun,
+					}
+
+					return reconciler.Run(ctx.Context, connectorConfig.Interval, func(ctx context.Context) ([]engine.UserCredential, error) {
+						return api.Credentials().List(ctx, kind, name)
+					})
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -0,0 +1,119 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+)
+
+var (
+	updateKindGrantRequest = grantRequest{}
+
+	deleteKindGrantRequest = grantRequest{}
+
+	Kinds = &cli.Command{
+		Name:  "kinds",
+		Usage: "Perform operations that apply to every service of a given kind.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "grants",
+				Usage: "Manage who has access to every service of a given kind.",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "list",
+						Usage:     "List all users and groups who have access to every service of a kind and their permissions.",
+						ArgsUsage: "<kind>",
+						Action: func(ctx *cli.Context) error {
+							kind := ctx.Args().Get(0)
+							if kind == "" {
+								return fmt.Errorf("expecting one argument: <kind>")
+							}
+
+							api := client.Extract(ctx.Context)
+
+							grants, err := api.Kinds().Grants().List(ctx.Context, kind)
+							if err != nil {
+								return err
+							}
+
+							renderGrants(ctx.App.Writer, grants)
+							return nil
+						},
+					},
+					{
+						Name:      "update",
+						Usage:     "Update a user or group's access to every service of a kind, optionally for a limited time.",
+						ArgsUsage: "<kind>",
+						Flags:     flagset.ExtractPrefix("varys_update_kind_grant", &updateKindGrantRequest),
+						Action: func(ctx *cli.Context) error {
+							kind := ctx.Args().Get(0)
+							if kind == "" {
+								return fmt.Errorf("expecting one argument: <kind>")
+							}
+
+							grant, err := updateKindGrantRequest.grant(kind)
+							if err != nil {
+								return err
+							}
+
+							api := client.Extract(ctx.Context)
+
+							return api.Kinds().Grants().Update(ctx.Context, kind, grant)
+						},
+					},
+					{
+						Name:      "delete",
+						Usage:     "Remove a user or group's access to every service of a kind.",
+						ArgsUsage: "<kind>",
+						Flags:     flagset.ExtractPrefix("varys_delete_kind_grant", &deleteKindGrantRequest),
+						Action: func(ctx *cli.Context) error {
+							kind := ctx.Args().Get(0)
+							if kind == "" {
+								return fmt.Errorf("expecting one argument: <kind>")
+							}
+
+							grant, err := deleteKindGrantRequest.grant(kind)
+							if err != nil {
+								return err
+							}
+
+							api := client.Extract(ctx.Context)
+
+							return api.Kinds().Grants().Delete(ctx.Context, kind, grant)
+						},
+					},
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -0,0 +1,71 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/browser"
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+)
+
+type LoginConfig struct {
+	TokenCache string            `json:"token_cache" usage:"the path to write the token cache to"`
+	OIDC       client.OIDCConfig `json:"oidc"`
+}
+
+var (
+	loginConfig = &LoginConfig{}
+
+	Login = &cli.Command{
+		Name:      "login",
+		Usage:     "Login to varys using an OIDC identity provider.",
+		ArgsUsage: " ",
+		Flags:     flagset.ExtractPrefix("varys", loginConfig),
+		Action: func(ctx *cli.Context) error {
+			path := loginConfig.TokenCache
+			if path == "" {
+				var err error
+				if path, err = client.DefaultTokenCache(); err != nil {
+					return err
+				}
+			}
+
+			token, err := client.Login(ctx.Context, loginConfig.OIDC, func(url string) error {
+				_, _ = fmt.Fprintf(ctx.App.Writer, "Opening a browser to complete the login. If it does not open, visit:\n\n  %s\n\n", url)
+				_ = browser.Open(ctx.Context, url)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			err = client.SaveToken(path, token)
+			if err != nil {
+				return err
+			}
+
+			_, _ = fmt.Fprintln(ctx.App.Writer, "Login successful.")
+			return nil
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -0,0 +1,235 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+type roleRequest struct {
+	Policy  *cli.StringSlice `json:"policy"  usage:"the policies for the role, formatted as '<object> <action>' where the action is a regular expression"`
+	Inherit *cli.StringSlice `json:"inherit" usage:"the roles this role inherits from"`
+}
+
+type roleAssignment struct {
+	User  user   `json:"user"`
+	Group string `json:"group" usage:"specify an identity provider group in place of a user"`
+}
+
+// assignment converts the flags into a role assignment, ensuring either a user or group was specified.
+func (req roleAssignment) assignment() (engine.RoleAssignment, error) {
+	switch {
+	case req.Group != "" && (req.User.Kind != "" || req.User.ID != ""):
+		return engine.RoleAssignment{}, fmt.Errorf("must provide either a user or a group, not both")
+	case req.Group == "" && (req.User.Kind == "" || req.User.ID == ""):
+		return engine.RoleAssignment{}, fmt.Errorf("must provide a user kind and id, or a group")
+	}
+
+	return engine.RoleAssignment{
+		User: engine.User{
+			Kind: req.User.Kind,
+			ID:   req.User.ID,
+		},
+		Group: req.Group,
+	}, nil
+}
+
+var (
+	updateRoleRequest = roleRequest{
+		Policy:  cli.NewStringSlice(),
+		Inherit: cli.NewStringSlice(),
+	}
+
+	assignRoleRequest = roleAssignment{}
+
+	unassignRoleRequest = roleAssignment{}
+
+	Roles = &cli.Command{
+		Name:  "roles",
+		Usage: "Manage roles, their policies, and who they're assigned to.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List the roles known to varys.",
+				ArgsUsage: " ",
+				Action: func(ctx *cli.Context) error {
+					api := client.Extract(ctx.Context)
+
+					roles, err := api.Roles().List(ctx.Context)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+					table.SetHeader([]string{"Name", "Managed", "Policies", "Inherits", "Members"})
+
+					for _, role := range roles {
+						table.Append([]string{
+							role.Name,
+							strconv.FormatBool(role.Managed),
+							strconv.Itoa(len(role.Policies)),
+							strings.Join(role.Roles, ", "),
+							strconv.Itoa(len(role.Members)),
+						})
+					}
+
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "Get a role from varys.",
+				ArgsUsage: "<role>",
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().Get(0)
+					if name == "" {
+						return fmt.Errorf("expecting one argument: <role>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					role, err := api.Roles().Get(ctx.Context, name)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+
+					table.Append([]string{"NAME", role.Name})
+					table.Append([]string{"MANAGED", strconv.FormatBool(role.Managed)})
+
+					for _, policy := range role.Policies {
+						table.Append([]string{"POLICY", policy.Object + " " + policy.Action})
+					}
+
+					table.Append([]string{"INHERITS", strings.Join(role.Roles, ", ")})
+					table.Append([]string{"MEMBERS", strings.Join(role.Members, ", ")})
+
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:      "update",
+				Usage:     "Create or replace a custom role.",
+				ArgsUsage: "<role>",
+				Flags:     flagset.ExtractPrefix("varys_update_role", &updateRoleRequest),
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().Get(0)
+					if name == "" {
+						return fmt.Errorf("expecting one argument: <role>")
+					}
+
+					req := engine.PutRoleRequest{
+						Policies: make([]engine.Policy, 0),
+						Roles:    updateRoleRequest.Inherit.Value(),
+					}
+
+					for _, policy := range updateRoleRequest.Policy.Value() {
+						parts := strings.Fields(policy)
+						if len(parts) != 2 {
+							return fmt.Errorf("invalid policy %q: expecting '<object> <action>'", policy)
+						}
+
+						req.Policies = append(req.Policies, engine.Policy{Object: parts[0], Action: parts[1]})
+					}
+
+					api := client.Extract(ctx.Context)
+
+					return api.Roles().Update(ctx.Context, name, req)
+				},
+			},
+			{
+				Name:      "delete",
+				Usage:     "Delete a custom role along with its assignments.",
+				ArgsUsage: "<role>",
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().Get(0)
+					if name == "" {
+						return fmt.Errorf("expecting one argument: <role>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					return api.Roles().Delete(ctx.Context, name)
+				},
+			},
+			{
+				Name:      "assign",
+				Usage:     "Assign a role to a user or group.",
+				ArgsUsage: "<role>",
+				Flags:     flagset.ExtractPrefix("varys_assign_role", &assignRoleRequest),
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().Get(0)
+					if name == "" {
+						return fmt.Errorf("expecting one argument: <role>")
+					}
+
+					assignment, err := assignRoleRequest.assignment()
+					if err != nil {
+						return err
+					}
+
+					api := client.Extract(ctx.Context)
+
+					return api.Roles().Assign(ctx.Context, name, assignment)
+				},
+			},
+			{
+				Name:      "unassign",
+				Usage:     "Remove a role from a user or group.",
+				ArgsUsage: "<role>",
+				Flags:     flagset.ExtractPrefix("varys_unassign_role", &unassignRoleRequest),
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().Get(0)
+					if name == "" {
+						return fmt.Errorf("expecting one argument: <role>")
+					}
+
+					assignment, err := unassignRoleRequest.assignment()
+					if err != nil {
+						return err
+					}
+
+					api := client.Extract(ctx.Context)
+
+					return api.Roles().Unassign(ctx.Context, name, assignment)
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
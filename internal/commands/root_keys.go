@@ -0,0 +1,121 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+var (
+	migrateServicesRequest = engine.MigrateServicesRequest{}
+
+	RootKeys = &cli.Command{
+		Name:  "root-keys",
+		Usage: "Manage the versions of the root key used to derive credentials.",
+		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List the versions of the root key and how many services use each.",
+				ArgsUsage: " ",
+				Action: func(ctx *cli.Context) error {
+					api := client.Extract(ctx.Context)
+
+					versions, err := api.RootKeys().List(ctx.Context)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+					table.SetHeader([]string{"Version", "Active", "Services"})
+
+					for _, version := range versions {
+						table.Append([]string{
+							version.Version,
+							strconv.FormatBool(version.Active),
+							strconv.Itoa(version.Services),
+						})
+					}
+
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:      "activate",
+				Usage:     "Set the version of the root key used by newly created services.",
+				ArgsUsage: "<version>",
+				Action: func(ctx *cli.Context) error {
+					version := ctx.Args().Get(0)
+					if version == "" {
+						return fmt.Errorf("expecting one argument: <version>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					return api.RootKeys().Activate(ctx.Context, version)
+				},
+			},
+			{
+				Name:      "migrate",
+				Usage:     "Migrate existing services to derive credentials from the provided version of the root key.",
+				ArgsUsage: "<version>",
+				Flags:     flagset.ExtractPrefix("varys_migrate", &migrateServicesRequest),
+				Action: func(ctx *cli.Context) error {
+					version := ctx.Args().Get(0)
+					if version == "" {
+						return fmt.Errorf("expecting one argument: <version>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					services, err := api.RootKeys().Migrate(ctx.Context, version, migrateServicesRequest)
+					if err != nil {
+						return err
+					}
+
+					table := newTable(ctx.App.Writer)
+					table.SetHeader([]string{"Kind", "Name", "Root Key Version"})
+
+					for _, service := range services {
+						table.Append([]string{service.Kind, service.Name, service.RootKeyVersion})
+					}
+
+					table.Render()
+					return nil
+				},
+			},
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -20,6 +20,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -42,6 +43,7 @@ import (
 	"github.com/mjpitz/myago/livetls"
 	"github.com/mjpitz/myago/zaputil"
 	"github.com/mjpitz/varys/internal/engine"
+	"github.com/mjpitz/varys/internal/oidcauth"
 )
 
 type EncryptionConfig struct {
@@ -55,17 +57,48 @@ type DatabaseConfig struct {
 }
 
 type CredentialConfig struct {
-	RootKey string `json:"root_key" usage:"specify the root key used to derive credentials from"`
+	RootKey            string           `json:"root_key"              usage:"specify the root key used to derive credentials from"`
+	RootKeys           *cli.StringSlice `json:"root_keys"             usage:"specify additional versions of the root key, formatted as version=key"`
+	AllowRootKeyChange bool             `json:"allow_root_key_change" usage:"allow the server to start with a root key that differs from the one previously used, changing all derived credentials"`
+	GracePeriod        time.Duration    `json:"grace_period"          usage:"how long the previous credentials remain valid after a service key or user counter is rotated" default:"24h"`
+}
+
+type GroupConfig struct {
+	LegacyRoles   string        `json:"legacy_roles"   usage:"how to handle roles assigned to users that earlier versions may have added for their groups (options: remove, keep)"`
+	MembershipTTL time.Duration `json:"membership_ttl" usage:"how long the groups reported on a users' most recent request are used to provision credentials for roles granted to a group" default:"24h"`
+}
+
+type GrantConfig struct {
+	ReapInterval time.Duration `json:"reap_interval" usage:"how frequently expired grants are removed" default:"30s"`
+}
+
+type RotationConfig struct {
+	Interval time.Duration `json:"interval" usage:"how frequently services are checked for scheduled key rotations" default:"1m"`
+}
+
+type SSHConfig struct {
+	CertificateTTL time.Duration `json:"certificate_ttl" usage:"the maximum amount of time ssh certificates are valid for" default:"1h"`
+}
+
+type X509Config struct {
+	CertificateTTL time.Duration `json:"certificate_ttl" usage:"the maximum amount of time client certificates are valid for" default:"1h"`
 }
 
 type RunConfig struct {
+	Dev         bool             `json:"dev"          usage:"run in development mode, allowing an empty root key"`
 	BindAddress string           `json:"bind_address" usage:"specify the address to bind to" default:"localhost:3456"`
 	TLS         livetls.Config   `json:"tls"`
 	Database    DatabaseConfig   `json:"database"`
 	Credential  CredentialConfig `json:"credential"`
+	Group       GroupConfig      `json:"group"`
+	Grant       GrantConfig      `json:"grant"`
+	Rotation    RotationConfig   `json:"rotation"`
+	SSH         SSHConfig        `json:"ssh"`
+	X509        X509Config       `json:"x509"`
 
 	auth.Config
 	Basic basicauth.Config `json:"basic"`
+	OIDC  oidcauth.Config  `json:"oidc"`
 }
 
 var (
@@ -73,6 +106,9 @@ var (
 		Config: auth.Config{
 			AuthType: "basic",
 		},
+		Credential: CredentialConfig{
+			RootKeys: cli.NewStringSlice(),
+		},
 		Basic: basicauth.Config{
 			StaticUsername: "badadmin",
 			StaticPassword: "badadmin",
@@ -92,6 +128,14 @@ var (
 				_ = runConfig.Basic.StaticGroups.Set("admin:varys")
 			}
 
+			if runConfig.Credential.RootKey == "" {
+				if !runConfig.Dev {
+					return fmt.Errorf("%w, set --credential-root-key or run with --dev", engine.ErrEmptyRootKey)
+				}
+
+				log.Warn("running in development mode without a root key, credentials are not secure")
+			}
+
 			tlsConfig, err := livetls.New(ctx.Context, runConfig.TLS)
 			if err != nil {
 				return err
@@ -107,7 +151,10 @@ var (
 					return err
 				}
 			case "oidc":
-				return fmt.Errorf("oidc not yet supported")
+				authFn, err = oidcauth.Handler(ctx.Context, runConfig.OIDC)
+				if err != nil {
+					return err
+				}
 			default:
 				return fmt.Errorf("unsupported auth type: %s", runConfig.AuthType)
 			}
@@ -127,6 +174,21 @@ var (
 			}
 			defer db.Close()
 
+			keys, err := engine.ParseKeyRing(runConfig.Credential.RootKey, runConfig.Credential.RootKeys.Value())
+			if err != nil {
+				return err
+			}
+
+			changed, err := engine.VerifyRootKeys(db, keys, runConfig.Credential.AllowRootKeyChange)
+			switch {
+			case errors.Is(err, engine.ErrRootKeyChanged):
+				return fmt.Errorf("%w, pass --credential-allow-root-key-change to proceed anyways", err)
+			case err != nil:
+				return err
+			case len(changed) > 0:
+				log.Warn("root key changed, all credentials derived from it have changed", zap.Strings("versions", changed))
+			}
+
 			adapter := engine.NewCasbinAdapter(db)
 			model, err := model.NewModelFromString(engine.Model)
 			if err != nil {
@@ -151,7 +213,38 @@ var (
 			}
 
 			log.Info("setting up api")
-			api := engine.NewAPI(db, enforcer, runConfig.Credential.RootKey)
+			api := engine.NewAPI(db, enforcer, keys)
+			api.RotationGracePeriod = runConfig.Credential.GracePeriod
+			api.SSHCertificateTTL = runConfig.SSH.CertificateTTL
+			api.CertificateTTL = runConfig.X509.CertificateTTL
+			api.GroupMembershipTTL = runConfig.Group.MembershipTTL
+
+			err = api.CheckRootKeys(ctx.Context)
+			if err != nil {
+				return err
+			}
+
+			err = api.EnsureServicePolicies(ctx.Context)
+			if err != nil {
+				return err
+			}
+
+			err = api.RemoveGroupRoles(ctx.Context)
+			if err != nil {
+				return err
+			}
+
+			legacy, err := api.ResolveLegacyGroupRoles(ctx.Context, runConfig.Group.LegacyRoles)
+			for _, rule := range legacy {
+				log.Warn("found role that may have been added for a group by an earlier version",
+					zap.String("user", rule[0]), zap.String("role", rule[1]))
+			}
+
+			if errors.Is(err, engine.ErrLegacyGroupRoles) {
+				return fmt.Errorf("%w: set VARYS_GROUP_LEGACY_ROLES to remove or keep them", err)
+			} else if err != nil {
+				return err
+			}
 
 			router := mux.NewRouter()
 			router.StrictSlash(true)
@@ -162,6 +255,7 @@ var (
 			apiRouter.Use(func(handler http.Handler) http.Handler {
 				// handler needs to be in reverse order since it works using delegation
 				handler = engine.Middleware(handler, api, runConfig.AuthType)
+				handler = engine.AuditMiddleware(handler, api, runConfig.AuthType)
 				handler = httpauth.Handler(handler, authFn, auth.Required())
 				handler = headers.HTTP(handler)
 
@@ -169,18 +263,49 @@ var (
 			})
 
 			credentials := apiRouter.PathPrefix("/v1/credentials").Subrouter()
-			credentials.HandleFunc("/{kind}/{name}", api.ListCredentials).Methods(http.MethodGet)
+			credentials.HandleFunc("/{kind}/{name}", api.ListCredentials).Methods(http.MethodGet).Name("credentials.list")
 
 			services := apiRouter.PathPrefix("/v1/services").Subrouter()
 			services.HandleFunc("", api.ListServices).Methods(http.MethodGet)
-			services.HandleFunc("", api.CreateService).Methods(http.MethodPost)
+			services.HandleFunc("", api.CreateService).Methods(http.MethodPost).Name("services.create")
 			services.HandleFunc("/{kind}/{name}", api.GetService).Methods(http.MethodGet)
-			services.HandleFunc("/{kind}/{name}", api.UpdateService).Methods(http.MethodPut)
-			services.HandleFunc("/{kind}/{name}", api.DeleteService).Methods(http.MethodDelete)
-			services.HandleFunc("/{kind}/{name}/credentials", api.GetServiceCredentials).Methods(http.MethodGet)
+			services.HandleFunc("/{kind}/{name}", api.UpdateService).Methods(http.MethodPut).Name("services.update")
+			services.HandleFunc("/{kind}/{name}", api.DeleteService).Methods(http.MethodDelete).Name("services.delete")
+			services.HandleFunc("/{kind}/{name}/credentials", api.GetServiceCredentials).Methods(http.MethodGet).Name("services.credentials.get")
+			services.HandleFunc("/{kind}/{name}/totp", api.GetServiceTOTP).Methods(http.MethodGet).Name("services.totp.get")
+			services.HandleFunc("/{kind}/{name}/ssh/ca", api.GetSSHCertificateAuthority).Methods(http.MethodGet)
+			services.HandleFunc("/{kind}/{name}/ssh/sign", api.SignSSHKey).Methods(http.MethodPost).Name("services.ssh.sign")
+			services.HandleFunc("/{kind}/{name}/x509/ca", api.GetCertificateAuthority).Methods(http.MethodGet)
+			services.HandleFunc("/{kind}/{name}/x509/sign", api.IssueCertificate).Methods(http.MethodPost).Name("services.x509.sign")
 			services.HandleFunc("/{kind}/{name}/grants", api.ListGrants).Methods(http.MethodGet)
-			services.HandleFunc("/{kind}/{name}/grants", api.PutGrant).Methods(http.MethodPut)
-			services.HandleFunc("/{kind}/{name}/grants", api.DeleteGrant).Methods(http.MethodDelete)
+			services.HandleFunc("/{kind}/{name}/grants", api.PutGrant).Methods(http.MethodPut).Name("services.grants.update")
+			services.HandleFunc("/{kind}/{name}/grants", api.DeleteGrant).Methods(http.MethodDelete).Name("services.grants.delete")
+			services.HandleFunc("/{kind}/{name}/requests", api.ListAccessRequests).Methods(http.MethodGet)
+			services.HandleFunc("/{kind}/{name}/requests", api.CreateAccessRequest).Methods(http.MethodPost).Name("services.requests.create")
+			services.HandleFunc("/{kind}/{name}/requests/{id}", api.GetAccessRequest).Methods(http.MethodGet)
+			services.HandleFunc("/{kind}/{name}/requests/{id}", api.UpdateAccessRequest).Methods(http.MethodPut).Name("services.requests.update")
+
+			kinds := apiRouter.PathPrefix("/v1/kinds").Subrouter()
+			kinds.HandleFunc("/{kind}/grants", api.ListKindGrants).Methods(http.MethodGet)
+			kinds.HandleFunc("/{kind}/grants", api.PutKindGrant).Methods(http.MethodPut).Name("kinds.grants.update")
+			kinds.HandleFunc("/{kind}/grants", api.DeleteKindGrant).Methods(http.MethodDelete).Name("kinds.grants.delete")
+
+			apiRouter.HandleFunc("/v1/audit", api.ListAuditEntries).Methods(http.MethodGet)
+			apiRouter.HandleFunc("/v1/audit/verify", api.VerifyAuditEntries).Methods(http.MethodGet)
+			apiRouter.HandleFunc("/v1/authz/check", api.CheckAuthz).Methods(http.MethodPost)
+
+			rootKeys := apiRouter.PathPrefix("/v1/root-keys").Subrouter()
+			rootKeys.HandleFunc("", api.ListRootKeys).Methods(http.MethodGet)
+			rootKeys.HandleFunc("/active", api.UpdateActiveRootKey).Methods(http.MethodPut).Name("root-keys.activate")
+			rootKeys.HandleFunc("/{version}/services", api.MigrateServices).Methods(http.MethodPut).Name("root-keys.migrate")
+
+			roles := apiRouter.PathPrefix("/v1/roles").Subrouter()
+			roles.HandleFunc("", api.ListRoles).Methods(http.MethodGet)
+			roles.HandleFunc("/{role}", api.GetRole).Methods(http.MethodGet)
+			roles.HandleFunc("/{role}", api.PutRole).Methods(http.MethodPut).Name("roles.update")
+			roles.HandleFunc("/{role}", api.DeleteRole).Methods(http.MethodDelete).Name("roles.delete")
+			roles.HandleFunc("/{role}/assignments", api.AssignRole).Methods(http.MethodPut).Name("roles.assignments.update")
+			roles.HandleFunc("/{role}/assignments", api.UnassignRole).Methods(http.MethodDelete).Name("roles.assignments.delete")
 
 			users := apiRouter.PathPrefix("/v1/users").Subrouter()
 			users.HandleFunc("", api.ListUsers).Methods(http.MethodGet)
@@ -209,6 +334,14 @@ var (
 				return svr.Serve(listener)
 			})
 
+			group.Go(func() error {
+				return api.RunGrantReaper(done, runConfig.Grant.ReapInterval)
+			})
+
+			group.Go(func() error {
+				return api.RunRotationScheduler(done, runConfig.Rotation.Interval)
+			})
+
 			log.Info("starting", zap.String("address", runConfig.BindAddress))
 			if log.Core().Enabled(zapcore.DebugLevel) {
 				_ = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
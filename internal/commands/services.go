@@ -1,29 +1,121 @@
 package commands
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/myago/zaputil"
 	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/drivers"
 	"github.com/mjpitz/varys/internal/engine"
+	"github.com/mjpitz/varys/internal/proxy"
 )
 
 type user struct {
-	Kind string `json:"kind" usage:"specify the kind of user we're referring to" required:"true"`
-	ID   string `json:"id" usage:"specify the id of the user we're granting access" required:"true"`
+	Kind string `json:"kind" usage:"specify the kind of user we're referring to"`
+	ID   string `json:"id" usage:"specify the id of the user we're granting access"`
+}
+
+type connectConfig struct {
+	Proxy    bool `json:"proxy"     usage:"connect through a local proxy that authenticates on the programs' behalf, keeping the password out of its environment"`
+	SSHAgent bool `json:"ssh_agent" usage:"load the derived ssh key into an ephemeral ssh-agent for the program, rather than writing it to disk"`
+}
+
+type certificateConfig struct {
+	Cert string        `json:"cert" usage:"where the client certificate is written" default:"client.crt"`
+	Key  string        `json:"key"  usage:"where the client certificates' private key is written" default:"client.key"`
+	CA   string        `json:"ca"   usage:"where the certificate authority is written" default:"ca.crt"`
+	TTL  time.Duration `json:"ttl"  usage:"how long the certificate should be valid for, limited by the server"`
+}
+
+type totpConfig struct {
+	URI bool `json:"uri" usage:"output the otpauth:// uri used to enroll the secret instead of the current code"`
+}
+
+type accessRequest struct {
+	Permission    *cli.StringSlice `json:"permission" alias:"p" usage:"the permissions being requested [options: read,write,update,delete,admin]"`
+	Duration      time.Duration    `json:"duration" usage:"how long access is needed for (e.g. 2h)" default:"1h"`
+	Justification string           `json:"justification" usage:"why access is needed" required:"true"`
 }
 
 type grantRequest struct {
 	User       user             `json:"user"`
+	Group      string           `json:"group" usage:"specify an identity provider group to grant access to in place of a user"`
 	Permission *cli.StringSlice `json:"permission" alias:"p" usage:"the permissions [options: read,write,update,delete,admin,system]"`
+	Duration   time.Duration    `json:"duration" usage:"how long the permissions are granted for (e.g. 2h), permissions do not expire by default"`
+	ExpiresAt  string           `json:"expires_at" usage:"when the permissions expire, formatted using RFC3339"`
+}
+
+// grant converts the request into a grant of each permission on the resource identified by the suffix, ensuring either
+// a user or group was specified.
+func (req grantRequest) grant(suffix string) (engine.UserGrant, error) {
+	switch {
+	case req.Group != "" && (req.User.Kind != "" || req.User.ID != ""):
+		return engine.UserGrant{}, fmt.Errorf("must provide either a user or a group, not both")
+	case req.Group == "" && (req.User.Kind == "" || req.User.ID == ""):
+		return engine.UserGrant{}, fmt.Errorf("must provide a user kind and id, or a group")
+	}
+
+	permissions := req.Permission.Value()
+	if len(permissions) == 0 {
+		return engine.UserGrant{}, fmt.Errorf("must provide at least one permission")
+	}
+
+	grant := engine.UserGrant{
+		User: engine.User{
+			Kind: req.User.Kind,
+			ID:   req.User.ID,
+		},
+		Group: req.Group,
+	}
+
+	for _, permission := range permissions {
+		grant.Roles = append(grant.Roles, permission+":"+suffix)
+	}
+
+	switch {
+	case req.Duration > 0:
+		grant.Duration = req.Duration.String()
+	case req.ExpiresAt != "":
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			return engine.UserGrant{}, err
+		}
+
+		grant.ExpiresAt = &expiresAt
+	}
+
+	return grant, nil
 }
 
 var (
+	connectServiceConfig = connectConfig{}
+
+	serviceCertificateConfig = certificateConfig{}
+
+	serviceTOTPConfig = totpConfig{}
+
 	createServiceRequest = engine.CreateServiceRequest{
 		Templates: engine.Templates{
 			UserTemplate:     "basic",
@@ -37,12 +129,14 @@ var (
 
 	deleteGrantRequest = grantRequest{}
 
+	createAccessRequest = accessRequest{}
+
 	Services = &cli.Command{
 		Name:  "services",
 		Usage: "Perform operations against the Services API.",
 		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
 		Before: func(ctx *cli.Context) error {
-			api, err := client.NewAPI(client.DefaultConfig)
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
 			if err != nil {
 				return err
 			}
@@ -55,21 +149,31 @@ var (
 				Name:      "connect",
 				Usage:     "Connects to a service managed by varys.",
 				ArgsUsage: "<kind> <name> [program...]",
+				Description: "When no program is provided, the native client for the kind of service is launched " +
+					"(postgres: psql, mysql: mysql, redis: redis-cli, mongodb: mongosh, http: curl, ssh: ssh). The " +
+					"--proxy option is supported for postgres and redis. The --ssh-agent option is supported for " +
+					"services that derive ssh keys.",
+				Flags: flagset.ExtractPrefix("varys_connect", &connectServiceConfig),
 				Action: func(ctx *cli.Context) error {
 					args := ctx.Args().Slice()
 
-					switch {
-					case len(args) < 2:
+					if len(args) < 2 {
 						return fmt.Errorf("expecting two arguments: <kind> <name>")
-					case len(args) < 3:
-						// TODO: make this optional with a driver approach
-						return fmt.Errorf("missing program to execute")
 					}
 
 					kind := args[0]
 					name := args[1]
 					program := args[2:]
 
+					driver := drivers.Lookup(kind)
+					if len(program) == 0 {
+						program = driver.DefaultProgram()
+					}
+
+					if len(program) == 0 {
+						return fmt.Errorf("missing program to execute")
+					}
+
 					api := client.Extract(ctx.Context)
 
 					serviceCreds, err := api.Services().Credentials(ctx.Context, kind, name)
@@ -77,32 +181,98 @@ var (
 						return err
 					}
 
-					// TODO: eventually use a driver approach
-
-					pargs := make([]string, 0)
-					if len(program) > 1 {
-						pargs = program[1:]
+					dir, err := ioutil.TempDir("", "varys-")
+					if err != nil {
+						return err
 					}
+					defer os.RemoveAll(dir)
 
-					prefix := strings.ToUpper(kind) + "_" + strings.ToUpper(name)
-
-					cmd := exec.Command(program[0], pargs...)
+					cmd := exec.Command(program[0], program[1:]...)
 					cmd.Stdin = os.Stdin
 					cmd.Stdout = os.Stdout
 					cmd.Stderr = os.Stderr
+					cmd.Env = os.Environ()
+
+					conn := drivers.Connection{
+						Kind:       kind,
+						Name:       name,
+						Address:    serviceCreds.Address,
+						Username:   serviceCreds.Credentials.Username,
+						Password:   serviceCreds.Credentials.Password,
+						PrivateKey: serviceCreds.Credentials.PrivateKey,
+						Dir:        dir,
+					}
 
-					cmd.Env = append(cmd.Env,
-						prefix+"_ADDRESS="+serviceCreds.Address,
-						prefix+"_USERNAME="+serviceCreds.Credentials.Username,
-						prefix+"_PASSWORD="+serviceCreds.Credentials.Password,
-					)
+					if connectServiceConfig.SSHAgent {
+						if conn.PrivateKey == "" {
+							return fmt.Errorf("%s/%s does not derive ssh keys", kind, name)
+						}
+
+						key, err := ssh.ParseRawPrivateKey([]byte(conn.PrivateKey))
+						if err != nil {
+							return err
+						}
+
+						agentCtx, cancel := context.WithCancel(ctx.Context)
+						defer cancel()
+
+						socket, err := serveAgent(agentCtx, dir, agent.AddedKey{
+							PrivateKey: key,
+							Comment:    conn.Username,
+						})
+						if err != nil {
+							return err
+						}
+
+						cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+socket)
+						conn.PrivateKey = ""
+					}
 
-					err = cmd.Run()
-					if err != nil {
+					if connectServiceConfig.Proxy {
+						protocol, ok := proxy.Lookup(kind)
+						if !ok {
+							return fmt.Errorf("proxy is not supported for %s", kind)
+						}
+
+						listener, err := net.Listen("tcp", "127.0.0.1:0")
+						if err != nil {
+							return err
+						}
+
+						// any local user can connect to the proxy, so the program must present a token that's only
+						// valid for this session
+						token := make([]byte, 32)
+						if _, err = rand.Read(token); err != nil {
+							_ = listener.Close()
+							return err
+						}
+
+						upstream := proxy.Upstream{
+							Address:  conn.Address,
+							Username: conn.Username,
+							Password: conn.Password,
+							Token:    hex.EncodeToString(token),
+						}
+
+						proxyCtx, cancel := context.WithCancel(ctx.Context)
+						defer cancel()
+
+						go func() {
+							err := proxy.Serve(proxyCtx, listener, protocol, upstream)
+							if err != nil {
+								zaputil.Extract(proxyCtx).Error("proxy stopped", zap.Error(err))
+							}
+						}()
+
+						conn.Address = proxiedAddress(conn.Address, listener.Addr().String())
+						conn.Password = upstream.Token
+					}
+
+					if err = driver.Prepare(cmd, conn); err != nil {
 						return err
 					}
 
-					return nil
+					return cmd.Run()
 				},
 			},
 			{
@@ -120,6 +290,12 @@ var (
 						return fmt.Errorf("expecting two arguments: <kind> <name>")
 					}
 
+					if policy := createServiceRequest.PasswordPolicy; !policy.IsZero() {
+						if err := policy.Validate(); err != nil {
+							return fmt.Errorf("invalid password policy: %w", err)
+						}
+					}
+
 					api := client.Extract(ctx.Context)
 
 					return api.Services().Create(ctx.Context, createServiceRequest)
@@ -173,17 +349,133 @@ var (
 					table.Append([]string{"USER TEMPLATE", string(service.Templates.UserTemplate)})
 					table.Append([]string{"PASSWORD TEMPLATE", string(service.Templates.PasswordTemplate)})
 
+					if policy := service.PasswordPolicy; policy != nil {
+						table.Append([]string{"PASSWORD POLICY", fmt.Sprintf("classes=%s required=%s min_length=%d max_length=%d exclude=%q",
+							policy.Classes, policy.Required, policy.MinLength, policy.MaxLength, policy.Exclude)})
+					}
+
+					extensions := service.SSHExtensions
+					if len(extensions) == 0 {
+						extensions = engine.DefaultSSHExtensions
+					}
+
+					table.Append([]string{"SSH KEY", strconv.FormatBool(service.SSHKey)})
+					table.Append([]string{"SSH EXTENSIONS", strings.Join(extensions, ",")})
+					table.Append([]string{"TOTP", strconv.FormatBool(service.TOTP)})
+					table.Append([]string{"ROOT KEY VERSION", service.RootKeyVersion})
+					table.Append([]string{"ROTATION PERIOD", service.RotationPeriod})
+					table.Append([]string{"LAST ROTATED", formatTime(service.LastRotatedAt)})
+					table.Append([]string{"NEXT ROTATION", formatTime(service.NextRotationAt)})
+
 					table.Render()
 					return nil
 				},
 			},
+			{
+				Name:      "totp",
+				Usage:     "Output your current TOTP code for a service.",
+				ArgsUsage: "<kind> <name>",
+				Flags:     flagset.ExtractPrefix("varys_totp", &serviceTOTPConfig),
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+
+					kind := args.Get(0)
+					name := args.Get(1)
+
+					if kind == "" || name == "" {
+						return fmt.Errorf("expecting two arguments: <kind> <name>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					totp, err := api.Services().TOTP(ctx.Context, kind, name)
+					if err != nil {
+						return err
+					}
+
+					if serviceTOTPConfig.URI {
+						_, err = fmt.Fprintln(ctx.App.Writer, totp.URI)
+					} else {
+						_, err = fmt.Fprintln(ctx.App.Writer, totp.Code)
+					}
+
+					return err
+				},
+			},
+			{
+				Name:      "certificate",
+				Usage:     "Issue a short-lived client certificate for a service.",
+				ArgsUsage: "<kind> <name>",
+				Description: "A new key pair is generated locally and only the public key is sent to varys. The " +
+					"certificate's common name is your derived username for the service.",
+				Flags: flagset.ExtractPrefix("varys_certificate", &serviceCertificateConfig),
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+
+					kind := args.Get(0)
+					name := args.Get(1)
+
+					if kind == "" || name == "" {
+						return fmt.Errorf("expecting two arguments: <kind> <name>")
+					}
+
+					api := client.Extract(ctx.Context)
+
+					key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					if err != nil {
+						return err
+					}
+
+					publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+					if err != nil {
+						return err
+					}
+
+					privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+					if err != nil {
+						return err
+					}
+
+					req := engine.IssueCertificateRequest{
+						PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+					}
+
+					if serviceCertificateConfig.TTL > 0 {
+						req.TTL = serviceCertificateConfig.TTL.String()
+					}
+
+					certificate, err := api.Services().IssueCertificate(ctx.Context, kind, name, req)
+					if err != nil {
+						return err
+					}
+
+					files := []struct {
+						path     string
+						contents []byte
+						mode     os.FileMode
+					}{
+						{serviceCertificateConfig.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey}), 0o600},
+						{serviceCertificateConfig.Cert, []byte(certificate.Certificate), 0o644},
+						{serviceCertificateConfig.CA, []byte(certificate.CA), 0o644},
+					}
+
+					for _, file := range files {
+						if err = ioutil.WriteFile(file.path, file.contents, file.mode); err != nil {
+							return err
+						}
+					}
+
+					_, _ = fmt.Fprintf(ctx.App.Writer, "certificate valid until %s\n", certificate.ValidBefore.Format(time.RFC3339))
+					return nil
+				},
+			},
 			{
 				Name:  "grants",
 				Usage: "Manage who has access to a given service.",
 				Subcommands: []*cli.Command{
 					{
 						Name:      "list",
-						Usage:     "List all users who have access to a service and their permissions.",
+						Usage:     "List all users and groups who have access to a service and their permissions.",
 						ArgsUsage: " ",
 						Action: func(ctx *cli.Context) error {
 							args := ctx.Args()
@@ -202,23 +494,13 @@ var (
 								return err
 							}
 
-							table := newTable(ctx.App.Writer)
-							table.SetHeader([]string{"UserKind", "UserID", "UserName", "Roles"})
-
-							for _, grant := range grants {
-								table.Append([]string{
-									grant.User.Kind, grant.User.Name, grant.User.ID,
-									strings.Join(grant.Roles, ", "),
-								})
-							}
-
-							table.Render()
+							renderGrants(ctx.App.Writer, grants)
 							return nil
 						},
 					},
 					{
 						Name:      "update",
-						Usage:     "Update a user's access to a service in varys.",
+						Usage:     "Update a user or group's access to a service in varys, optionally for a limited time.",
 						ArgsUsage: "<kind> <name>",
 						Flags:     flagset.ExtractPrefix("varys_update_service_grant", &updateGrantRequest),
 						Action: func(ctx *cli.Context) error {
@@ -231,34 +513,51 @@ var (
 								return fmt.Errorf("expecting two arguments: <kind> <name>")
 							}
 
-							permissions := updateGrantRequest.Permission.Value()
-							if len(permissions) == 0 {
-								return fmt.Errorf("must provide at least one permission")
+							grant, err := updateGrantRequest.grant(fmt.Sprintf("%s:%s", kind, name))
+							if err != nil {
+								return err
 							}
 
-							suffix := fmt.Sprintf("%s:%s", kind, name)
+							api := client.Extract(ctx.Context)
+
+							return api.Services().Grants().Update(ctx.Context, kind, name, grant)
+						},
+					},
+					{
+						Name:      "delete",
+						Usage:     "Remove a user or group's access to a service in varys.",
+						ArgsUsage: "<kind> <name>",
+						Flags:     flagset.ExtractPrefix("varys_delete_service_grant", &deleteGrantRequest),
+						Action: func(ctx *cli.Context) error {
+							args := ctx.Args()
+
+							kind := args.Get(0)
+							name := args.Get(1)
+
+							if kind == "" || name == "" {
+								return fmt.Errorf("expecting two arguments: <kind> <name>")
+							}
 
-							roles := make([]string, 0)
-							for _, permission := range permissions {
-								roles = append(roles, permission+":"+suffix)
+							grant, err := deleteGrantRequest.grant(fmt.Sprintf("%s:%s", kind, name))
+							if err != nil {
+								return err
 							}
 
 							api := client.Extract(ctx.Context)
 
-							return api.Services().Grants().Update(ctx.Context, kind, name, engine.UserGrant{
-								User: engine.User{
-									Kind: updateGrantRequest.User.Kind,
-									ID:   updateGrantRequest.User.ID,
-								},
-								Roles: roles,
-							})
+							return api.Services().Grants().Delete(ctx.Context, kind, name, grant)
 						},
 					},
+				},
+			},
+			{
+				Name:  "requests",
+				Usage: "Request temporary access to a service and review requests made by others.",
+				Subcommands: []*cli.Command{
 					{
-						Name:      "delete",
-						Usage:     "Remove a user's access to a service in varys.",
+						Name:      "list",
+						Usage:     "List the access requests made for a service.",
 						ArgsUsage: "<kind> <name>",
-						Flags:     flagset.ExtractPrefix("varys_delete_service_grant", &deleteGrantRequest),
 						Action: func(ctx *cli.Context) error {
 							args := ctx.Args()
 
@@ -269,29 +568,83 @@ var (
 								return fmt.Errorf("expecting two arguments: <kind> <name>")
 							}
 
-							permissions := updateGrantRequest.Permission.Value()
-							if len(permissions) == 0 {
-								return fmt.Errorf("must provide at least one permission")
+							api := client.Extract(ctx.Context)
+
+							requests, err := api.Services().Requests().List(ctx.Context, kind, name)
+							if err != nil {
+								return err
+							}
+
+							table := newTable(ctx.App.Writer)
+							table.SetHeader([]string{"ID", "User", "Permissions", "Duration", "Status", "Justification"})
+
+							for _, req := range requests {
+								permissions := make([]string, 0, len(req.Permissions))
+								for _, perm := range req.Permissions {
+									permissions = append(permissions, string(perm))
+								}
+
+								table.Append([]string{
+									req.ID, req.User.Name, strings.Join(permissions, ", "),
+									req.Duration, string(req.Status), req.Justification,
+								})
 							}
 
-							suffix := fmt.Sprintf("%s:%s", kind, name)
+							table.Render()
+							return nil
+						},
+					},
+					{
+						Name:      "create",
+						Usage:     "Request temporary access to a service.",
+						ArgsUsage: "<kind> <name>",
+						Flags:     flagset.ExtractPrefix("varys_create_access_request", &createAccessRequest),
+						Action: func(ctx *cli.Context) error {
+							args := ctx.Args()
+
+							kind := args.Get(0)
+							name := args.Get(1)
 
-							roles := make([]string, 0)
-							for _, permission := range permissions {
-								roles = append(roles, permission+":"+suffix)
+							if kind == "" || name == "" {
+								return fmt.Errorf("expecting two arguments: <kind> <name>")
+							}
+
+							permissions := make([]engine.Permission, 0)
+							for _, permission := range createAccessRequest.Permission.Value() {
+								permissions = append(permissions, engine.Permission(permission))
+							}
+
+							if len(permissions) == 0 {
+								return fmt.Errorf("must provide at least one permission")
 							}
 
 							api := client.Extract(ctx.Context)
 
-							return api.Services().Grants().Delete(ctx.Context, kind, name, engine.UserGrant{
-								User: engine.User{
-									Kind: updateGrantRequest.User.Kind,
-									ID:   updateGrantRequest.User.ID,
-								},
-								Roles: roles,
+							req, err := api.Services().Requests().Create(ctx.Context, kind, name, engine.CreateAccessRequestRequest{
+								Permissions:   permissions,
+								Duration:      createAccessRequest.Duration.String(),
+								Justification: createAccessRequest.Justification,
 							})
+							if err != nil {
+								return err
+							}
+
+							_, err = fmt.Fprintln(ctx.App.Writer, req.ID)
+							return err
 						},
 					},
+					{
+						Name:      "approve",
+						Usage:     "Approve a pending access request, granting the requested permissions.",
+						ArgsUsage: "<kind> <name> <id>",
+						Action:    reviewAccessRequest(engine.ApprovedAccessRequest),
+					},
+					{
+						Name:      "deny",
+						Usage:     "Deny a pending access request.",
+						ArgsUsage: "<kind> <name> <id>",
+						Action:    reviewAccessRequest(engine.DeniedAccessRequest),
+					},
 				},
 			},
 			{
@@ -332,6 +685,12 @@ var (
 						return fmt.Errorf("expecting two arguments: <kind> <name>")
 					}
 
+					if policy := updateServiceRequest.PasswordPolicy; !policy.IsZero() {
+						if err := policy.Validate(); err != nil {
+							return fmt.Errorf("invalid password policy: %w", err)
+						}
+					}
+
 					api := client.Extract(ctx.Context)
 
 					return api.Services().Update(ctx.Context, kind, name, updateServiceRequest)
@@ -341,3 +700,67 @@ var (
 		HideHelpCommand: true,
 	}
 )
+
+// proxiedAddress replaces the host in the address with the proxies' address, preserving any other components of the
+// URL (such as the database).
+func proxiedAddress(address, listener string) string {
+	if !strings.Contains(address, "://") {
+		return listener
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return listener
+	}
+
+	u.Host = listener
+	return u.String()
+}
+
+func reviewAccessRequest(status engine.AccessRequestStatus) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		args := ctx.Args()
+
+		kind := args.Get(0)
+		name := args.Get(1)
+		id := args.Get(2)
+
+		if kind == "" || name == "" || id == "" {
+			return fmt.Errorf("expecting three arguments: <kind> <name> <id>")
+		}
+
+		api := client.Extract(ctx.Context)
+
+		_, err := api.Services().Requests().Update(ctx.Context, kind, name, id, engine.UpdateAccessRequestRequest{
+			Status: status,
+		})
+
+		return err
+	}
+}
+
+// formatTime renders an optional timestamp in the local timezone, returning an empty string when unset.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Local().Format(time.RFC3339)
+}
+
+// renderGrants writes the grants as a table, one row per user or group and expiration.
+func renderGrants(out io.Writer, grants []engine.UserGrant) {
+	table := newTable(out)
+	table.SetHeader([]string{"UserKind", "UserID", "UserName", "Group", "Roles", "Expires"})
+
+	for _, grant := range grants {
+		table.Append([]string{
+			grant.User.Kind, grant.User.ID, grant.User.Name,
+			grant.Group,
+			strings.Join(grant.Roles, ", "),
+			formatTime(grant.ExpiresAt),
+		})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/mjpitz/myago/flagset"
+	"github.com/mjpitz/varys/internal/client"
+	"github.com/mjpitz/varys/internal/drivers"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+type sshClientConfig struct {
+	User string        `json:"user" alias:"l" usage:"the user to log in as on the remote host"`
+	TTL  time.Duration `json:"ttl"  usage:"how long the certificate should be valid for, limited by the server"`
+}
+
+var (
+	sshConfig = &sshClientConfig{}
+
+	SSH = &cli.Command{
+		Name:      "ssh",
+		Usage:     "Connect to a host using a short-lived certificate issued by varys.",
+		UsageText: "varys ssh [options] <kind> <name> [ssh arguments...]",
+		Description: "A new key pair is generated for each connection and held by an ephemeral ssh-agent alongside " +
+			"the certificate. The certificate's principals are the permissions granted on the service. The " +
+			"certificate authority can be trusted by hosts using the public key from " +
+			"GET /api/v1/services/{kind}/{name}/ssh/ca.",
+		Flags: append(
+			flagset.ExtractPrefix("varys", &client.DefaultConfig),
+			flagset.ExtractPrefix("varys_ssh", sshConfig)...,
+		),
+		Before: func(ctx *cli.Context) error {
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = client.WithContext(ctx.Context, api)
+			return nil
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args().Slice()
+
+			if len(args) < 2 {
+				return fmt.Errorf("expecting two arguments: <kind> <name>")
+			}
+
+			kind := args[0]
+			name := args[1]
+
+			api := client.Extract(ctx.Context)
+
+			service, err := api.Services().Get(ctx.Context, kind, name)
+			if err != nil {
+				return err
+			}
+
+			public, private, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+
+			publicKey, err := ssh.NewPublicKey(public)
+			if err != nil {
+				return err
+			}
+
+			req := engine.SignSSHKeyRequest{
+				PublicKey: string(ssh.MarshalAuthorizedKey(publicKey)),
+			}
+
+			if sshConfig.TTL > 0 {
+				req.TTL = sshConfig.TTL.String()
+			}
+
+			signed, err := api.Services().SignSSHKey(ctx.Context, kind, name, req)
+			if err != nil {
+				return err
+			}
+
+			parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.Certificate))
+			if err != nil {
+				return err
+			}
+
+			certificate, ok := parsed.(*ssh.Certificate)
+			if !ok {
+				return fmt.Errorf("server did not return a certificate")
+			}
+
+			dir, err := ioutil.TempDir("", "varys-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+
+			agentCtx, cancel := context.WithCancel(ctx.Context)
+			defer cancel()
+
+			socket, err := serveAgent(agentCtx, dir, agent.AddedKey{
+				PrivateKey:   private,
+				Certificate:  certificate,
+				Comment:      fmt.Sprintf("varys:%s:%s", kind, name),
+				LifetimeSecs: uint32(time.Until(signed.ValidBefore).Seconds()),
+			})
+			if err != nil {
+				return err
+			}
+
+			host, port, _ := drivers.ParseAddress(service.Address, "22")
+
+			sshArgs := []string{"-p", port}
+			if sshConfig.User != "" {
+				sshArgs = append(sshArgs, "-l", sshConfig.User)
+			}
+
+			sshArgs = append(sshArgs, host)
+			sshArgs = append(sshArgs, args[2:]...)
+
+			cmd := exec.Command("ssh", sshArgs...)
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+
+			return cmd.Run()
+		},
+		HideHelpCommand: true,
+	}
+)
@@ -14,6 +14,7 @@ import (
 type UpdateUserRequest struct {
 	RotateServiceKind string `json:"rotate_service_kind" usage:"the kind of service that we're rotating the credential for"`
 	RotateServiceName string `json:"rotate_service_name" usage:"the name of the service we're rotating the credential for"`
+	Immediate         bool   `json:"immediate"           usage:"set to invalidate the previous credential right away instead of after the grace period"`
 }
 
 var (
@@ -24,7 +25,7 @@ var (
 		Usage: "Perform operations against the Users API.",
 		Flags: flagset.ExtractPrefix("varys", &client.DefaultConfig),
 		Before: func(ctx *cli.Context) error {
-			api, err := client.NewAPI(client.DefaultConfig)
+			api, err := client.NewAPI(ctx.Context, client.DefaultConfig)
 			if err != nil {
 				return err
 			}
@@ -97,6 +98,7 @@ var (
 									Kind: updateUserRequest.RotateServiceKind,
 									Name: updateUserRequest.RotateServiceName,
 								},
+								Immediate: updateUserRequest.Immediate,
 							})
 						},
 					},
@@ -0,0 +1,52 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package connector
+
+import (
+	"context"
+
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+// Account describes a user account within a target system.
+type Account struct {
+	Username    string              `json:"username"`
+	Password    string              `json:"password,omitempty"`
+	Permissions []engine.Permission `json:"permissions"`
+}
+
+// Connector provisions user accounts within a target system. Implementations should only operate on accounts that
+// they manage, leaving any other accounts in the target system untouched.
+type Connector interface {
+	// List returns the accounts managed by the connector. Implementations may omit the password when the target
+	// system does not make it available.
+	List(ctx context.Context) ([]Account, error)
+	// Create adds the account to the target system with the provided password and permissions.
+	Create(ctx context.Context, account Account) error
+	// UpdatePassword changes the password of an existing account.
+	UpdatePassword(ctx context.Context, account Account) error
+	// UpdatePermissions changes the permissions of an existing account to match the provided set.
+	UpdatePermissions(ctx context.Context, account Account) error
+	// Drop removes the account from the target system.
+	Drop(ctx context.Context, account Account) error
+}
+
+// Normalizer may be implemented by connectors whose target system is unable to represent every permission distinctly.
+// Desired permissions are normalized before being compared to those reported by List.
+type Normalizer interface {
+	Normalize(permissions []engine.Permission) []engine.Permission
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package connector
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+// NewMemory returns a Connector that manages accounts in memory. It's primarily useful for testing.
+func NewMemory(accounts ...Account) *Memory {
+	m := &Memory{
+		accounts: make(map[string]Account, len(accounts)),
+	}
+
+	for _, account := range accounts {
+		m.accounts[account.Username] = account
+	}
+
+	return m
+}
+
+// Memory provides an in-memory implementation of a Connector.
+type Memory struct {
+	mu       sync.Mutex
+	accounts map[string]Account
+}
+
+func (m *Memory) List(ctx context.Context) ([]Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	accounts := make([]Account, 0, len(m.accounts))
+	for _, account := range m.accounts {
+		accounts = append(accounts, account)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Username < accounts[j].Username
+	})
+
+	return accounts, nil
+}
+
+func (m *Memory) Create(ctx context.Context, account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.accounts[account.Username] = account
+	return nil
+}
+
+func (m *Memory) UpdatePassword(ctx context.Context, account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := m.accounts[account.Username]
+	existing.Password = account.Password
+	m.accounts[account.Username] = existing
+
+	return nil
+}
+
+func (m *Memory) UpdatePermissions(ctx context.Context, account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := m.accounts[account.Username]
+	existing.Permissions = append([]engine.Permission{}, account.Permissions...)
+	m.accounts[account.Username] = existing
+
+	return nil
+}
+
+func (m *Memory) Drop(ctx context.Context, account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.accounts, account.Username)
+	return nil
+}
+
+var _ Connector = &Memory{}
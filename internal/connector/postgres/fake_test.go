@@ -0,0 +1,262 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package postgres_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const ident = `"((?:[^"]|"")+)"`
+
+var (
+	createRole     = regexp.MustCompile(`^CREATE ROLE ` + ident + ` (NOLOGIN|LOGIN PASSWORD '([^']*)')$`)
+	grantRole      = regexp.MustCompile(`^GRANT ` + ident + ` TO ` + ident + `$`)
+	revokeRole     = regexp.MustCompile(`^REVOKE ` + ident + ` FROM ` + ident + `$`)
+	alterPassword  = regexp.MustCompile(`^ALTER ROLE ` + ident + ` PASSWORD '([^']*)'$`)
+	dropRole       = regexp.MustCompile(`^DROP ROLE ` + ident + `$`)
+	grantPrivilege = regexp.MustCompile(`^(GRANT \w+ ON |ALTER DEFAULT PRIVILEGES |REASSIGN OWNED |DROP OWNED )`)
+)
+
+func unquote(identifier string) string {
+	return strings.ReplaceAll(identifier, `""`, `"`)
+}
+
+type fakeRole struct {
+	login    bool
+	verifier string
+	groups   map[string]bool
+}
+
+// fakeDatabase implements just enough of a database/sql driver to interpret the statements issued by the connector.
+// Roles and their memberships are tracked in memory so tests can assert on the state of the cluster without a server.
+type fakeDatabase struct {
+	mu         sync.Mutex
+	roles      map[string]*fakeRole
+	statements []string
+}
+
+func newFakeDatabase() *fakeDatabase {
+	return &fakeDatabase{roles: make(map[string]*fakeRole)}
+}
+
+func (d *fakeDatabase) Connect(context.Context) (driver.Conn, error) { return &fakeConn{d}, nil }
+func (d *fakeDatabase) Driver() driver.Driver                        { return nil }
+
+func (d *fakeDatabase) snapshot() map[string]*fakeRole {
+	roles := make(map[string]*fakeRole, len(d.roles))
+	for name, role := range d.roles {
+		clone := *role
+		clone.groups = make(map[string]bool, len(role.groups))
+
+		for group := range role.groups {
+			clone.groups[group] = true
+		}
+
+		roles[name] = &clone
+	}
+
+	return roles
+}
+
+func (d *fakeDatabase) role(name string) (*fakeRole, error) {
+	role, ok := d.roles[name]
+	if !ok {
+		return nil, fmt.Errorf("role %q does not exist", name)
+	}
+
+	return role, nil
+}
+
+func (d *fakeDatabase) exec(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.statements = append(d.statements, query)
+
+	if match := createRole.FindStringSubmatch(query); match != nil {
+		name := unquote(match[1])
+		if _, ok := d.roles[name]; ok {
+			return fmt.Errorf("role %q already exists", name)
+		}
+
+		d.roles[name] = &fakeRole{
+			login:    match[2] != "NOLOGIN",
+			verifier: match[3],
+			groups:   make(map[string]bool),
+		}
+
+		return nil
+	}
+
+	if match := grantRole.FindStringSubmatch(query); match != nil {
+		if _, err := d.role(unquote(match[1])); err != nil {
+			return err
+		}
+
+		role, err := d.role(unquote(match[2]))
+		if err != nil {
+			return err
+		}
+
+		role.groups[unquote(match[1])] = true
+		return nil
+	}
+
+	if match := revokeRole.FindStringSubmatch(query); match != nil {
+		role, err := d.role(unquote(match[2]))
+		if err != nil {
+			return err
+		}
+
+		delete(role.groups, unquote(match[1]))
+		return nil
+	}
+
+	if match := alterPassword.FindStringSubmatch(query); match != nil {
+		role, err := d.role(unquote(match[1]))
+		if err != nil {
+			return err
+		}
+
+		role.verifier = match[2]
+		return nil
+	}
+
+	if match := dropRole.FindStringSubmatch(query); match != nil {
+		if _, err := d.role(unquote(match[1])); err != nil {
+			return err
+		}
+
+		delete(d.roles, unquote(match[1]))
+		return nil
+	}
+
+	if grantPrivilege.MatchString(query) {
+		return nil
+	}
+
+	return fmt.Errorf("unsupported statement: %s", query)
+}
+
+func (d *fakeDatabase) query(query string, args []driver.Value) (driver.Rows, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		_, ok := d.roles[args[0].(string)]
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{ok}}}, nil
+	case strings.Contains(query, "FROM pg_auth_members"):
+		marker := args[0].(string)
+		rows := &fakeRows{columns: []string{"rolname", "rolname"}}
+
+		for name, role := range d.roles {
+			if !role.login || !role.groups[marker] {
+				continue
+			}
+
+			for group := range role.groups {
+				rows.values = append(rows.values, []driver.Value{name, group})
+			}
+		}
+
+		sort.Slice(rows.values, func(i, j int) bool {
+			a, b := rows.values[i], rows.values[j]
+			if a[0] != b[0] {
+				return a[0].(string) < b[0].(string)
+			}
+
+			return a[1].(string) < b[1].(string)
+		})
+
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("unsupported query: %s", query)
+}
+
+type fakeConn struct {
+	db *fakeDatabase
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+
+// Begin snapshots the roles so they can be restored if the transaction is rolled back.
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	return &fakeTx{db: c.db, roles: c.db.snapshot()}, nil
+}
+
+type fakeTx struct {
+	db    *fakeDatabase
+	roles map[string]*fakeRole
+}
+
+func (t *fakeTx) Commit() error { return nil }
+
+func (t *fakeTx) Rollback() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	t.db.roles = t.roles
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDatabase
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), s.db.exec(s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+
+	return nil
+}
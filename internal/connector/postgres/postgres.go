@@ -0,0 +1,345 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package postgres provides a connector that provisions LOGIN roles within a PostgreSQL cluster.
+//
+// Permissions are managed using a group role per permission (e.g. varys_read, varys_write, ...). Each group role is
+// granted the corresponding privileges on the configured schema and user roles are granted membership to the groups
+// that match their permissions. All roles created by the connector are members of a marker role (e.g. varys) which is
+// used to identify the roles that the connector manages.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/mjpitz/varys/internal/connector"
+	"github.com/mjpitz/varys/internal/engine"
+	"github.com/mjpitz/varys/internal/scram"
+)
+
+// Config defines the options used to connect to and manage a PostgreSQL cluster.
+type Config struct {
+	URL        string `json:"url"         usage:"the connection url used to administer the postgres database"`
+	Schema     string `json:"schema"      usage:"the schema that permissions are granted on" default:"public"`
+	RolePrefix string `json:"role_prefix" usage:"the prefix used for the group roles managed by the connector" default:"varys"`
+}
+
+// privileges maps varys permissions to the privileges granted on tables within the configured schema.
+var privileges = map[engine.Permission]string{
+	engine.ReadPermission:   "SELECT",
+	engine.WritePermission:  "INSERT",
+	engine.UpdatePermission: "UPDATE",
+	engine.DeletePermission: "DELETE",
+	engine.AdminPermission:  "ALL",
+}
+
+// Open connects to the PostgreSQL database and ensures the group roles used by the connector exist.
+func Open(ctx context.Context, cfg Config) (*Connector, error) {
+	db, err := sql.Open("postgres", cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := New(db, cfg)
+
+	err = conn.Setup(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// New constructs a connector using the provided database.
+func New(db *sql.DB, cfg Config) *Connector {
+	if cfg.Schema == "" {
+		cfg.Schema = "public"
+	}
+
+	if cfg.RolePrefix == "" {
+		cfg.RolePrefix = "varys"
+	}
+
+	return &Connector{
+		db:  db,
+		cfg: cfg,
+	}
+}
+
+// Connector manages LOGIN roles within a PostgreSQL database.
+type Connector struct {
+	db  *sql.DB
+	cfg Config
+}
+
+func (c *Connector) group(permission engine.Permission) string {
+	return c.cfg.RolePrefix + "_" + string(permission)
+}
+
+func (c *Connector) tx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	return fn(tx)
+}
+
+func exec(ctx context.Context, tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%w: %s", err, statement)
+		}
+	}
+
+	return nil
+}
+
+func (c *Connector) ensureRole(ctx context.Context, tx *sql.Tx, role string) error {
+	exists := false
+
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	return exec(ctx, tx, "CREATE ROLE "+pq.QuoteIdentifier(role)+" NOLOGIN")
+}
+
+// Setup ensures the marker and group roles exist and that each group role has been granted its privileges on the
+// configured schema. It's safe to call multiple times and should be re-run when new tables are added to the schema by
+// roles other than the connector.
+func (c *Connector) Setup(ctx context.Context) error {
+	schema := pq.QuoteIdentifier(c.cfg.Schema)
+
+	return c.tx(ctx, func(tx *sql.Tx) error {
+		err := c.ensureRole(ctx, tx, c.cfg.RolePrefix)
+		if err != nil {
+			return err
+		}
+
+		for _, permission := range engine.PermissionValues {
+			privilege, ok := privileges[permission]
+			if !ok {
+				continue
+			}
+
+			group := c.group(permission)
+			if err = c.ensureRole(ctx, tx, group); err != nil {
+				return err
+			}
+
+			role := pq.QuoteIdentifier(group)
+			schemaPrivilege := "USAGE"
+			sequencePrivilege := "USAGE"
+
+			switch permission {
+			case engine.ReadPermission:
+				sequencePrivilege = "SELECT"
+			case engine.AdminPermission:
+				schemaPrivilege = "ALL"
+				sequencePrivilege = "ALL"
+			}
+
+			err = exec(ctx, tx,
+				fmt.Sprintf("GRANT %s ON SCHEMA %s TO %s", schemaPrivilege, schema, role),
+				fmt.Sprintf("GRANT %s ON ALL TABLES IN SCHEMA %s TO %s", privilege, schema, role),
+				fmt.Sprintf("GRANT %s ON ALL SEQUENCES IN SCHEMA %s TO %s", sequencePrivilege, schema, role),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT %s ON TABLES TO %s", schema, privilege, role),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT %s ON SEQUENCES TO %s", schema, sequencePrivilege, role),
+			)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+const listMemberships = `
+SELECT r.rolname, g.rolname
+FROM pg_auth_members m
+JOIN pg_roles r ON r.oid = m.member
+JOIN pg_roles g ON g.oid = m.roleid
+WHERE r.rolcanlogin AND r.oid IN (
+	SELECT member FROM pg_auth_members WHERE roleid = (SELECT oid FROM pg_roles WHERE rolname = $1)
+)
+ORDER BY r.rolname, g.rolname`
+
+func (c *Connector) List(ctx context.Context) ([]connector.Account, error) {
+	groups := make(map[string]engine.Permission, len(privileges))
+	for permission := range privileges {
+		groups[c.group(permission)] = permission
+	}
+
+	rows, err := c.db.QueryContext(ctx, listMemberships, c.cfg.RolePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]connector.Account, 0)
+	index := make(map[string]int)
+
+	for rows.Next() {
+		var username, group string
+		if err = rows.Scan(&username, &group); err != nil {
+			return nil, err
+		}
+
+		idx, ok := index[username]
+		if !ok {
+			idx = len(accounts)
+			index[username] = idx
+			accounts = append(accounts, connector.Account{Username: username})
+		}
+
+		if permission, ok := groups[group]; ok {
+			accounts[idx].Permissions = append(accounts[idx].Permissions, permission)
+		}
+	}
+
+	return accounts, rows.Err()
+}
+
+// Normalize removes permissions that don't map to a group role, such as system, so that they compare equal to those
+// reported by List.
+func (c *Connector) Normalize(perms []engine.Permission) []engine.Permission {
+	normalized := make([]engine.Permission, 0, len(perms))
+	for _, permission := range perms {
+		if _, ok := privileges[permission]; ok {
+			normalized = append(normalized, permission)
+		}
+	}
+
+	return normalized
+}
+
+func (c *Connector) grants(account connector.Account) (granted, revoked []string) {
+	desired := make(map[engine.Permission]bool, len(account.Permissions))
+	for _, permission := range account.Permissions {
+		desired[permission] = true
+	}
+
+	for _, permission := range engine.PermissionValues {
+		if _, ok := privileges[permission]; !ok {
+			continue
+		}
+
+		group := pq.QuoteIdentifier(c.group(permission))
+
+		if desired[permission] {
+			granted = append(granted, group)
+		} else {
+			revoked = append(revoked, group)
+		}
+	}
+
+	return granted, revoked
+}
+
+func (c *Connector) Create(ctx context.Context, account connector.Account) error {
+	verifier, err := scram.Verifier(account.Password)
+	if err != nil {
+		return err
+	}
+
+	role := pq.QuoteIdentifier(account.Username)
+	granted, _ := c.grants(account)
+	granted = append([]string{pq.QuoteIdentifier(c.cfg.RolePrefix)}, granted...)
+
+	return c.tx(ctx, func(tx *sql.Tx) error {
+		statements := []string{
+			fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s", role, pq.QuoteLiteral(verifier)),
+		}
+
+		for _, group := range granted {
+			statements = append(statements, fmt.Sprintf("GRANT %s TO %s", group, role))
+		}
+
+		return exec(ctx, tx, statements...)
+	})
+}
+
+func (c *Connector) UpdatePassword(ctx context.Context, account connector.Account) error {
+	verifier, err := scram.Verifier(account.Password)
+	if err != nil {
+		return err
+	}
+
+	return c.tx(ctx, func(tx *sql.Tx) error {
+		return exec(ctx, tx, fmt.Sprintf("ALTER ROLE %s PASSWORD %s",
+			pq.QuoteIdentifier(account.Username), pq.QuoteLiteral(verifier)))
+	})
+}
+
+func (c *Connector) UpdatePermissions(ctx context.Context, account connector.Account) error {
+	role := pq.QuoteIdentifier(account.Username)
+	granted, revoked := c.grants(account)
+
+	return c.tx(ctx, func(tx *sql.Tx) error {
+		statements := make([]string, 0, len(granted)+len(revoked))
+
+		for _, group := range granted {
+			statements = append(statements, fmt.Sprintf("GRANT %s TO %s", group, role))
+		}
+
+		for _, group := range revoked {
+			statements = append(statements, fmt.Sprintf("REVOKE %s FROM %s", group, role))
+		}
+
+		return exec(ctx, tx, statements...)
+	})
+}
+
+func (c *Connector) Drop(ctx context.Context, account connector.Account) error {
+	role := pq.QuoteIdentifier(account.Username)
+
+	return c.tx(ctx, func(tx *sql.Tx) error {
+		// hand any objects created by the role back to the connector before removing it
+		return exec(ctx, tx,
+			fmt.Sprintf("REASSIGN OWNED BY %s TO CURRENT_USER", role),
+			fmt.Sprintf("DROP OWNED BY %s", role),
+			fmt.Sprintf("DROP ROLE %s", role),
+		)
+	})
+}
+
+// Close closes the underlying database connection.
+func (c *Connector) Close() error {
+	return c.db.Close()
+}
+
+var (
+	_ connector.Connector  = &Connector{}
+	_ connector.Normalizer = &Connector{}
+)
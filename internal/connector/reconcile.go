@@ -0,0 +1,244 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+// Action describes an operation performed against the target system.
+type Action string
+
+const (
+	// CreateAction indicates an account will be created.
+	CreateAction Action = "create"
+	// UpdatePasswordAction indicates an accounts' password will be changed.
+	UpdatePasswordAction Action = "update_password"
+	// UpdatePermissionsAction indicates an accounts' permissions will be changed.
+	UpdatePermissionsAction Action = "update_permissions"
+	// DropAction indicates an account will be removed.
+	DropAction Action = "drop"
+)
+
+// Change defines a single action to be taken against the target system.
+type Change struct {
+	Action  Action
+	Account Account
+}
+
+// Source returns the desired set of credentials for the target system. Typically, this is backed by the
+// GET /api/v1/credentials/{kind}/{name} endpoint.
+type Source func(ctx context.Context) ([]engine.UserCredential, error)
+
+// Reconciler ensures that exactly the granted users exist within the target system, with the derived passwords and
+// the right permissions.
+type Reconciler struct {
+	Connector Connector
+	DryRun    bool
+
+	mu sync.Mutex
+	// applied tracks a hash of the passwords we've set so we do not need to reset them on every pass when the target
+	// system does not expose them.
+	applied map[string][32]byte
+}
+
+// normalize sorts and de-duplicates the provided permissions.
+func normalize(permissions []engine.Permission) []engine.Permission {
+	set := make(map[engine.Permission]bool, len(permissions))
+	for _, permission := range permissions {
+		set[permission] = true
+	}
+
+	normalized := make([]engine.Permission, 0, len(set))
+	for _, permission := range engine.PermissionValues {
+		if set[permission] {
+			normalized = append(normalized, permission)
+		}
+	}
+
+	return normalized
+}
+
+func equal(a, b []engine.Permission) bool {
+	a, b = normalize(a), normalize(b)
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Plan computes the changes required to bring the target system in line with the desired credentials.
+func (r *Reconciler) Plan(ctx context.Context, desired []engine.UserCredential) ([]Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.plan(ctx, desired)
+}
+
+func (r *Reconciler) plan(ctx context.Context, desired []engine.UserCredential) ([]Change, error) {
+	existing, err := r.Connector.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]Account, len(existing))
+	for _, account := range existing {
+		current[account.Username] = account
+	}
+
+	changes := make([]Change, 0)
+	wanted := make(map[string]bool, len(desired))
+
+	for _, credential := range desired {
+		username := credential.Credentials.Username
+		if username == "" || wanted[username] {
+			continue
+		}
+
+		wanted[username] = true
+
+		account := Account{
+			Username:    username,
+			Password:    credential.Credentials.Password,
+			Permissions: normalize(credential.Permission),
+		}
+
+		if normalizer, ok := r.Connector.(Normalizer); ok {
+			account.Permissions = normalize(normalizer.Normalize(account.Permissions))
+		}
+
+		actual, ok := current[username]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Action: CreateAction, Account: account})
+			continue
+		case actual.Password != "" && actual.Password != account.Password:
+			changes = append(changes, Change{Action: UpdatePasswordAction, Account: account})
+		case actual.Password == "" && r.applied[username] != sha256.Sum256([]byte(account.Password)):
+			changes = append(changes, Change{Action: UpdatePasswordAction, Account: account})
+		}
+
+		if !equal(actual.Permissions, account.Permissions) {
+			changes = append(changes, Change{Action: UpdatePermissionsAction, Account: account})
+		}
+	}
+
+	for _, account := range existing {
+		if !wanted[account.Username] {
+			changes = append(changes, Change{Action: DropAction, Account: account})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Account.Username < changes[j].Account.Username
+	})
+
+	return changes, nil
+}
+
+// Reconcile plans and applies the changes required to bring the target system in line with the desired credentials.
+// When running in dry-run mode, changes are planned and returned, but never applied.
+func (r *Reconciler) Reconcile(ctx context.Context, desired []engine.UserCredential) ([]Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log := zaputil.Extract(ctx)
+
+	changes, err := r.plan(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.applied == nil {
+		r.applied = make(map[string][32]byte)
+	}
+
+	for _, change := range changes {
+		log.Info("reconciling account",
+			zap.String("action", string(change.Action)),
+			zap.String("username", change.Account.Username),
+			zap.Bool("dry_run", r.DryRun))
+
+		if r.DryRun {
+			continue
+		}
+
+		switch change.Action {
+		case CreateAction:
+			err = r.Connector.Create(ctx, change.Account)
+		case UpdatePasswordAction:
+			err = r.Connector.UpdatePassword(ctx, change.Account)
+		case UpdatePermissionsAction:
+			err = r.Connector.UpdatePermissions(ctx, change.Account)
+		case DropAction:
+			err = r.Connector.Drop(ctx, change.Account)
+		}
+
+		if err != nil {
+			return changes, err
+		}
+
+		switch change.Action {
+		case CreateAction, UpdatePasswordAction:
+			r.applied[change.Account.Username] = sha256.Sum256([]byte(change.Account.Password))
+		case DropAction:
+			delete(r.applied, change.Account.Username)
+		}
+	}
+
+	return changes, nil
+}
+
+// Run periodically polls the source and reconciles the results into the target system until the context is
+// canceled. Failures are logged and retried on the next interval.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, source Source) error {
+	log := zaputil.Extract(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		desired, err := source(ctx)
+		if err != nil {
+			log.Error("failed to list credentials", zap.Error(err))
+		} else if _, err = r.Reconcile(ctx, desired); err != nil {
+			log.Error("failed to reconcile credentials", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
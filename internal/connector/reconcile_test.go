@@ -0,0 +1,158 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package connector_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/varys/internal/connector"
+	"github.com/mjpitz/varys/internal/engine"
+)
+
+func credential(username, password string, permissions ...engine.Permission) engine.UserCredential {
+	return engine.UserCredential{
+		Permission: permissions,
+		Credentials: engine.Credentials{
+			Username: username,
+			Password: password,
+		},
+	}
+}
+
+func TestReconciler(t *testing.T) {
+	ctx := context.Background()
+
+	memory := connector.NewMemory(
+		connector.Account{Username: "stale", Password: "stale", Permissions: []engine.Permission{engine.ReadPermission}},
+		connector.Account{Username: "rotated", Password: "old", Permissions: []engine.Permission{engine.ReadPermission}},
+		connector.Account{Username: "promoted", Password: "promoted", Permissions: []engine.Permission{engine.ReadPermission}},
+		connector.Account{Username: "unchanged", Password: "unchanged", Permissions: []engine.Permission{engine.ReadPermission}},
+	)
+
+	desired := []engine.UserCredential{
+		credential("created", "created", engine.ReadPermission, engine.WritePermission),
+		credential("rotated", "new", engine.ReadPermission),
+		credential("promoted", "promoted", engine.AdminPermission, engine.ReadPermission, engine.AdminPermission),
+		credential("unchanged", "unchanged", engine.ReadPermission),
+		credential("", "", engine.ReadPermission),
+	}
+
+	expected := []connector.Change{
+		{Action: connector.CreateAction, Account: connector.Account{
+			Username: "created", Password: "created",
+			Permissions: []engine.Permission{engine.ReadPermission, engine.WritePermission},
+		}},
+		{Action: connector.UpdatePermissionsAction, Account: connector.Account{
+			Username: "promoted", Password: "promoted",
+			Permissions: []engine.Permission{engine.ReadPermission, engine.AdminPermission},
+		}},
+		{Action: connector.UpdatePasswordAction, Account: connector.Account{
+			Username: "rotated", Password: "new",
+			Permissions: []engine.Permission{engine.ReadPermission},
+		}},
+		{Action: connector.DropAction, Account: connector.Account{
+			Username: "stale", Password: "stale",
+			Permissions: []engine.Permission{engine.ReadPermission},
+		}},
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		reconciler := &connector.Reconciler{Connector: memory, DryRun: true}
+
+		before, err := memory.List(ctx)
+		require.NoError(t, err)
+
+		changes, err := reconciler.Reconcile(ctx, desired)
+		require.NoError(t, err)
+		require.Equal(t, expected, changes)
+
+		after, err := memory.List(ctx)
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		reconciler := &connector.Reconciler{Connector: memory}
+
+		changes, err := reconciler.Reconcile(ctx, desired)
+		require.NoError(t, err)
+		require.Equal(t, expected, changes)
+
+		accounts, err := memory.List(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []connector.Account{
+			{Username: "created", Password: "created", Permissions: []engine.Permission{engine.ReadPermission, engine.WritePermission}},
+			{Username: "promoted", Password: "promoted", Permissions: []engine.Permission{engine.ReadPermission, engine.AdminPermission}},
+			{Username: "rotated", Password: "new", Permissions: []engine.Permission{engine.ReadPermission}},
+			{Username: "unchanged", Password: "unchanged", Permissions: []engine.Permission{engine.ReadPermission}},
+		}, accounts)
+
+		changes, err = reconciler.Reconcile(ctx, desired)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+	})
+}
+
+// opaque hides passwords from the reconciler, similar to most database systems.
+type opaque struct {
+	*connector.Memory
+}
+
+func (o opaque) List(ctx context.Context) ([]connector.Account, error) {
+	accounts, err := o.Memory.List(ctx)
+	for i := range accounts {
+		accounts[i].Password = ""
+	}
+
+	return accounts, err
+}
+
+func TestReconcilerOpaquePasswords(t *testing.T) {
+	ctx := context.Background()
+
+	memory := connector.NewMemory(
+		connector.Account{Username: "existing", Password: "unknown", Permissions: []engine.Permission{engine.ReadPermission}},
+	)
+
+	reconciler := &connector.Reconciler{Connector: opaque{memory}}
+	desired := []engine.UserCredential{credential("existing", "derived", engine.ReadPermission)}
+
+	// passwords we have not set are always reset
+	changes, err := reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, connector.UpdatePasswordAction, changes[0].Action)
+
+	// once set, they are left alone until the derived password changes
+	changes, err = reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	desired[0].Credentials.Password = "rotated"
+
+	changes, err = reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, connector.UpdatePasswordAction, changes[0].Action)
+
+	accounts, err := memory.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", accounts[0].Password)
+}
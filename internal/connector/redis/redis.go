@@ -0,0 +1,334 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package redis provides a connector that provisions users within Redis using access control lists.
+//
+// Redis 6.2 or later is required. Users created by the connector are identified by a marker channel, and ACL rules for
+// channels were introduced in 6.2.
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+	"github.com/mjpitz/varys/internal/connector"
+	"github.com/mjpitz/varys/internal/engine"
+	"github.com/mjpitz/varys/internal/resp"
+)
+
+// Config defines the options used to connect to and manage users within a Redis server.
+type Config struct {
+	Address    string `json:"address"     usage:"the address of the redis server" default:"localhost:6379"`
+	Username   string `json:"username"    usage:"the username used to administer redis"`
+	Password   string `json:"password"    usage:"the password used to administer redis"`
+	KeyPattern string `json:"key_pattern" usage:"the key pattern that users are granted access to" default:"*"`
+	Ignore     string `json:"ignore"      usage:"a comma separated list of users that should not be managed" default:"default"`
+	Marker     string `json:"marker"      usage:"a channel granted to every user created by varys, used to identify them (requires redis 6.2+)" default:"__varys__"`
+}
+
+// categories maps varys permissions to ACL command categories. Redis does not distinguish between writing and updating
+// a key, so both permissions map to the same category.
+var categories = map[engine.Permission]string{
+	engine.ReadPermission:   "+@read",
+	engine.WritePermission:  "+@write",
+	engine.UpdatePermission: "+@write",
+	engine.DeletePermission: "+@keyspace",
+	engine.AdminPermission:  "+@all",
+}
+
+// Open connects to the Redis server.
+func Open(ctx context.Context, cfg Config) (*Connector, error) {
+	if cfg.KeyPattern == "" {
+		cfg.KeyPattern = "*"
+	}
+
+	if cfg.Marker == "" {
+		cfg.Marker = "__varys__"
+	}
+
+	ignore := map[string]bool{}
+	for _, user := range strings.Split(cfg.Ignore, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			ignore[user] = true
+		}
+	}
+
+	if cfg.Username != "" {
+		ignore[cfg.Username] = true
+	}
+
+	c := &Connector{
+		cfg:    cfg,
+		ignore: ignore,
+	}
+
+	_, err := c.do(ctx, "PING")
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Connector manages ACL users within a Redis server.
+type Connector struct {
+	cfg    Config
+	ignore map[string]bool
+
+	mu     sync.Mutex
+	client *resp.Client
+}
+
+func (c *Connector) do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		client, err := resp.Dial(ctx, c.cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.cfg.Password != "" {
+			auth := []string{"AUTH", c.cfg.Password}
+			if c.cfg.Username != "" {
+				auth = []string{"AUTH", c.cfg.Username, c.cfg.Password}
+			}
+
+			if _, err = client.Do(ctx, auth...); err != nil {
+				_ = client.Close()
+				return nil, err
+			}
+		}
+
+		c.client = client
+	}
+
+	value, err := c.client.Do(ctx, args...)
+	if _, ok := err.(resp.Error); err != nil && !ok {
+		// connection level failure, reconnect on the next call
+		_ = c.client.Close()
+		c.client = nil
+	}
+
+	return value, err
+}
+
+// commands returns the command rules for the provided permissions.
+func commands(permissions []engine.Permission) []string {
+	set := make(map[engine.Permission]bool, len(permissions))
+	for _, permission := range permissions {
+		set[permission] = true
+	}
+
+	if set[engine.AdminPermission] {
+		return []string{categories[engine.AdminPermission]}
+	}
+
+	rules := make([]string, 0, len(set))
+	seen := make(map[string]bool, len(set))
+
+	for _, permission := range engine.PermissionValues {
+		category, ok := categories[permission]
+		if !set[permission] || !ok || seen[category] {
+			continue
+		}
+
+		seen[category] = true
+		rules = append(rules, category)
+	}
+
+	return rules
+}
+
+// permissions returns the permissions represented by the provided command rules.
+func permissions(rules []string) []engine.Permission {
+	set := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		set[rule] = true
+	}
+
+	result := make([]engine.Permission, 0, len(rules))
+	for _, permission := range engine.PermissionValues {
+		if category, ok := categories[permission]; ok && set[category] {
+			result = append(result, permission)
+		}
+	}
+
+	return result
+}
+
+// rules returns the ACL rules for a user with the provided permissions. Every user is granted the marker channel so
+// that the users created by varys can be told apart from the rest. Since pub/sub commands are only available to
+// administrators, the channel grants no meaningful access.
+func (c *Connector) rules(permissions []engine.Permission) []string {
+	return append([]string{
+		"on", "resetkeys", "~" + c.cfg.KeyPattern, "resetchannels", "&" + c.cfg.Marker, "-@all",
+	}, commands(permissions)...)
+}
+
+func hash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return "#" + hex.EncodeToString(sum[:])
+}
+
+// Normalize collapses permissions that share a command category so that they compare equal to those reported by List.
+func (c *Connector) Normalize(perms []engine.Permission) []engine.Permission {
+	return permissions(commands(perms))
+}
+
+// parse extracts the state we manage from a line of ACL LIST output. Rules that reset state or manage passwords are
+// ignored.
+func parse(fields []string) (enabled bool, keys, channels, cmds []string) {
+	for _, field := range fields {
+		switch {
+		case field == "on":
+			enabled = true
+		case field == "allkeys":
+			keys = append(keys, "~*")
+		case field == "allchannels":
+			channels = append(channels, "&*")
+		case field == "allcommands":
+			cmds = append(cmds, "+@all")
+		case field == "nocommands", field == "-@all":
+		case strings.HasPrefix(field, "~"):
+			keys = append(keys, field)
+		case strings.HasPrefix(field, "&"):
+			channels = append(channels, field)
+		case strings.HasPrefix(field, "+"), strings.HasPrefix(field, "-"):
+			cmds = append(cmds, field)
+		}
+	}
+
+	sort.Strings(keys)
+	sort.Strings(channels)
+	sort.Strings(cmds)
+
+	return enabled, keys, channels, cmds
+}
+
+// List returns the users that have been granted the marker channel. Users created by earlier versions of the
+// connector do not have the marker and are recreated, keeping their username, on the next reconciliation.
+func (c *Connector) List(ctx context.Context) ([]connector.Account, error) {
+	log := zaputil.Extract(ctx)
+
+	value, err := c.do(ctx, "ACL", "LIST")
+	if err != nil {
+		return nil, err
+	}
+
+	lines, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to ACL LIST: %T", value)
+	}
+
+	accounts := make([]connector.Account, 0, len(lines))
+
+	for _, line := range lines {
+		entry, _ := line.(string)
+
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || fields[0] != "user" || c.ignore[fields[1]] {
+			continue
+		}
+
+		enabled, keys, channels, cmds := parse(fields[2:])
+		if !contains(channels, "&"+c.cfg.Marker) {
+			// not created by varys
+			continue
+		}
+
+		account := connector.Account{Username: fields[1]}
+		account.Permissions = permissions(cmds)
+
+		_, expectedKeys, expectedChannels, expectedCmds := parse(c.rules(account.Permissions))
+
+		if !enabled || strings.Join(keys, " ") != strings.Join(expectedKeys, " ") ||
+			strings.Join(channels, " ") != strings.Join(expectedChannels, " ") ||
+			strings.Join(cmds, " ") != strings.Join(expectedCmds, " ") {
+			log.Warn("acl drift detected", zap.String("username", account.Username), zap.String("acl", entry))
+
+			// clearing the permissions forces the reconciler to reset the users' rules
+			account.Permissions = nil
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Connector) setUser(ctx context.Context, username string, rules ...string) error {
+	_, err := c.do(ctx, append([]string{"ACL", "SETUSER", username}, rules...)...)
+	return err
+}
+
+func (c *Connector) Create(ctx context.Context, account connector.Account) error {
+	rules := append([]string{"reset", hash(account.Password)}, c.rules(account.Permissions)...)
+
+	return c.setUser(ctx, account.Username, rules...)
+}
+
+func (c *Connector) UpdatePassword(ctx context.Context, account connector.Account) error {
+	return c.setUser(ctx, account.Username, "resetpass", hash(account.Password))
+}
+
+func (c *Connector) UpdatePermissions(ctx context.Context, account connector.Account) error {
+	return c.setUser(ctx, account.Username, c.rules(account.Permissions)...)
+}
+
+func (c *Connector) Drop(ctx context.Context, account connector.Account) error {
+	_, err := c.do(ctx, "ACL", "DELUSER", account.Username)
+	return err
+}
+
+// Close closes the underlying connection.
+func (c *Connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+
+	err := c.client.Close()
+	c.client = nil
+
+	return err
+}
+
+var (
+	_ connector.Connector  = &Connector{}
+	_ connector.Normalizer = &Connector{}
+)
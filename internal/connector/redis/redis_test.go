@@ -0,0 +1,263 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/varys/internal/connector"
+	"github.com/mjpitz/varys/internal/connector/redis"
+	"github.com/mjpitz/varys/internal/engine"
+	"github.com/mjpitz/varys/internal/resp"
+)
+
+// server is a stand-in for a Redis server that supports the subset of ACL commands used by the connector.
+type server struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	users map[string][]string
+}
+
+func newServer(t *testing.T) *server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &server{
+		listener: listener,
+		users: map[string][]string{
+			"default": {"on", "nopass", "~*", "&*", "+@all"},
+			"legacy":  {"on", "#abc", "~*", "&*", "-@all", "+@read"},
+		},
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := resp.ReadCommand(reader)
+		if err != nil {
+			return
+		}
+
+		switch cmd := strings.ToUpper(strings.Join(args[:min(2, len(args))], " ")); {
+		case cmd == "PING":
+			err = resp.WriteStatus(conn, "PONG")
+		case cmd == "ACL LIST":
+			err = resp.WriteValue(conn, s.list())
+		case cmd == "ACL SETUSER":
+			s.setUser(args[2], args[3:])
+			err = resp.WriteStatus(conn, "OK")
+		case cmd == "ACL DELUSER":
+			s.mu.Lock()
+			delete(s.users, args[2])
+			s.mu.Unlock()
+			err = resp.WriteValue(conn, int64(1))
+		default:
+			err = resp.WriteValue(conn, resp.Error("ERR unknown command"))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func (s *server) list() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	lines := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, strings.Join(append([]string{"user", name}, s.users[name]...), " "))
+	}
+
+	return lines
+}
+
+func (s *server) setUser(name string, rules []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.users[name]
+	if current == nil {
+		current = []string{"off"}
+	}
+
+	filter := func(keep func(string) bool) {
+		next := make([]string, 0, len(current))
+		for _, rule := range current {
+			if keep(rule) {
+				next = append(next, rule)
+			}
+		}
+
+		current = next
+	}
+
+	for _, rule := range rules {
+		switch {
+		case rule == "reset":
+			current = []string{"off"}
+		case rule == "on", rule == "off":
+			filter(func(r string) bool { return r != "on" && r != "off" })
+			current = append([]string{rule}, current...)
+		case rule == "resetpass":
+			filter(func(r string) bool { return !strings.HasPrefix(r, "#") })
+		case rule == "resetkeys":
+			filter(func(r string) bool { return !strings.HasPrefix(r, "~") })
+		case rule == "resetchannels":
+			filter(func(r string) bool { return !strings.HasPrefix(r, "&") })
+		case rule == "-@all":
+			filter(func(r string) bool { return !strings.HasPrefix(r, "+") && !strings.HasPrefix(r, "-") })
+			current = append(current, rule)
+		default:
+			current = append(current, rule)
+		}
+	}
+
+	s.users[name] = current
+}
+
+func (s *server) user(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.users[name]
+}
+
+func TestConnector(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+
+	conn, err := redis.Open(ctx, redis.Config{
+		Address:    srv.listener.Addr().String(),
+		KeyPattern: "*",
+		Ignore:     "default",
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reconciler := &connector.Reconciler{Connector: conn}
+
+	desired := []engine.UserCredential{
+		{
+			Permission:  []engine.Permission{engine.ReadPermission, engine.WritePermission},
+			Credentials: engine.Credentials{Username: "alice", Password: "alice"},
+		},
+		{
+			Permission:  []engine.Permission{engine.AdminPermission, engine.ReadPermission},
+			Credentials: engine.Credentials{Username: "bob", Password: "bob"},
+		},
+	}
+
+	changes, err := reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+
+	require.Equal(t, []string{
+		"on", "#2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90", "~*", "&__varys__", "-@all",
+		"+@read", "+@write",
+	}, srv.user("alice"))
+
+	accounts, err := conn.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []connector.Account{
+		{Username: "alice", Permissions: []engine.Permission{engine.ReadPermission, engine.WritePermission, engine.UpdatePermission}},
+		{Username: "bob", Permissions: []engine.Permission{engine.AdminPermission}},
+	}, accounts)
+
+	// a converged system produces no changes
+	changes, err = reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	// out of band modifications are detected and corrected
+	srv.setUser("alice", []string{"+flushall"})
+
+	changes, err = reconciler.Reconcile(ctx, desired)
+	require.NoError(t, err)
+	require.Equal(t, []connector.Change{{
+		Action: connector.UpdatePermissionsAction,
+		Account: connector.Account{
+			Username:    "alice",
+			Password:    "alice",
+			Permissions: []engine.Permission{engine.ReadPermission, engine.WritePermission, engine.UpdatePermission},
+		},
+	}}, changes)
+	require.NotContains(t, srv.user("alice"), "+flushall")
+
+	// users who have lost their grants are removed
+	changes, err = reconciler.Reconcile(ctx, desired[1:])
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, connector.DropAction, changes[0].Action)
+	require.Nil(t, srv.user("alice"))
+	require.NotNil(t, srv.user("default"))
+
+	// users that were not created by varys are left untouched
+	require.Equal(t, []string{"on", "#abc", "~*", "&*", "-@all", "+@read"}, srv.user("legacy"))
+
+	// removing the marker hands the user back to the operator
+	srv.setUser("bob", []string{"resetchannels"})
+
+	changes, err = reconciler.Reconcile(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	require.NotNil(t, srv.user("bob"))
+}
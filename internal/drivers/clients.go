@@ -0,0 +1,224 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Postgres configures clients using the libpq environment variables, which are honored by psql, pg_dump, and most
+// other tools built on libpq. The password is written to a password file rather than being passed directly. When
+// connecting through a proxy, the password is a token that's only accepted by the proxy.
+type Postgres struct{}
+
+func (Postgres) DefaultProgram() []string {
+	return []string{"psql"}
+}
+
+// escape escapes values written to a .pgpass file.
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(value)
+}
+
+func (Postgres) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, port, database := ParseAddress(conn.Address, "5432")
+
+	cmd.Env = append(cmd.Env,
+		"PGHOST="+host,
+		"PGPORT="+port,
+		"PGUSER="+conn.Username,
+	)
+
+	if conn.Password != "" {
+		passfile := filepath.Join(conn.Dir, "pgpass")
+		entry := fmt.Sprintf("%s:%s:*:%s:%s\n", escape(host), escape(port), escape(conn.Username), escape(conn.Password))
+
+		if err := ioutil.WriteFile(passfile, []byte(entry), 0600); err != nil {
+			return err
+		}
+
+		cmd.Env = append(cmd.Env, "PGPASSFILE="+passfile)
+	}
+
+	if database != "" {
+		cmd.Env = append(cmd.Env, "PGDATABASE="+database)
+	}
+
+	return nil
+}
+
+// MySQL configures clients using an option file. MySQL clients require the --defaults-extra-file option to be
+// provided first, so it's only added for the programs that ship with MySQL.
+type MySQL struct{}
+
+func (MySQL) DefaultProgram() []string {
+	return []string{"mysql"}
+}
+
+func (MySQL) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, port, database := ParseAddress(conn.Address, "3306")
+
+	options := fmt.Sprintf("[client]\nhost=%q\nport=%s\nuser=%q\npassword=%q\n", host, port, conn.Username, conn.Password)
+	if database != "" {
+		options += fmt.Sprintf("database=%q\n", database)
+	}
+
+	optionFile := filepath.Join(conn.Dir, "my.cnf")
+	if err := ioutil.WriteFile(optionFile, []byte(options), 0600); err != nil {
+		return err
+	}
+
+	switch program(cmd) {
+	case "mysql", "mysqldump", "mysqladmin", "mysqlshow", "mysqlcheck":
+		insertArgs(cmd, "--defaults-extra-file="+optionFile)
+	}
+
+	cmd.Env = append(cmd.Env,
+		"MYSQL_HOST="+host,
+		"MYSQL_TCP_PORT="+port,
+	)
+
+	return nil
+}
+
+// Redis configures redis-cli using command line flags. The password is provided through the REDISCLI_AUTH environment
+// variable so it does not show up in the process list. When connecting through a proxy, the password is a token
+// that's only accepted by the proxy.
+type Redis struct{}
+
+func (Redis) DefaultProgram() []string {
+	return []string{"redis-cli"}
+}
+
+func (Redis) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, port, _ := ParseAddress(conn.Address, "6379")
+
+	if program(cmd) == "redis-cli" {
+		insertArgs(cmd, "-h", host, "-p", port, "--user", conn.Username)
+	}
+
+	if conn.Password != "" {
+		cmd.Env = append(cmd.Env, "REDISCLI_AUTH="+conn.Password)
+	}
+
+	return nil
+}
+
+// MongoDB configures mongosh (or the legacy mongo shell) using a script that connects to the database. The connection
+// string contains the password, so it's written to the script rather than being passed as an argument where it would
+// show up in the process list.
+type MongoDB struct{}
+
+func (MongoDB) DefaultProgram() []string {
+	return []string{"mongosh"}
+}
+
+func (MongoDB) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, port, database := ParseAddress(conn.Address, "27017")
+
+	uri := url.URL{
+		Scheme: "mongodb",
+		User:   url.UserPassword(conn.Username, conn.Password),
+		Host:   net.JoinHostPort(host, port),
+		Path:   "/" + database,
+	}
+
+	// a json string is a valid javascript string literal
+	literal, err := json.Marshal(uri.String())
+	if err != nil {
+		return err
+	}
+
+	script := filepath.Join(conn.Dir, "connect.js")
+	if err = ioutil.WriteFile(script, []byte("db = connect("+string(literal)+");\n"), 0600); err != nil {
+		return err
+	}
+
+	switch program(cmd) {
+	case "mongosh", "mongo":
+		insertArgs(cmd, "--nodb", "--shell", script)
+	}
+
+	return nil
+}
+
+// HTTP configures curl using a netrc file. The address of the service is used as the URL when curl is the default
+// program.
+type HTTP struct{}
+
+func (HTTP) DefaultProgram() []string {
+	return []string{"curl"}
+}
+
+func (HTTP) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, _, _ := ParseAddress(conn.Address, "")
+
+	netrc := filepath.Join(conn.Dir, "netrc")
+	entry := fmt.Sprintf("machine %s\nlogin %s\npassword %s\n", host, conn.Username, conn.Password)
+
+	if err := ioutil.WriteFile(netrc, []byte(entry), 0600); err != nil {
+		return err
+	}
+
+	if program(cmd) == "curl" {
+		insertArgs(cmd, "--netrc-file", netrc)
+
+		if len(cmd.Args) == 3 {
+			cmd.Args = append(cmd.Args, conn.Address)
+		}
+	}
+
+	cmd.Env = append(cmd.Env, "NETRC="+netrc)
+
+	return nil
+}
+
+// SSH configures ssh to connect to the host as the derived user. When a private key is available, it's written to the
+// connections' directory and provided as the only identity. When the key is held by an agent, no key is written.
+type SSH struct{}
+
+func (SSH) DefaultProgram() []string {
+	return []string{"ssh"}
+}
+
+func (SSH) Prepare(cmd *exec.Cmd, conn Connection) error {
+	host, port, _ := ParseAddress(conn.Address, "22")
+
+	args := []string{"-p", port, "-l", conn.Username}
+
+	if conn.PrivateKey != "" {
+		identity := filepath.Join(conn.Dir, "id_ed25519")
+		if err := ioutil.WriteFile(identity, []byte(conn.PrivateKey), 0600); err != nil {
+			return err
+		}
+
+		args = append(args, "-i", identity, "-o", "IdentitiesOnly=yes")
+	}
+
+	if program(cmd) == "ssh" {
+		insertArgs(cmd, append(args, host)...)
+	}
+
+	return nil
+}
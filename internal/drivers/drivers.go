@@ -0,0 +1,142 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package drivers knows how to launch the native client for each kind of service managed by varys.
+package drivers
+
+import (
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Connection describes the service being connected to along with the credentials used to connect.
+type Connection struct {
+	Kind     string
+	Name     string
+	Address  string
+	Username string
+	Password string
+	// PrivateKey contains an OpenSSH formatted private key for services that derive SSH keys.
+	PrivateKey string
+	// Dir is a private, temporary directory that drivers may write auth files to. It's removed once the program exits.
+	Dir string
+}
+
+// Driver configures a program to connect to a given kind of service.
+type Driver interface {
+	// DefaultProgram returns the program that's launched when none is provided.
+	DefaultProgram() []string
+	// Prepare configures the command to connect to the service. Drivers may add arguments, environment variables, or
+	// write auth files to the connections' directory.
+	Prepare(cmd *exec.Cmd, conn Connection) error
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Driver{
+		"http":       HTTP{},
+		"https":      HTTP{},
+		"mongo":      MongoDB{},
+		"mongodb":    MongoDB{},
+		"mysql":      MySQL{},
+		"postgres":   Postgres{},
+		"postgresql": Postgres{},
+		"redis":      Redis{},
+		"ssh":        SSH{},
+	}
+)
+
+// Register adds a driver for the provided kind of service, replacing any existing driver.
+func Register(kind string, driver Driver) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registry[kind] = driver
+}
+
+// Lookup returns the driver for the provided kind of service. Kinds without a registered driver fall back to the
+// Environment driver.
+func Lookup(kind string) Driver {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if driver, ok := registry[strings.ToLower(kind)]; ok {
+		return driver
+	}
+
+	return Environment{}
+}
+
+// Environment exposes the address and credentials through environment variables prefixed with the kind and name of
+// the service (e.g. KIND_NAME_ADDRESS). It requires a program to be provided.
+type Environment struct{}
+
+func (Environment) DefaultProgram() []string {
+	return nil
+}
+
+func (Environment) Prepare(cmd *exec.Cmd, conn Connection) error {
+	prefix := strings.ToUpper(conn.Kind) + "_" + strings.ToUpper(conn.Name)
+
+	cmd.Env = append(cmd.Env,
+		prefix+"_ADDRESS="+conn.Address,
+		prefix+"_USERNAME="+conn.Username,
+		prefix+"_PASSWORD="+conn.Password,
+	)
+
+	return nil
+}
+
+// ParseAddress breaks the address down into its host, port, and path. Addresses may be provided as a URL, host:port,
+// or a bare host.
+func ParseAddress(addr, defaultPort string) (host, port, path string) {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			addr = u.Host
+			path = strings.TrimPrefix(u.Path, "/")
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+
+	if port == "" {
+		port = defaultPort
+	}
+
+	return host, port, path
+}
+
+// program returns the base name of the program being executed.
+func program(cmd *exec.Cmd) string {
+	if len(cmd.Args) == 0 {
+		return ""
+	}
+
+	return filepath.Base(cmd.Args[0])
+}
+
+// insertArgs adds arguments immediately after the program name. Some clients require options like
+// --defaults-extra-file to come first.
+func insertArgs(cmd *exec.Cmd, args ...string) {
+	cmd.Args = append(append([]string{cmd.Args[0]}, args...), cmd.Args[1:]...)
+}
@@ -17,16 +17,18 @@
 package engine
 
 import (
+	"time"
+
 	"github.com/casbin/casbin/v2"
 	"github.com/dgraph-io/badger/v3"
 )
 
 // NewAPI constructs a new API definition used to mount the various endpoints for the engine.
-func NewAPI(db *badger.DB, enforcer *casbin.Enforcer, root string) *API {
+func NewAPI(db *badger.DB, enforcer *casbin.Enforcer, keys KeyRing) *API {
 	return &API{
 		db:       db,
 		enforcer: enforcer,
-		root:     root,
+		keys:     keys,
 		users: &Store{
 			db:     db,
 			prefix: "varys/users",
@@ -35,15 +37,47 @@ func NewAPI(db *badger.DB, enforcer *casbin.Enforcer, root string) *API {
 			db:     db,
 			prefix: "varys/services",
 		},
+		grants: &Store{
+			db:     db,
+			prefix: "varys/grants",
+		},
+		requests: &Store{
+			db:     db,
+			prefix: "varys/requests",
+		},
+		settings: &Store{
+			db:     db,
+			prefix: "varys/settings",
+		},
+		audit: &AuditLog{
+			db:  db,
+			key: auditMACKey(keys[DefaultRootKeyVersion]),
+		},
 	}
 }
 
 // API encapsulates the requirements of operating the API.
 type API struct {
+	// RotationGracePeriod controls how long credentials derived from a rotated service key or counter remain valid.
+	// When zero, rotated credentials are invalidated immediately.
+	RotationGracePeriod time.Duration
+	// SSHCertificateTTL controls how long SSH certificates are valid for. Users may request shorter lived certificates.
+	SSHCertificateTTL time.Duration
+	// CertificateTTL controls how long X.509 client certificates are valid for. Users may request shorter lived
+	// certificates.
+	CertificateTTL time.Duration
+	// GroupMembershipTTL controls how long the groups reported on a users' most recent request are used to provision
+	// credentials for roles granted to a group. When zero, recorded groups never expire.
+	GroupMembershipTTL time.Duration
+
 	db       *badger.DB
 	enforcer *casbin.Enforcer
-	root     string
+	keys     KeyRing
 
 	users    *Store
 	services *Store
+	grants   *Store
+	requests *Store
+	settings *Store
+	audit    *AuditLog
 }
@@ -0,0 +1,119 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// ListAuditEntries returns entries from the audit log. Results can be filtered using the since, until (both RFC3339),
+// and actor query parameters.
+func (api *API) ListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	q := r.URL.Query()
+
+	filter := AuditFilter{
+		Actor: q.Get("actor"),
+	}
+
+	var err error
+
+	if since := q.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if until := q.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := api.audit.List(filter)
+	if err != nil {
+		log.Error("failed to list audit entries", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(entries)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// AuditVerification describes the outcome of verifying the audit log.
+type AuditVerification struct {
+	Entries int       `json:"entries"`
+	Head    AuditHead `json:"head"`
+	// Error describes why verification failed. It's empty when the log is intact.
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyAuditEntries verifies the hash chain of the audit log. The sequence and hash query parameters may be used to
+// provide a head exported by an earlier verification, detecting the log being truncated or rolled back since.
+func (api *API) VerifyAuditEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	q := r.URL.Query()
+
+	var expected *AuditHead
+
+	if sequence := q.Get("sequence"); sequence != "" {
+		parsed, err := strconv.ParseUint(sequence, 10, 64)
+		if err != nil || parsed == 0 || q.Get("hash") == "" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		expected = &AuditHead{Sequence: parsed, Hash: q.Get("hash")}
+	}
+
+	head, entries, err := api.audit.Verify(expected)
+
+	resp := AuditVerification{Entries: entries, Head: head}
+
+	switch {
+	case errors.Is(err, ErrAuditChainBroken):
+		resp.Error = err.Error()
+	case err != nil:
+		log.Error("failed to verify audit log", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(resp)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
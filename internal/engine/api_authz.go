@@ -0,0 +1,118 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+type AuthzCheckRequest struct {
+	// User identifies the user being checked. Their groups, as reported on their most recent request, are included
+	// the same way they are when the user makes a request.
+	User User `json:"user"`
+	// Subject may be provided in place of User to check a specific subject (e.g. a role or /_group/{name}).
+	Subject string `json:"subject,omitempty"`
+	Object  string `json:"object"`
+	Action  string `json:"action"`
+}
+
+type AuthzCheckResponse struct {
+	Allowed bool `json:"allowed"`
+	// Subject contains the user, group, or role the request was allowed through.
+	Subject string `json:"subject,omitempty"`
+	// Policy contains the policy that allowed the request, formatted as subject, object, and action.
+	Policy []string `json:"policy,omitempty"`
+	// Roles contains the chain of roles linking the subject to the policy.
+	Roles []string `json:"roles,omitempty"`
+	// Subjects lists every subject that was evaluated, in order.
+	Subjects []string `json:"subjects"`
+}
+
+// CheckAuthz evaluates whether a subject is allowed to perform an action on an object without performing it. When
+// allowed, the response explains which policy matched and how the subject came to hold it.
+func (api *API) CheckAuthz(w http.ResponseWriter, r *http.Request) {
+	req := AuthzCheckRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	resp := AuthzCheckResponse{}
+
+	switch {
+	case req.Object == "" || req.Action == "":
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	case req.Subject != "":
+		resp.Subjects = []string{req.Subject}
+	case req.User.Kind != "" && req.User.ID != "":
+		user := req.User
+
+		err = api.users.Get(ctx, user.Kind, user.ID, &user)
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			// users may be granted roles before they've logged in for the first time
+		case err != nil:
+			log.Error("failed to get user", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		resp.Subjects = user.subjects()
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	for _, subject := range resp.Subjects {
+		allowed, explain, err := api.enforcer.EnforceEx(subject, req.Object, req.Action)
+		if err != nil {
+			log.Error("failed to enforce access", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		} else if !allowed {
+			continue
+		}
+
+		resp.Allowed = true
+		resp.Subject = subject
+		resp.Policy = explain
+
+		if len(explain) > 0 {
+			resp.Roles = rolePath(api.enforcer.GetGroupingPolicy(), subject, explain[0])
+		}
+
+		break
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(resp)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestCheckAuthz(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	admin := User{Kind: "basic", ID: "admin", Name: "admin"}
+	member := User{Kind: "oidc", ID: "member", Name: "member", Groups: []string{"dba"}}
+
+	require.NoError(t, api.users.Put(ctx, member.Kind, member.ID, member))
+	require.NoError(t, api.grant(ctx, admin.K(), []string{"admin:varys"}, nil))
+	require.NoError(t, api.grant(ctx, Group{Name: "dba"}.K(), []string{"read:postgres:prod"}, nil))
+	require.NoError(t, EnsurePolicy(api.enforcer, `
+p, read:postgres:prod, /_service/postgres/prod, read
+`))
+
+	check := func(req AuthzCheckRequest) (int, AuthzCheckResponse) {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(req))
+
+		w := httptest.NewRecorder()
+		api.CheckAuthz(w, httptest.NewRequest(http.MethodPost, "/api/v1/authz/check", body).WithContext(ctx))
+
+		resp := AuthzCheckResponse{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&resp))
+		}
+
+		return w.Code, resp
+	}
+
+	{ // explains the role chain that led to the policy
+		code, resp := check(AuthzCheckRequest{User: admin, Object: "/api/v1/audit", Action: http.MethodGet})
+		require.Equal(t, http.StatusOK, code)
+		require.True(t, resp.Allowed)
+		require.Equal(t, admin.K(), resp.Subject)
+		require.Equal(t, []string{"read:varys:audit", "/api/v1/audit", "GET"}, resp.Policy)
+		require.Equal(t, []string{admin.K(), "admin:varys", "read:varys:audit"}, resp.Roles)
+	}
+
+	{ // includes the groups on the users' most recent request
+		code, resp := check(AuthzCheckRequest{User: User{Kind: member.Kind, ID: member.ID}, Object: "/_service/postgres/prod", Action: "read"})
+		require.Equal(t, http.StatusOK, code)
+		require.True(t, resp.Allowed)
+		require.Equal(t, []string{member.K(), "/_group/dba", "dba"}, resp.Subjects)
+		require.Equal(t, "/_group/dba", resp.Subject)
+		require.Equal(t, []string{"/_group/dba", "read:postgres:prod"}, resp.Roles)
+	}
+
+	{ // denied requests are reported without a policy
+		code, resp := check(AuthzCheckRequest{Subject: "read:postgres:prod", Object: "/api/v1/audit", Action: http.MethodGet})
+		require.Equal(t, http.StatusOK, code)
+		require.False(t, resp.Allowed)
+		require.Empty(t, resp.Policy)
+		require.Equal(t, []string{"read:postgres:prod"}, resp.Subjects)
+	}
+
+	{ // a subject or user is required
+		code, _ := check(AuthzCheckRequest{Object: "/api/v1/audit", Action: http.MethodGet})
+		require.Equal(t, http.StatusBadRequest, code)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
@@ -71,6 +72,13 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	members, err := api.getGroupMembers(ctx, time.Now())
+	if err != nil {
+		log.Error("failed to get group members", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
 	credentials := make([]UserCredential, 0)
 	userKeys := make(map[string]int)
 
@@ -87,6 +95,19 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "", http.StatusInternalServerError)
 				return
 			}
+
+			groups, err := api.getGroupsForRole(role)
+			if err != nil {
+				log.Error("failed to get groups for role", zap.Error(err))
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+
+			// includes users whose groups are named after the role
+			for _, group := range append(groups, role) {
+				users = append(users, members[group]...)
+			}
+
 			for _, user := range users {
 				_, ok := userKeys[user]
 				if !ok {
@@ -94,7 +115,11 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 					credentials = append(credentials, UserCredential{})
 				}
 
-				credentials[userKeys[user]].Permission = append(credentials[userKeys[user]].Permission, perm)
+				// users may hold the same permission through multiple roles and groups
+				granted := credentials[userKeys[user]].Permission
+				if len(granted) == 0 || granted[len(granted)-1] != perm {
+					credentials[userKeys[user]].Permission = append(granted, perm)
+				}
 			}
 		}
 	}
@@ -104,6 +129,9 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 
 	ctx = withTxn(ctx, txn)
 
+	now := time.Now()
+	previous := make([]UserCredential, 0)
+
 	for key, idx := range userKeys {
 		parts := strings.Split(key, "/")
 		user := &User{}
@@ -118,17 +146,39 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		username, password, err := Derive(api.root, service, user)
-		if err != nil {
-			log.Error("failed to derive credentials", zap.Error(err))
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		}
+		for i, version := range credentialVersions(service, user, now) {
+			root, err := api.keys.Get(version.service.RootKeyVersion)
+			if err != nil {
+				log.Error("failed to get root key", zap.Error(err))
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
 
-		credentials[idx].Credentials.Username = string(username)
-		credentials[idx].Credentials.Password = string(password)
+			derived, err := deriveCredentials(root, version.service, user.Name, version.counter)
+			if err != nil {
+				log.Error("failed to derive credentials", zap.Error(err))
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+
+			// private keys are only ever returned to the user they belong to
+			derived.PrivateKey = ""
+
+			if i == 0 {
+				credentials[idx].Credentials = derived
+				continue
+			}
+
+			previous = append(previous, UserCredential{
+				Permission:  credentials[idx].Permission,
+				Credentials: derived,
+				ExpiresAt:   version.expiresAt,
+			})
+		}
 	}
 
+	credentials = append(credentials, previous...)
+
 	err = encoding.JSON.Encoder(w).Encode(credentials)
 	if err != nil {
 		log.Error("failed to marshal json", zap.Error(err))
@@ -139,6 +189,9 @@ func (api *API) ListCredentials(w http.ResponseWriter, r *http.Request) {
 type UserCredential struct {
 	Permission  []Permission `json:"permissions"`
 	Credentials Credentials  `json:"credentials"`
+	// ExpiresAt is set on credentials that were in use before a rotation. They remain valid until the rotation grace
+	// period ends, after which they're no longer returned.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 func (api *API) GetServiceCredentials(w http.ResponseWriter, r *http.Request) {
@@ -169,15 +222,7 @@ func (api *API) GetServiceCredentials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	match := "(" + strings.Join([]string{
-		ReadPermission.String(),
-		WritePermission.String(),
-		UpdatePermission.String(),
-		DeletePermission.String(),
-		AdminPermission.String(),
-	}, ")|(") + ")"
-
-	allowed, err := api.enforcer.Enforce(user.K(), service.K(), match)
+	allowed, err := api.canReadCredentials(user, service)
 	if err != nil {
 		log.Error("failed to enforce credentials", zap.Error(err))
 		http.Error(w, "", http.StatusInternalServerError)
@@ -187,7 +232,14 @@ func (api *API) GetServiceCredentials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, password, err := Derive(api.root, service, user)
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		log.Error("failed to get root key", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	credentials, err := Derive(root, service, user)
 	if err != nil {
 		log.Error("failed to derive credentials", zap.Error(err))
 		http.Error(w, "", http.StatusInternalServerError)
@@ -195,11 +247,8 @@ func (api *API) GetServiceCredentials(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := ServiceCredentials{
-		Address: service.Address,
-		Credentials: Credentials{
-			Username: string(username),
-			Password: string(password),
-		},
+		Address:     service.Address,
+		Credentials: credentials,
 	}
 
 	err = encoding.JSON.Encoder(w).Encode(response)
@@ -209,29 +258,75 @@ func (api *API) GetServiceCredentials(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// canReadCredentials determines if the user has been granted any permission on the service, allowing them to obtain
+// their own credentials for it.
+func (api *API) canReadCredentials(user *User, service Service) (bool, error) {
+	match := "(" + strings.Join([]string{
+		ReadPermission.String(),
+		WritePermission.String(),
+		UpdatePermission.String(),
+		DeletePermission.String(),
+		AdminPermission.String(),
+	}, ")|(") + ")"
+
+	return api.enforce(user, service.K(), match)
+}
+
 type ServiceCredentials struct {
 	Address     string      `json:"address"`
 	Credentials Credentials `json:"credentials"`
 }
 
-// Derive provides a convenience function for producing a username and password for a site given the site config.
-func Derive(root string, service Service, user *User) (username, password []byte, err error) {
-	counter := user.SiteCounters[service.K()]
+// Derive provides a convenience function for producing credentials for a site given the site config.
+func Derive(root string, service Service, user *User) (Credentials, error) {
+	return deriveCredentials(root, service, user.Name, user.SiteCounters[service.K()])
+}
+
+func deriveCredentials(root string, service Service, name string, counter uint32) (Credentials, error) {
+	username, err := derive(root, pass.Identification, service, name, counter)
+	if err != nil {
+		return Credentials{}, err
+	}
 
-	username, err = derive(root, pass.Identification, service, user.Name, counter)
+	siteKey, err := deriveSiteKey(root, pass.Authentication, service, string(username), counter)
 	if err != nil {
-		return nil, nil, err
+		return Credentials{}, err
 	}
 
-	password, err = derive(root, pass.Authentication, service, string(username), counter)
+	password, err := sitePassword(pass.Authentication, service, siteKey)
 	if err != nil {
-		return nil, nil, err
+		return Credentials{}, err
 	}
 
-	return username, password, nil
+	credentials := Credentials{
+		Username: string(username),
+		Password: string(password),
+	}
+
+	if service.SSHKey {
+		key := deriveSSHKey(siteKey)
+
+		credentials.PublicKey, err = marshalAuthorizedKey(key, credentials.Username)
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		privateKey, err := marshalOpenSSHPrivateKey(key, credentials.Username)
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		credentials.PrivateKey = string(privateKey)
+	}
+
+	if service.TOTP {
+		credentials.TOTPURI = totpURI(deriveTOTPSecret(siteKey), totpIssuer(service), credentials.Username)
+	}
+
+	return credentials, nil
 }
 
-func derive(root string, scope pass.Scope, site Service, name string, counter uint32) ([]byte, error) {
+func deriveSiteKey(root string, scope pass.Scope, site Service, name string, counter uint32) ([]byte, error) {
 	key, err := pass.Identity(pass.Authentication, site.Key, root)
 	if err != nil {
 		return nil, err
@@ -242,12 +337,25 @@ func derive(root string, scope pass.Scope, site Service, name string, counter ui
 		return nil, err
 	}
 
-	siteKey := pass.SiteKey(scope, identity, site.Address, counter)
+	return pass.SiteKey(scope, identity, site.Address, counter), nil
+}
 
-	switch scope {
-	case pass.Identification:
+func sitePassword(scope pass.Scope, site Service, siteKey []byte) ([]byte, error) {
+	switch {
+	case scope == pass.Identification:
 		return pass.SitePassword(siteKey, site.Templates.UserTemplate), nil
+	case site.PasswordPolicy != nil:
+		return site.PasswordPolicy.Generate(siteKey)
 	default:
 		return pass.SitePassword(siteKey, site.Templates.PasswordTemplate), nil
 	}
 }
+
+func derive(root string, scope pass.Scope, site Service, name string, counter uint32) ([]byte, error) {
+	siteKey, err := deriveSiteKey(root, scope, site, name, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	return sitePassword(scope, site, siteKey)
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// ListKindGrants returns the users and groups that have been granted access to every service of a given kind.
+func (api *API) ListKindGrants(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	kind := mux.Vars(r)["kind"]
+	if !validKind(kind) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	resp := ListGrantsResponse{}
+	for _, perm := range PermissionValues {
+		resp.Roles = append(resp.Roles, perm.String()+":"+kind)
+	}
+
+	var err error
+
+	resp.Grants, err = api.listGrants(ctx, resp.Roles)
+	if err != nil {
+		log.Error("failed to list grants", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(resp)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// PutKindGrant grants a user or group access to every service of a given kind, including services created later.
+func (api *API) PutKindGrant(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	if !validKind(kind) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	api.putGrant(w, r, kind)
+}
+
+// DeleteKindGrant removes a user or groups' access to every service of a given kind. Access granted on individual
+// services is left in place.
+func (api *API) DeleteKindGrant(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	if !validKind(kind) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	api.deleteGrant(w, r, kind)
+}
+
+// validKind reports whether roles can be derived for the kind. Roles are named by joining the permission and kind with
+// a colon, so a kind of varys, or one that contains a colon, would produce the roles used to administer varys itself.
+func validKind(kind string) bool {
+	return kind != "" && kind != "varys" && !strings.Contains(kind, ":")
+}
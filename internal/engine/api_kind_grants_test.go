@@ -0,0 +1,148 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestKindGrants(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	admin := User{Kind: "basic", ID: "admin", Name: "admin"}
+	operator := User{Kind: "basic", ID: "operator", Name: "operator"}
+	service := Service{Kind: "postgres", Name: "prod"}
+	vars := map[string]string{"kind": service.Kind}
+
+	require.NoError(t, api.users.Put(ctx, operator.Kind, operator.ID, operator))
+	require.NoError(t, api.grant(ctx, admin.K(), []string{"admin:varys"}, nil))
+	require.NoError(t, api.grant(ctx, operator.K(), []string{"read:varys"}, nil))
+
+	policy, err := renderServicePolicy(policyTemplate{Service: service, Creator: admin})
+	require.NoError(t, err)
+	require.NoError(t, EnsurePolicy(api.enforcer, policy))
+
+	// only administrators can manage kind-level grants
+	allowed, err := api.enforce(&admin, "/api/v1/kinds/postgres/grants", http.MethodPut)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = api.enforce(&operator, "/api/v1/kinds/postgres/grants", http.MethodPut)
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	call := func(handler http.HandlerFunc, method string, grant UserGrant) {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(grant))
+
+		w := httptest.NewRecorder()
+		handler(w, mux.SetURLVars(httptest.NewRequest(method, "/api/v1/kinds/postgres/grants", body), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// roles for individual services are ignored
+	call(api.PutKindGrant, http.MethodPut, UserGrant{
+		User:  operator,
+		Roles: []string{"read:postgres", "system:postgres", "admin:postgres:prod"},
+	})
+
+	allowed, err = api.enforce(&operator, service.K(), "read")
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = api.enforce(&operator, "/api/v1/credentials/postgres/prod", http.MethodGet)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = api.enforce(&operator, service.K(), "admin")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	{
+		w := httptest.NewRecorder()
+		api.ListKindGrants(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/kinds/postgres/grants", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := ListGrantsResponse{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&resp))
+		require.Contains(t, resp.Roles, "system:postgres")
+		require.Len(t, resp.Grants, 1)
+		require.Equal(t, operator.ID, resp.Grants[0].User.ID)
+		require.Equal(t, []string{"read:postgres", "system:postgres"}, resp.Grants[0].Roles)
+	}
+
+	call(api.DeleteKindGrant, http.MethodDelete, UserGrant{
+		User:  operator,
+		Roles: []string{"read:postgres", "system:postgres"},
+	})
+
+	allowed, err = api.enforce(&operator, service.K(), "read")
+	require.NoError(t, err)
+	require.False(t, allowed)
+}
+
+func TestKindGrantsRejectVarys(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	admin := User{Kind: "basic", ID: "admin", Name: "admin"}
+	operator := User{Kind: "basic", ID: "operator", Name: "operator"}
+
+	require.NoError(t, api.users.Put(ctx, operator.Kind, operator.ID, operator))
+	require.NoError(t, api.grant(ctx, admin.K(), []string{"admin:varys"}, nil))
+	require.NoError(t, api.grant(ctx, operator.K(), []string{"admin:varys:kinds"}, nil))
+
+	for _, kind := range []string{"varys", "varys:services", "postgres:prod"} {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UserGrant{
+			User:  operator,
+			Roles: []string{"admin:" + kind},
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/kinds/"+kind+"/grants", body)
+		api.PutKindGrant(w, mux.SetURLVars(r, map[string]string{"kind": kind}))
+		require.Equal(t, http.StatusBadRequest, w.Code, kind)
+	}
+
+	allowed, err := api.enforce(&operator, "/api/v1/services/postgres/prod", http.MethodDelete)
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// revoking the administrator role through a kind is rejected as well
+	body := bytes.NewBuffer(nil)
+	require.NoError(t, encoding.JSON.Encoder(body).Encode(UserGrant{User: admin, Roles: []string{"admin:varys"}}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/kinds/varys/grants", body)
+	api.DeleteKindGrant(w, mux.SetURLVars(r, map[string]string{"kind": "varys"}))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	allowed, err = api.enforce(&admin, "/api/v1/roles", http.MethodGet)
+	require.NoError(t, err)
+	require.True(t, allowed)
+}
@@ -0,0 +1,575 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// administratorRole is the role that grants full access to varys. At least one user must always hold it.
+const administratorRole = "admin:varys"
+
+// Policy describes an action a role is allowed to perform on an object. Actions are regular expressions.
+type Policy struct {
+	Object string `json:"object"`
+	Action string `json:"action"`
+}
+
+// Role describes a role within varys, what it's allowed to do, and who it's been assigned to.
+type Role struct {
+	Name string `json:"name"`
+	// Managed indicates the role is maintained by varys and cannot be modified through the API. It may still be
+	// assigned to users and groups.
+	Managed  bool     `json:"managed"`
+	Policies []Policy `json:"policies"`
+	// Roles contains the roles this role inherits from.
+	Roles []string `json:"roles"`
+	// Members contains the users, groups, and roles that have been assigned this role.
+	Members []string `json:"members"`
+}
+
+type PutRoleRequest struct {
+	Policies []Policy `json:"policies"`
+	Roles    []string `json:"roles"`
+}
+
+// RoleAssignment identifies the user or group a role is assigned to.
+type RoleAssignment struct {
+	User  User   `json:"user"`
+	Group string `json:"group,omitempty"`
+}
+
+// valid reports whether the assignment identifies a user or group.
+func (a RoleAssignment) valid() bool {
+	return a.Group != "" || (a.User.Kind != "" && a.User.ID != "")
+}
+
+// subject returns the key of the user or group the role is assigned to.
+func (a RoleAssignment) subject() string {
+	if a.Group != "" {
+		return Group{Name: a.Group}.K()
+	}
+
+	return a.User.K()
+}
+
+// managedRole determines if the role is maintained by varys. Roles that begin with a permission are reserved for the
+// default policy, services, and kinds. Keys for users and groups are never roles.
+func managedRole(name string) bool {
+	if strings.HasPrefix(name, "/_") {
+		return true
+	}
+
+	for _, perm := range PermissionValues {
+		if strings.HasPrefix(name, perm.String()+":") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roleNames returns the name of every role known to the enforcer.
+func (api *API) roleNames() []string {
+	names := make(map[string]bool)
+
+	for _, policy := range api.enforcer.GetPolicy() {
+		names[policy[0]] = true
+	}
+
+	for _, grouping := range api.enforcer.GetGroupingPolicy() {
+		names[grouping[1]] = true
+
+		if !strings.HasPrefix(grouping[0], "/_") {
+			names[grouping[0]] = true
+		}
+	}
+
+	roles := make([]string, 0, len(names))
+	for name := range names {
+		roles = append(roles, name)
+	}
+
+	sort.Strings(roles)
+	return roles
+}
+
+// getRole returns the role with the provided name, or nil if the role does not exist.
+func (api *API) getRole(name string) *Role {
+	role := &Role{
+		Name:     name,
+		Managed:  managedRole(name),
+		Policies: make([]Policy, 0),
+		Roles:    make([]string, 0),
+		Members:  make([]string, 0),
+	}
+
+	for _, policy := range api.enforcer.GetFilteredPolicy(0, name) {
+		role.Policies = append(role.Policies, Policy{Object: policy[1], Action: policy[2]})
+	}
+
+	for _, grouping := range api.enforcer.GetFilteredGroupingPolicy(0, name) {
+		role.Roles = append(role.Roles, grouping[1])
+	}
+
+	for _, grouping := range api.enforcer.GetFilteredGroupingPolicy(1, name) {
+		role.Members = append(role.Members, grouping[0])
+	}
+
+	if len(role.Policies) == 0 && len(role.Roles) == 0 && len(role.Members) == 0 {
+		return nil
+	}
+
+	return role
+}
+
+// rolePath returns the chain of roles linking the subject to the role using the provided grouping rules. The chain
+// starts with the subject and ends with the role. Nil is returned when the subject does not hold the role.
+func rolePath(rules [][]string, subject, role string) []string {
+	parents := make(map[string][]string)
+	for _, rule := range rules {
+		parents[rule[0]] = append(parents[rule[0]], rule[1])
+	}
+
+	// previous records how each role was reached, allowing the chain to be rebuilt
+	previous := map[string]string{subject: ""}
+	queue := []string{subject}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if current == role {
+			path := make([]string, 0)
+			for ; current != subject; current = previous[current] {
+				path = append([]string{current}, path...)
+			}
+
+			return append([]string{subject}, path...)
+		}
+
+		for _, parent := range parents[current] {
+			if _, seen := previous[parent]; !seen {
+				previous[parent] = current
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removesLastAdministrator determines if removing the provided grouping rules would leave varys without a user that
+// holds the administrator role, directly or through their groups.
+func (api *API) removesLastAdministrator(ctx context.Context, removed [][]string) (bool, error) {
+	users, err := api.users.List(ctx, User{})
+	if err != nil {
+		return false, err
+	}
+
+	skip := make(map[string]bool)
+	for _, rule := range removed {
+		skip[rule[0]+"\x00"+rule[1]] = true
+	}
+
+	subjects := make([]string, 0)
+	remaining := make([][]string, 0)
+
+	for _, rule := range api.enforcer.GetGroupingPolicy() {
+		// users may be granted roles before they've logged in for the first time
+		if strings.HasPrefix(rule[0], "/_user/") {
+			subjects = append(subjects, rule[0])
+		}
+
+		if !skip[rule[0]+"\x00"+rule[1]] {
+			remaining = append(remaining, rule)
+		}
+	}
+
+	for _, u := range users {
+		subjects = append(subjects, u.(*User).subjects()...)
+	}
+
+	hasAdministrator := func(rules [][]string) bool {
+		for _, subject := range subjects {
+			if rolePath(rules, subject, administratorRole) != nil {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return hasAdministrator(api.enforcer.GetGroupingPolicy()) && !hasAdministrator(remaining), nil
+}
+
+// ruleChange describes a batch of policy or grouping rules that are added to, or removed from, the enforcer.
+type ruleChange struct {
+	add      bool
+	grouping bool
+	rules    [][]string
+}
+
+func (c ruleChange) apply(enforcer *casbin.Enforcer) (err error) {
+	var ok bool
+
+	switch {
+	case len(c.rules) == 0:
+		return nil
+	case c.add && c.grouping:
+		ok, err = enforcer.AddGroupingPolicies(c.rules)
+	case c.add:
+		ok, err = enforcer.AddPolicies(c.rules)
+	case c.grouping:
+		ok, err = enforcer.RemoveGroupingPolicies(c.rules)
+	default:
+		ok, err = enforcer.RemovePolicies(c.rules)
+	}
+
+	if err == nil && !ok {
+		// batches are rejected as a whole when any rule was added or removed concurrently
+		err = fmt.Errorf("rules were modified concurrently")
+	}
+
+	return err
+}
+
+func (c ruleChange) revert() ruleChange {
+	c.add = !c.add
+	return c
+}
+
+// applyRuleChanges applies each batch of changes in order. Every batch is stored in a single transaction. When a
+// batch fails, those that were already applied are reverted so the role is left as it was. If reverting fails as
+// well, the changes that remain applied are included in the returned error.
+func (api *API) applyRuleChanges(changes []ruleChange) error {
+	for i, change := range changes {
+		err := change.apply(api.enforcer)
+		if err == nil {
+			continue
+		}
+
+		for j := i - 1; j >= 0; j-- {
+			if revertErr := changes[j].revert().apply(api.enforcer); revertErr != nil {
+				return fmt.Errorf("%w, and failed to revert %v: %v", err, changes[:j+1], revertErr)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (api *API) ListRoles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	roles := make([]Role, 0)
+	for _, name := range api.roleNames() {
+		if role := api.getRole(name); role != nil {
+			roles = append(roles, *role)
+		}
+	}
+
+	err := encoding.JSON.Encoder(w).Encode(roles)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+func (api *API) GetRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	role := api.getRole(mux.Vars(r)["role"])
+	if role == nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	err := encoding.JSON.Encoder(w).Encode(role)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// validateRole ensures the policies and inherited roles can be applied to the named role.
+func (api *API) validateRole(name string, req PutRoleRequest) error {
+	for _, policy := range req.Policies {
+		if policy.Object == "" || policy.Action == "" {
+			return fmt.Errorf("policies require an object and action")
+		}
+
+		if _, err := regexp.Compile(policy.Action); err != nil {
+			return fmt.Errorf("invalid action: %w", err)
+		}
+	}
+
+	for _, parent := range req.Roles {
+		switch {
+		case parent == name:
+			return fmt.Errorf("role cannot inherit from itself")
+		case strings.HasPrefix(parent, "/_"):
+			return fmt.Errorf("role cannot inherit from users or groups")
+		case api.getRole(parent) == nil:
+			return fmt.Errorf("role %s does not exist", parent)
+		}
+
+		// prevent cycles, which casbin does not detect
+		cycle, err := api.enforcer.GetRoleManager().HasLink(parent, name)
+		if err != nil {
+			return err
+		} else if cycle {
+			return fmt.Errorf("role %s already inherits from %s", parent, name)
+		}
+	}
+
+	return nil
+}
+
+// PutRole creates or replaces a custom role, setting its policies and the roles it inherits from. Existing
+// assignments are left in place.
+func (api *API) PutRole(w http.ResponseWriter, r *http.Request) {
+	req := PutRoleRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	name := mux.Vars(r)["role"]
+	if name == "" || managedRole(name) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err = api.validateRole(name, req); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	desiredPolicies := make(map[Policy]bool)
+	for _, policy := range req.Policies {
+		desiredPolicies[policy] = true
+	}
+
+	desiredRoles := make(map[string]bool)
+	for _, parent := range req.Roles {
+		desiredRoles[parent] = true
+	}
+
+	removedPolicies := make([][]string, 0)
+	for _, policy := range api.enforcer.GetFilteredPolicy(0, name) {
+		existing := Policy{Object: policy[1], Action: policy[2]}
+
+		if desiredPolicies[existing] {
+			delete(desiredPolicies, existing)
+		} else {
+			removedPolicies = append(removedPolicies, policy)
+		}
+	}
+
+	removedRoles := make([][]string, 0)
+	for _, grouping := range api.enforcer.GetFilteredGroupingPolicy(0, name) {
+		if desiredRoles[grouping[1]] {
+			delete(desiredRoles, grouping[1])
+		} else {
+			removedRoles = append(removedRoles, grouping)
+		}
+	}
+
+	lockout, err := api.removesLastAdministrator(ctx, removedRoles)
+	if err != nil {
+		log.Error("failed to check for administrators", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if lockout {
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	addedPolicies := make([][]string, 0, len(desiredPolicies))
+	for policy := range desiredPolicies {
+		addedPolicies = append(addedPolicies, []string{name, policy.Object, policy.Action})
+	}
+
+	addedRoles := make([][]string, 0, len(desiredRoles))
+	for parent := range desiredRoles {
+		addedRoles = append(addedRoles, []string{name, parent})
+	}
+
+	// rules are added before they're removed so members never briefly lose access they're meant to keep
+	err = api.applyRuleChanges([]ruleChange{
+		{add: true, rules: addedPolicies},
+		{add: true, grouping: true, rules: addedRoles},
+		{rules: removedPolicies},
+		{grouping: true, rules: removedRoles},
+	})
+
+	if err != nil {
+		log.Error("failed to update role", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// DeleteRole removes a custom role along with its policies, the roles it inherits from, and its assignments.
+func (api *API) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	name := mux.Vars(r)["role"]
+	if managedRole(name) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	role := api.getRole(name)
+	if role == nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	removed := make([][]string, 0, len(role.Roles)+len(role.Members))
+	for _, parent := range role.Roles {
+		removed = append(removed, []string{name, parent})
+	}
+
+	for _, member := range role.Members {
+		removed = append(removed, []string{member, name})
+	}
+
+	lockout, err := api.removesLastAdministrator(ctx, removed)
+	if err != nil {
+		log.Error("failed to check for administrators", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if lockout {
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	policies := make([][]string, 0, len(role.Policies))
+	for _, policy := range role.Policies {
+		policies = append(policies, []string{name, policy.Object, policy.Action})
+	}
+
+	err = api.applyRuleChanges([]ruleChange{
+		{grouping: true, rules: removed},
+		{rules: policies},
+	})
+
+	if err != nil {
+		log.Error("failed to delete role", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// the assignments are gone, so a failure here only leaves behind expirations that no longer apply
+	for _, member := range role.Members {
+		if err = api.grants.Delete(ctx, name, member); err != nil {
+			log.Error("failed to remove grant expiration", zap.String("member", member), zap.Error(err))
+		}
+	}
+}
+
+// AssignRole assigns any existing role, including those managed by varys, to a user or group.
+func (api *API) AssignRole(w http.ResponseWriter, r *http.Request) {
+	req := RoleAssignment{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	name := mux.Vars(r)["role"]
+	switch {
+	case !req.valid():
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	case api.getRole(name) == nil:
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	annotateAudit(ctx, AuditGrant{Subject: req.subject(), Roles: []string{name}})
+
+	err = api.grant(ctx, req.subject(), []string{name}, nil)
+	if err != nil {
+		log.Error("failed to assign role", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// UnassignRole removes a role from a user or group. Removing the administrator role from the last administrator is
+// rejected.
+func (api *API) UnassignRole(w http.ResponseWriter, r *http.Request) {
+	req := RoleAssignment{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	name := mux.Vars(r)["role"]
+	if !req.valid() {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	subject := req.subject()
+	annotateAudit(ctx, AuditGrant{Subject: subject, Roles: []string{name}})
+
+	lockout, err := api.removesLastAdministrator(ctx, [][]string{{subject, name}})
+	if err != nil {
+		log.Error("failed to check for administrators", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if lockout {
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	err = api.revoke(ctx, subject, name)
+	if err != nil {
+		log.Error("failed to unassign role", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	call := func(handler http.HandlerFunc, method, role string, body interface{}) int {
+		buffer := bytes.NewBuffer(nil)
+		if body != nil {
+			require.NoError(t, encoding.JSON.Encoder(buffer).Encode(body))
+		}
+
+		r := httptest.NewRequest(method, "/api/v1/roles/"+role, buffer)
+		r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"role": role})
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		return w.Code
+	}
+
+	auditor := User{Kind: "basic", ID: "auditor", Name: "auditor"}
+	require.NoError(t, api.users.Put(ctx, auditor.Kind, auditor.ID, auditor))
+
+	{ // roles managed by varys cannot be modified
+		require.Equal(t, http.StatusBadRequest, call(api.PutRole, http.MethodPut, "admin:varys", PutRoleRequest{}))
+		require.Equal(t, http.StatusBadRequest, call(api.DeleteRole, http.MethodDelete, "read:varys", nil))
+	}
+
+	{ // invalid policies and inheritance are rejected
+		require.Equal(t, http.StatusBadRequest, call(api.PutRole, http.MethodPut, "auditors", PutRoleRequest{
+			Policies: []Policy{{Object: "/api/v1/audit", Action: "(GET"}},
+		}))
+
+		require.Equal(t, http.StatusBadRequest, call(api.PutRole, http.MethodPut, "auditors", PutRoleRequest{
+			Roles: []string{"missing"},
+		}))
+	}
+
+	{ // custom roles can be created, inherited, and assigned
+		require.Equal(t, http.StatusOK, call(api.PutRole, http.MethodPut, "auditors", PutRoleRequest{
+			Policies: []Policy{{Object: "/api/v1/audit", Action: "GET"}},
+			Roles:    []string{"read:varys"},
+		}))
+
+		require.Equal(t, http.StatusOK, call(api.AssignRole, http.MethodPut, "auditors", RoleAssignment{User: auditor}))
+
+		allowed, err := api.enforce(&auditor, "/api/v1/audit", http.MethodGet)
+		require.NoError(t, err)
+		require.True(t, allowed)
+
+		allowed, err = api.enforce(&auditor, "/api/v1/users", http.MethodGet)
+		require.NoError(t, err)
+		require.True(t, allowed)
+
+		require.Equal(t, http.StatusOK, call(api.PutRole, http.MethodPut, "compliance", PutRoleRequest{
+			Roles: []string{"auditors"},
+		}))
+
+		// cycles are rejected
+		require.Equal(t, http.StatusBadRequest, call(api.PutRole, http.MethodPut, "auditors", PutRoleRequest{
+			Roles: []string{"compliance"},
+		}))
+	}
+
+	{ // replacing a role removes policies and inheritance that are no longer listed
+		require.Equal(t, http.StatusOK, call(api.PutRole, http.MethodPut, "auditors", PutRoleRequest{
+			Policies: []Policy{{Object: "/api/v1/audit", Action: "GET"}},
+		}))
+
+		role := api.getRole("auditors")
+		require.NotNil(t, role)
+		require.False(t, role.Managed)
+		require.Equal(t, []Policy{{Object: "/api/v1/audit", Action: "GET"}}, role.Policies)
+		require.Empty(t, role.Roles)
+		require.ElementsMatch(t, []string{auditor.K(), "compliance"}, role.Members)
+
+		allowed, err := api.enforce(&auditor, "/api/v1/users", http.MethodGet)
+		require.NoError(t, err)
+		require.False(t, allowed)
+	}
+
+	{ // assignments must identify a user or group
+		require.Equal(t, http.StatusBadRequest, call(api.AssignRole, http.MethodPut, "auditors", RoleAssignment{}))
+		require.Equal(t, http.StatusBadRequest, call(api.UnassignRole, http.MethodDelete, "auditors", RoleAssignment{}))
+
+		ok, err := api.enforcer.HasRoleForUser(User{}.K(), "auditors")
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+
+	{ // deleting a role removes its assignments
+		require.Equal(t, http.StatusOK, call(api.DeleteRole, http.MethodDelete, "auditors", nil))
+		require.Equal(t, http.StatusNotFound, call(api.GetRole, http.MethodGet, "auditors", nil))
+
+		allowed, err := api.enforce(&auditor, "/api/v1/audit", http.MethodGet)
+		require.NoError(t, err)
+		require.False(t, allowed)
+	}
+}
+
+func TestRolesPreventAdministratorLockout(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	admin := User{Kind: "basic", ID: "admin", Name: "admin"}
+	member := User{Kind: "oidc", ID: "member", Name: "member", Groups: []string{"platform"}}
+
+	require.NoError(t, api.users.Put(ctx, admin.Kind, admin.ID, admin))
+	require.NoError(t, api.grant(ctx, admin.K(), []string{"superusers"}, nil))
+	_, err := api.enforcer.AddRoleForUser("superusers", administratorRole)
+	require.NoError(t, err)
+
+	lockout, err := api.removesLastAdministrator(ctx, [][]string{{admin.K(), "superusers"}})
+	require.NoError(t, err)
+	require.True(t, lockout)
+
+	lockout, err = api.removesLastAdministrator(ctx, [][]string{{"superusers", administratorRole}})
+	require.NoError(t, err)
+	require.True(t, lockout)
+
+	// administrators reached through a group count once the user has logged in
+	require.NoError(t, api.grant(ctx, Group{Name: "platform"}.K(), []string{administratorRole}, nil))
+
+	lockout, err = api.removesLastAdministrator(ctx, [][]string{{admin.K(), "superusers"}})
+	require.NoError(t, err)
+	require.True(t, lockout)
+
+	require.NoError(t, api.users.Put(ctx, member.Kind, member.ID, member))
+
+	lockout, err = api.removesLastAdministrator(ctx, [][]string{{admin.K(), "superusers"}})
+	require.NoError(t, err)
+	require.False(t, lockout)
+
+	lockout, err = api.removesLastAdministrator(ctx, [][]string{
+		{admin.K(), "superusers"},
+		{Group{Name: "platform"}.K(), administratorRole},
+	})
+	require.NoError(t, err)
+	require.True(t, lockout)
+
+	{ // handlers reject the change
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(RoleAssignment{Group: "platform"}))
+
+		r := httptest.NewRequest(http.MethodDelete, "/api/v1/roles/admin:varys/assignments", body)
+		r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"role": administratorRole})
+
+		require.NoError(t, api.revoke(ctx, admin.K(), "superusers"))
+
+		w := httptest.NewRecorder()
+		api.UnassignRole(w, r)
+		require.Equal(t, http.StatusConflict, w.Code)
+	}
+}
+
+func TestApplyRuleChangesReverts(t *testing.T) {
+	api := newTestAPI(t)
+
+	_, err := api.enforcer.AddPolicy("auditors", "/api/v1/audit", "GET")
+	require.NoError(t, err)
+
+	err = api.applyRuleChanges([]ruleChange{
+		{add: true, rules: [][]string{{"auditors", "/api/v1/users", "GET"}}},
+		{rules: [][]string{{"auditors", "/api/v1/audit", "GET"}}},
+		// removing a rule that doesn't exist fails the batch
+		{grouping: true, rules: [][]string{{"auditors", "read:varys"}}},
+	})
+	require.Error(t, err)
+
+	role := api.getRole("auditors")
+	require.NotNil(t, role)
+	require.Equal(t, []Policy{{Object: "/api/v1/audit", Action: "GET"}}, role.Policies)
+}
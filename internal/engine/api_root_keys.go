@@ -0,0 +1,255 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// activeRootKeyVersion returns the version of the root key that newly created services derive credentials from.
+func (api *API) activeRootKeyVersion(ctx context.Context) (string, error) {
+	version := ""
+
+	err := api.settings.Get(ctx, "root_key", "active", &version)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		return DefaultRootKeyVersion, nil
+	case err != nil:
+		return "", err
+	}
+
+	return version, nil
+}
+
+// CheckRootKeys ensures the active root key version, and the version used by every service, is present in the key
+// ring. Removing a version from the key ring while services still reference it would prevent their credentials from
+// being derived.
+func (api *API) CheckRootKeys(ctx context.Context) error {
+	active, err := api.activeRootKeyVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err = api.keys.Get(active); err != nil {
+		return fmt.Errorf("active %w", err)
+	}
+
+	services, err := api.services.List(ctx, Service{})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		service := s.(*Service)
+
+		if _, err = api.keys.Get(service.RootKeyVersion); err != nil {
+			return fmt.Errorf("service %s/%s uses %w", service.Kind, service.Name, err)
+		}
+
+		// credentials derived from the previous version are still handed out during the grace period
+		if service.PreviousRootKeyVersion != "" && service.PreviousKeyExpiresAt != nil &&
+			time.Now().Before(*service.PreviousKeyExpiresAt) {
+			if _, err = api.keys.Get(service.PreviousRootKeyVersion); err != nil {
+				return fmt.Errorf("service %s/%s previously used %w", service.Kind, service.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RootKeyVersion describes a version of the root key. The key itself is never returned.
+type RootKeyVersion struct {
+	Version  string `json:"version"`
+	Active   bool   `json:"active"`
+	Services int    `json:"services"`
+}
+
+// ListRootKeys returns the versions in the key ring, which one is active, and how many services derive from each.
+// Versions no longer used by any services may be retired by removing them from the key ring.
+func (api *API) ListRootKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	active, err := api.activeRootKeyVersion(ctx)
+	if err != nil {
+		log.Error("failed to get active root key version", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	services, err := api.services.List(ctx, Service{})
+	if err != nil {
+		log.Error("failed to list services", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, s := range services {
+		service := s.(*Service)
+
+		version := service.RootKeyVersion
+		if version == "" {
+			version = DefaultRootKeyVersion
+		}
+
+		counts[version]++
+	}
+
+	versions := make([]RootKeyVersion, 0, len(api.keys))
+	for _, version := range api.keys.Versions() {
+		versions = append(versions, RootKeyVersion{
+			Version:  version,
+			Active:   version == active,
+			Services: counts[version],
+		})
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(versions)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type UpdateActiveRootKeyRequest struct {
+	Version string `json:"version"`
+}
+
+// UpdateActiveRootKey changes which version of the root key newly created services derive credentials from. Existing
+// services continue to use the version they were created with until they're migrated.
+func (api *API) UpdateActiveRootKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	req := UpdateActiveRootKeyRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if _, err = api.keys.Get(req.Version); err != nil || req.Version == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err = api.settings.Put(ctx, "root_key", "active", req.Version)
+	if err != nil {
+		log.Error("failed to update active root key version", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type MigrateServicesRequest struct {
+	// Kind limits the migration to services of the given kind.
+	Kind string `json:"kind" usage:"only migrate services of the provided kind"`
+	// From limits the migration to services using the given root key version.
+	From string `json:"from" usage:"only migrate services using the provided root key version"`
+	// Immediate invalidates credentials derived from the previous root key version right away instead of after the
+	// grace period.
+	Immediate bool `json:"immediate" usage:"set to invalidate credentials derived from the previous root key version right away"`
+}
+
+// MigrateServices re-points services to derive credentials from the root key version in the path. Credentials derived
+// from the previous version remain valid for the rotation grace period. Services may also be migrated one at a time by
+// setting their root_key_version.
+func (api *API) MigrateServices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	req := MigrateServicesRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	version := mux.Vars(r)["version"]
+	if _, err = api.keys.Get(version); err != nil || version == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	services, err := api.services.List(ctx, Service{})
+	if err != nil {
+		log.Error("failed to list services", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	migrated := make([]Service, 0)
+
+	func() {
+		txn := &Txn{api.db.NewTransaction(true)}
+		defer txn.CommitOrDiscard(&err)
+
+		ctx := withTxn(ctx, txn)
+
+		for _, s := range services {
+			service := s.(*Service)
+
+			current := service.RootKeyVersion
+			if current == "" {
+				current = DefaultRootKeyVersion
+			}
+
+			switch {
+			case current == version:
+				continue
+			case req.Kind != "" && req.Kind != service.Kind:
+				continue
+			case req.From != "" && req.From != current:
+				continue
+			}
+
+			api.migrateRootKey(service, version, now, req.Immediate)
+
+			err = api.services.Put(ctx, service.Kind, service.Name, service)
+			if err != nil {
+				return
+			}
+
+			migrated = append(migrated, *service)
+		}
+	}()
+
+	if err != nil {
+		log.Error("failed to migrate services", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(migrated)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -17,11 +17,13 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"go.uber.org/zap"
@@ -34,8 +36,6 @@ func (api *API) ListGrants(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := zaputil.Extract(ctx)
 
-	var err error
-
 	service, code := api.getService(r)
 	if code > 0 {
 		http.Error(w, "", code)
@@ -43,53 +43,108 @@ func (api *API) ListGrants(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := ListGrantsResponse{}
-	userKeys := make(map[string]int)
+	roles := make([]string, 0)
 
 	for _, perm := range PermissionValues {
-		roles := []string{
-			fmt.Sprintf("%s:%s:%s", perm, service.Kind, service.Name),
-			fmt.Sprintf("%s:%s", perm, service.Kind),
-		}
-		resp.Roles = append(resp.Roles, roles[0])
+		serviceRole := fmt.Sprintf("%s:%s:%s", perm, service.Kind, service.Name)
 
-		for _, role := range roles {
-			users, err := api.getUsersForRole(role)
-			if err != nil {
-				log.Error("failed to get users for role", zap.Error(err))
-				http.Error(w, "", http.StatusInternalServerError)
-				return
-			}
+		resp.Roles = append(resp.Roles, serviceRole)
+		roles = append(roles, serviceRole, fmt.Sprintf("%s:%s", perm, service.Kind))
+	}
 
-			for _, user := range users {
-				_, ok := userKeys[user]
-				if !ok {
-					userKeys[user] = len(resp.Grants)
-					resp.Grants = append(resp.Grants, UserGrant{})
-				}
+	var err error
 
-				resp.Grants[userKeys[user]].Roles = append(resp.Grants[userKeys[user]].Roles, role)
-			}
-		}
+	resp.Grants, err = api.listGrants(ctx, roles)
+	if err != nil {
+		log.Error("failed to list grants", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(resp)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
 	}
+}
 
+// listGrants returns the users and groups that have been granted the provided roles. Grants are grouped by the user
+// or group and when they expire.
+func (api *API) listGrants(ctx context.Context, roles []string) (grants []UserGrant, err error) {
 	txn := &Txn{api.db.NewTransaction(false)}
 	defer txn.CommitOrDiscard(&err)
 
 	ctx = withTxn(ctx, txn)
 
+	grants = make([]UserGrant, 0)
+	userKeys := make(map[string]int)
+	users := make(map[string]string)
+
+	// appendGrant adds the role to the grant with the same key and expiration, returning the key the grant was stored
+	// under. Groups are keyed by their subject, so they never collide with users.
+	appendGrant := func(key string, grant UserGrant, role string) string {
+		if grant.ExpiresAt != nil {
+			key += "@" + grant.ExpiresAt.Format(time.RFC3339Nano)
+		}
+
+		_, ok := userKeys[key]
+		if !ok {
+			userKeys[key] = len(grants)
+			grants = append(grants, grant)
+		}
+
+		grants[userKeys[key]].Roles = append(grants[userKeys[key]].Roles, role)
+		return key
+	}
+
+	for _, role := range roles {
+		roleUsers, err := api.getUsersForRole(role)
+		if err != nil {
+			return nil, err
+		}
+
+		roleGroups, err := api.getGroupsForRole(role)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range roleUsers {
+			expiresAt, err := api.getGrantExpiration(ctx, "/_user/"+user, role)
+			if err != nil {
+				return nil, err
+			}
+
+			users[appendGrant(user, UserGrant{ExpiresAt: expiresAt}, role)] = user
+		}
+
+		for _, group := range roleGroups {
+			key := Group{Name: group}.K()
+
+			expiresAt, err := api.getGrantExpiration(ctx, key, role)
+			if err != nil {
+				return nil, err
+			}
+
+			appendGrant(key, UserGrant{Group: group, ExpiresAt: expiresAt}, role)
+		}
+	}
+
 	prune := make([]int, 0)
 	for key, idx := range userKeys {
-		parts := strings.Split(key, "/")
+		user, ok := users[key]
+		if !ok {
+			continue
+		}
+
+		parts := strings.Split(user, "/")
 
-		err := api.users.Get(ctx, parts[0], parts[1], &resp.Grants[idx].User)
+		err := api.users.Get(ctx, parts[0], parts[1], &grants[idx].User)
 		switch {
 		case errors.Is(err, badger.ErrKeyNotFound):
 			prune = append(prune, idx)
 			continue
 		case err != nil:
-			log.Error("failed to get user for key", zap.Error(err))
-			http.Error(w, "", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 	}
 
@@ -99,19 +154,55 @@ func (api *API) ListGrants(w http.ResponseWriter, r *http.Request) {
 	for i := 0; i < p; i++ {
 		idx := prune[p-i-1]
 
-		resp.Grants = append(resp.Grants[:idx], append([]UserGrant{}, resp.Grants[idx+1:]...)...)
+		grants = append(grants[:idx], append([]UserGrant{}, grants[idx+1:]...)...)
 	}
 
-	err = encoding.JSON.Encoder(w).Encode(resp)
-	if err != nil {
-		log.Error("failed to marshal json", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
-	}
+	return grants, nil
 }
 
 type UserGrant struct {
-	User  User     `json:"user"`
+	User User `json:"user"`
+	// Group, when set, grants the roles to every user the identity provider reports as a member of the group instead
+	// of an individual user.
+	Group string   `json:"group,omitempty"`
 	Roles []string `json:"roles"`
+	// ExpiresAt specifies when the roles are removed from the user. When empty, the roles do not expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Duration may be provided in place of ExpiresAt when granting roles (e.g. 2h).
+	Duration string `json:"duration,omitempty"`
+}
+
+// subject returns the key of the user or group the roles are granted to.
+func (g UserGrant) subject() string {
+	if g.Group != "" {
+		return Group{Name: g.Group}.K()
+	}
+
+	return g.User.K()
+}
+
+// expiration returns when the grant expires, or nil if it does not.
+func (g UserGrant) expiration(now time.Time) (*time.Time, error) {
+	switch {
+	case g.Duration != "":
+		duration, err := time.ParseDuration(g.Duration)
+		if err != nil {
+			return nil, err
+		} else if duration <= 0 {
+			return nil, fmt.Errorf("duration must be positive")
+		}
+
+		expiresAt := now.Add(duration)
+		return &expiresAt, nil
+	case g.ExpiresAt != nil:
+		if !g.ExpiresAt.After(now) {
+			return nil, fmt.Errorf("expiration must be in the future")
+		}
+
+		return g.ExpiresAt, nil
+	}
+
+	return nil, nil
 }
 
 type ListGrantsResponse struct {
@@ -120,29 +211,55 @@ type ListGrantsResponse struct {
 }
 
 func (api *API) PutGrant(w http.ResponseWriter, r *http.Request) {
-	req := UserGrant{}
-	err := encoding.JSON.Decoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
 		return
 	}
 
-	ctx := r.Context()
-	log := zaputil.Extract(ctx)
+	api.putGrant(w, r, fmt.Sprintf("%s:%s", service.Kind, service.Name))
+}
 
+func (api *API) DeleteGrant(w http.ResponseWriter, r *http.Request) {
 	service, code := api.getService(r)
 	if code > 0 {
 		http.Error(w, "", code)
 		return
 	}
 
-	suffix := fmt.Sprintf("%s:%s", service.Kind, service.Name)
+	api.deleteGrant(w, r, fmt.Sprintf("%s:%s", service.Kind, service.Name))
+}
 
+// assignableRoles returns the set of roles that can be granted for the suffix, one for each permission.
+func assignableRoles(suffix string) map[string]bool {
 	roles := make(map[string]bool)
 	for _, perm := range PermissionValues {
 		roles[perm.String()+":"+suffix] = true
 	}
 
+	return roles
+}
+
+// putGrant grants the roles in the request body that are assignable for the suffix. Other roles are ignored.
+func (api *API) putGrant(w http.ResponseWriter, r *http.Request, suffix string) {
+	req := UserGrant{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := req.expiration(time.Now())
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	roles := assignableRoles(suffix)
+
 	added := make([]string, 0)
 	for _, role := range req.Roles {
 		if roles[role] {
@@ -150,17 +267,18 @@ func (api *API) PutGrant(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	userKey := req.User.K()
+	annotateAudit(ctx, AuditGrant{Subject: req.subject(), Roles: added, ExpiresAt: expiresAt})
 
-	_, err = api.enforcer.AddRolesForUser(userKey, added)
+	err = api.grant(ctx, req.subject(), added, expiresAt)
 	if err != nil {
-		log.Error("failed to add roles for user", zap.Error(err))
+		log.Error("failed to add roles for subject", zap.Error(err))
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 }
 
-func (api *API) DeleteGrant(w http.ResponseWriter, r *http.Request) {
+// deleteGrant revokes the roles in the request body that are assignable for the suffix. Other roles are ignored.
+func (api *API) deleteGrant(w http.ResponseWriter, r *http.Request, suffix string) {
 	req := UserGrant{}
 	err := encoding.JSON.Decoder(r.Body).Decode(&req)
 	if err != nil {
@@ -171,29 +289,24 @@ func (api *API) DeleteGrant(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := zaputil.Extract(ctx)
 
-	service, code := api.getService(r)
-	if code > 0 {
-		http.Error(w, "", code)
-		return
-	}
-
-	userKey := req.User.K()
-
-	suffix := fmt.Sprintf("%s:%s", service.Kind, service.Name)
-
-	roles := make(map[string]bool)
-	for _, perm := range PermissionValues {
-		roles[perm.String()+":"+suffix] = true
-	}
+	subject := req.subject()
+	roles := assignableRoles(suffix)
 
+	removed := make([]string, 0)
 	for _, role := range req.Roles {
 		if roles[role] {
-			_, err := api.enforcer.DeleteRoleForUser(userKey, role)
-			if err != nil {
-				log.Error("failed to delete role for user", zap.Error(err))
-				http.Error(w, "", http.StatusInternalServerError)
-				return
-			}
+			removed = append(removed, role)
+		}
+	}
+
+	annotateAudit(ctx, AuditGrant{Subject: subject, Roles: removed})
+
+	for _, role := range removed {
+		err := api.revoke(ctx, subject, role)
+		if err != nil {
+			log.Error("failed to delete role for subject", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
 		}
 	}
 }
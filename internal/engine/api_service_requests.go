@@ -0,0 +1,327 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+func requestKey(service *Service) string {
+	return service.Kind + "/" + service.Name
+}
+
+func newRequestID() (string, error) {
+	id := make([]byte, 10)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(base32enc.EncodeToString(id)), nil
+}
+
+func (api *API) ListAccessRequests(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	all, err := api.requests.List(ctx, AccessRequest{})
+	if err != nil {
+		log.Error("failed to list access requests", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	requests := make([]*AccessRequest, 0)
+	for _, req := range all {
+		req := req.(*AccessRequest)
+
+		if req.Kind == service.Kind && req.Name == service.Name {
+			requests = append(requests, req)
+		}
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.Before(requests[j].CreatedAt)
+	})
+
+	err = encoding.JSON.Encoder(w).Encode(requests)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type CreateAccessRequestRequest struct {
+	Permissions   []Permission `json:"permissions"`
+	Duration      string       `json:"duration"`
+	Justification string       `json:"justification"`
+}
+
+func (api *API) CreateAccessRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+	user := extractUser(ctx)
+
+	req := CreateAccessRequestRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 || len(req.Permissions) == 0 || strings.TrimSpace(req.Justification) == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	// system access hands out the credentials of every user and is only granted by administrators
+	for _, perm := range req.Permissions {
+		if perm.String() == "" || perm == SystemPermission {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	id, err := newRequestID()
+	if err != nil {
+		log.Error("failed to generate request id", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	accessRequest := AccessRequest{
+		ID:   id,
+		Kind: service.Kind,
+		Name: service.Name,
+		User: User{
+			Kind: user.Kind,
+			ID:   user.ID,
+			Name: user.Name,
+		},
+		Permissions:   req.Permissions,
+		Duration:      duration.String(),
+		Justification: req.Justification,
+		Status:        PendingAccessRequest,
+		CreatedAt:     time.Now(),
+	}
+
+	err = api.requests.Put(ctx, requestKey(service), id, accessRequest)
+	if err != nil {
+		log.Error("failed to create access request", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(accessRequest)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+func (api *API) getAccessRequest(r *http.Request) (*Service, *AccessRequest, int) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	service, code := api.getService(r)
+	if code > 0 {
+		return nil, nil, code
+	}
+
+	accessRequest := &AccessRequest{}
+
+	err := api.requests.Get(ctx, requestKey(service), mux.Vars(r)["id"], accessRequest)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		return nil, nil, http.StatusNotFound
+	case err != nil:
+		log.Error("failed to get access request", zap.Error(err))
+		return nil, nil, http.StatusInternalServerError
+	}
+
+	return service, accessRequest, 0
+}
+
+func (api *API) GetAccessRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	_, accessRequest, code := api.getAccessRequest(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	err := encoding.JSON.Encoder(w).Encode(accessRequest)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type UpdateAccessRequestRequest struct {
+	Status AccessRequestStatus `json:"status"`
+}
+
+// UpdateAccessRequest approves or denies a pending access request. Approving a request grants the requested
+// permissions for the requested duration, starting from the time of approval. Users may not review their own
+// requests.
+func (api *API) UpdateAccessRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	req := UpdateAccessRequestRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil || (req.Status != ApprovedAccessRequest && req.Status != DeniedAccessRequest) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	accessRequest, code := api.reviewAccessRequest(r, service, req.Status, time.Now())
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	if accessRequest.Status == ApprovedAccessRequest {
+		roles := make([]string, 0, len(accessRequest.Permissions))
+		for _, perm := range accessRequest.Permissions {
+			roles = append(roles, perm.String()+":"+service.Kind+":"+service.Name)
+		}
+
+		err = api.grant(ctx, accessRequest.User.K(), roles, accessRequest.ExpiresAt)
+		if err != nil {
+			log.Error("failed to grant access request", zap.Error(err))
+
+			// return the request to pending so that it can be reviewed again
+			accessRequest.Status = PendingAccessRequest
+			accessRequest.ReviewedAt = nil
+			accessRequest.Reviewer = nil
+			accessRequest.ExpiresAt = nil
+
+			err = api.requests.Put(ctx, requestKey(service), accessRequest.ID, accessRequest)
+			if err != nil {
+				log.Error("failed to reset access request", zap.Error(err))
+			}
+
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(accessRequest)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// reviewAccessRequest records the review of a pending access request. The request is read, checked, and updated
+// within a single transaction so that concurrent reviews cannot both succeed.
+func (api *API) reviewAccessRequest(r *http.Request, service *Service, status AccessRequestStatus, now time.Time) (
+	accessRequest *AccessRequest, code int,
+) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+	user := extractUser(ctx)
+
+	var err error
+
+	txn := &Txn{api.db.NewTransaction(true)}
+	defer func() {
+		txn.CommitOrDiscard(&err)
+
+		switch {
+		case code > 0:
+			// the transaction was discarded and the status has already been determined
+		case errors.Is(err, badger.ErrConflict):
+			accessRequest, code = nil, http.StatusConflict
+		case err != nil:
+			log.Error("failed to update access request", zap.Error(err))
+			accessRequest, code = nil, http.StatusInternalServerError
+		}
+	}()
+
+	ctx = withTxn(ctx, txn)
+	accessRequest = &AccessRequest{}
+
+	err = api.requests.Get(ctx, requestKey(service), mux.Vars(r)["id"], accessRequest)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		return nil, http.StatusNotFound
+	case err != nil:
+		log.Error("failed to get access request", zap.Error(err))
+		return nil, http.StatusInternalServerError
+	case accessRequest.Status != PendingAccessRequest:
+		return nil, http.StatusConflict
+	case accessRequest.User.K() == user.K():
+		return nil, http.StatusForbidden
+	}
+
+	accessRequest.Status = status
+	accessRequest.ReviewedAt = &now
+	accessRequest.Reviewer = &User{
+		Kind: user.Kind,
+		ID:   user.ID,
+		Name: user.Name,
+	}
+
+	if status == ApprovedAccessRequest {
+		accessRequest.ExpiresAt, err = UserGrant{Duration: accessRequest.Duration}.expiration(now)
+		if err != nil {
+			log.Error("invalid access request duration", zap.Error(err))
+			return nil, http.StatusInternalServerError
+		}
+	}
+
+	err = api.requests.Put(ctx, requestKey(service), accessRequest.ID, accessRequest)
+	if err != nil {
+		return nil, 0
+	}
+
+	return accessRequest, 0
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func newAccessRequestRequest(t *testing.T, ctx context.Context, method, path string, vars map[string]string, body interface{}) *http.Request {
+	data := bytes.NewBuffer(nil)
+	require.NoError(t, encoding.JSON.Encoder(data).Encode(body))
+
+	r := httptest.NewRequest(method, path, data).WithContext(ctx)
+	return mux.SetURLVars(r, vars)
+}
+
+func TestAccessRequests(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	requester := User{Kind: "basic", ID: "requester", Name: "requester"}
+	approver := User{Kind: "basic", ID: "approver", Name: "approver"}
+	service := Service{Kind: "postgres", Name: "prod"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	policy, err := renderServicePolicy(policyTemplate{Service: service, Creator: approver})
+	require.NoError(t, err)
+	require.NoError(t, EnsurePolicy(api.enforcer, policy))
+
+	_, err = api.enforcer.AddRoleForUser(requester.K(), "read:varys")
+	require.NoError(t, err)
+
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	{ // anyone can request access, but only service admins can review requests
+		allowed, err := api.enforcer.Enforce(requester.K(), "/api/v1/services/postgres/prod/requests", http.MethodPost)
+		require.NoError(t, err)
+		require.True(t, allowed)
+
+		allowed, err = api.enforcer.Enforce(requester.K(), "/api/v1/services/postgres/prod/requests/abc", http.MethodPut)
+		require.NoError(t, err)
+		require.False(t, allowed)
+
+		allowed, err = api.enforcer.Enforce(approver.K(), "/api/v1/services/postgres/prod/requests/abc", http.MethodPut)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+
+	created := AccessRequest{}
+
+	{ // create
+		w := httptest.NewRecorder()
+		api.CreateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, requester), http.MethodPost,
+			"/api/v1/services/postgres/prod/requests", vars, CreateAccessRequestRequest{
+				Permissions:   []Permission{AdminPermission},
+				Duration:      "2h",
+				Justification: "incident",
+			}))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&created))
+		require.NotEmpty(t, created.ID)
+		require.Equal(t, PendingAccessRequest, created.Status)
+	}
+
+	vars["id"] = created.ID
+	approve := UpdateAccessRequestRequest{Status: ApprovedAccessRequest}
+
+	{ // requesters cannot approve their own requests
+		w := httptest.NewRecorder()
+		api.UpdateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, requester), http.MethodPut,
+			"/api/v1/services/postgres/prod/requests/"+created.ID, vars, approve))
+
+		require.Equal(t, http.StatusForbidden, w.Code)
+	}
+
+	{ // approve
+		w := httptest.NewRecorder()
+		api.UpdateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, approver), http.MethodPut,
+			"/api/v1/services/postgres/prod/requests/"+created.ID, vars, approve))
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		approved := AccessRequest{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&approved))
+		require.Equal(t, ApprovedAccessRequest, approved.Status)
+		require.Equal(t, approver.ID, approved.Reviewer.ID)
+		require.NotNil(t, approved.ExpiresAt)
+
+		ok, err := api.enforcer.HasRoleForUser(requester.K(), "admin:postgres:prod")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		expiresAt, err := api.getGrantExpiration(ctx, requester.K(), "admin:postgres:prod")
+		require.NoError(t, err)
+		require.NotNil(t, expiresAt)
+		require.WithinDuration(t, time.Now().Add(2*time.Hour), *expiresAt, time.Minute)
+	}
+
+	{ // requests can only be reviewed once
+		w := httptest.NewRecorder()
+		api.UpdateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, approver), http.MethodPut,
+			"/api/v1/services/postgres/prod/requests/"+created.ID, vars, UpdateAccessRequestRequest{
+				Status: DeniedAccessRequest,
+			}))
+
+		require.Equal(t, http.StatusConflict, w.Code)
+	}
+
+	{ // list
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/prod/requests", nil), vars)
+		w := httptest.NewRecorder()
+
+		api.ListAccessRequests(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		requests := make([]AccessRequest, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&requests))
+		require.Len(t, requests, 1)
+		require.Equal(t, created.ID, requests[0].ID)
+		require.Equal(t, ApprovedAccessRequest, requests[0].Status)
+	}
+}
+
+func TestAccessRequestReview(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	requester := User{Kind: "basic", ID: "requester", Name: "requester"}
+	approver := User{Kind: "basic", ID: "approver", Name: "approver"}
+	service := Service{Kind: "postgres", Name: "prod"}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.grant(ctx, requester.K(), []string{"read:postgres:prod"}, nil))
+
+	create := func(perms ...Permission) (AccessRequest, int) {
+		w := httptest.NewRecorder()
+		api.CreateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, requester), http.MethodPost,
+			"/api/v1/services/postgres/prod/requests", vars, CreateAccessRequestRequest{
+				Permissions:   perms,
+				Duration:      "1h",
+				Justification: "incident",
+			}))
+
+		created := AccessRequest{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&created))
+		}
+
+		return created, w.Code
+	}
+
+	{ // system access cannot be requested
+		_, code := create(SystemPermission)
+		require.Equal(t, http.StatusBadRequest, code)
+	}
+
+	created, code := create(ReadPermission)
+	require.Equal(t, http.StatusOK, code)
+
+	{ // concurrent reviews only succeed once
+		reviewVars := map[string]string{"kind": service.Kind, "name": service.Name, "id": created.ID}
+		codes := make(chan int, 10)
+
+		for i := 0; i < cap(codes); i++ {
+			status := ApprovedAccessRequest
+			if i%2 == 1 {
+				status = DeniedAccessRequest
+			}
+
+			go func(status AccessRequestStatus) {
+				w := httptest.NewRecorder()
+				api.UpdateAccessRequest(w, newAccessRequestRequest(t, withUser(ctx, approver), http.MethodPut,
+					"/api/v1/services/postgres/prod/requests/"+created.ID, reviewVars, UpdateAccessRequestRequest{
+						Status: status,
+					}))
+
+				codes <- w.Code
+			}(status)
+		}
+
+		succeeded := 0
+		for i := 0; i < cap(codes); i++ {
+			code := <-codes
+			if code == http.StatusOK {
+				succeeded++
+			} else {
+				require.Equal(t, http.StatusConflict, code)
+			}
+		}
+
+		require.Equal(t, 1, succeeded)
+	}
+
+	// approving a request for a permission that is already held does not remove it once the request expires
+	require.NoError(t, api.ReapExpiredGrants(ctx, time.Now().Add(2*time.Hour)))
+
+	ok, err := api.enforcer.HasRoleForUser(requester.K(), "read:postgres:prod")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
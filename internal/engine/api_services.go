@@ -17,9 +17,13 @@
 package engine
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
@@ -63,6 +67,8 @@ func (api *API) CreateService(w http.ResponseWriter, r *http.Request) {
 		Kind:    req.Kind,
 		Name:    req.Name,
 		Address: req.Address,
+		SSHKey:  req.SSHKey,
+		TOTP:    req.TOTP,
 		Key:     make([]byte, 32),
 		Templates: ServiceTemplates{
 			UserTemplate:     pass.Basic,
@@ -78,12 +84,34 @@ func (api *API) CreateService(w http.ResponseWriter, r *http.Request) {
 		service.Templates.PasswordTemplate = pass.TemplateClass(req.Templates.PasswordTemplate)
 	}
 
-	if service.Kind == "" || service.Name == "" || service.Address == "" ||
-		service.Templates.UserTemplate == "" || service.Templates.PasswordTemplate == "" {
+	if !validKind(service.Kind) || service.Name == "" || strings.Contains(service.Name, ":") ||
+		service.Address == "" || service.Templates.UserTemplate == "" || service.Templates.PasswordTemplate == "" {
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	if err = service.setRotationPeriod(req.RotationPeriod, time.Now()); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if !req.PasswordPolicy.IsZero() {
+		if err = req.PasswordPolicy.Validate(); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		service.PasswordPolicy = &req.PasswordPolicy
+	}
+
+	if req.SSHExtensions != "" {
+		service.SSHExtensions, err = parseSSHExtensions(req.SSHExtensions)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
 	policy, err := renderServicePolicy(policyTemplate{
 		Service: service,
 		Creator: *user,
@@ -101,6 +129,13 @@ func (api *API) CreateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	service.RootKeyVersion, err = api.activeRootKeyVersion(ctx)
+	if err != nil {
+		log.Error("failed to get active root key version", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
 	func() {
 		txn := &Txn{api.db.NewTransaction(true)}
 		defer txn.CommitOrDiscard(&err)
@@ -132,12 +167,40 @@ func (api *API) CreateService(w http.ResponseWriter, r *http.Request) {
 }
 
 type CreateServiceRequest struct {
-	Kind    string `json:"kind" hidden:"true"`
-	Name    string `json:"name" hidden:"true"`
-	Address string `json:"address" usage:"the address clients should connect to" required:"true"`
+	Kind           string         `json:"kind" hidden:"true"`
+	Name           string         `json:"name" hidden:"true"`
+	Address        string         `json:"address" usage:"the address clients should connect to" required:"true"`
+	RotationPeriod string         `json:"rotation_period" usage:"how frequently the service key is rotated automatically (e.g. 720h)"`
+	PasswordPolicy PasswordPolicy `json:"password_policy"`
+	SSHKey         bool           `json:"ssh_key" usage:"derive an ssh key pair for each user alongside their password"`
+	SSHExtensions  string         `json:"ssh_extensions" usage:"comma separated list of extensions granted to ssh certificates (defaults to permit-pty)"`
+	TOTP           bool           `json:"totp" usage:"derive a totp secret for each user for services that require a second factor"`
 	Templates
 }
 
+// EnsureServicePolicies adds any rules missing from the policy of each existing service. Services created by earlier
+// versions only received the rules that were present in the service policy at the time they were created.
+func (api *API) EnsureServicePolicies(ctx context.Context) error {
+	services, err := api.services.List(ctx, Service{})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		policy, err := renderServicePolicy(policyTemplate{Service: *s.(*Service)})
+		if err != nil {
+			return err
+		}
+
+		err = EnsurePolicy(api.enforcer, policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (api *API) getService(r *http.Request) (*Service, int) {
 	ctx := r.Context()
 	log := zaputil.Extract(ctx)
@@ -205,7 +268,7 @@ func (api *API) UpdateService(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if req.RotateKey {
-		if _, err = rand.Read(service.Key); err != nil {
+		if err = api.rotateServiceKey(service, time.Now(), req.Immediate); err != nil {
 			log.Error("failed to regenerate service key", zap.Error(err))
 			http.Error(w, "", http.StatusInternalServerError)
 			return
@@ -222,6 +285,56 @@ func (api *API) UpdateService(w http.ResponseWriter, r *http.Request) {
 
 	if req.Templates.PasswordTemplate != "" {
 		service.Templates.PasswordTemplate = pass.TemplateClass(req.Templates.PasswordTemplate)
+		service.PasswordPolicy = nil
+	}
+
+	if !req.PasswordPolicy.IsZero() {
+		if err = req.PasswordPolicy.Validate(); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		service.PasswordPolicy = &req.PasswordPolicy
+	}
+
+	if req.SSHKey != "" {
+		service.SSHKey, err = strconv.ParseBool(req.SSHKey)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.SSHExtensions != "" {
+		service.SSHExtensions, err = parseSSHExtensions(req.SSHExtensions)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.TOTP != "" {
+		service.TOTP, err = strconv.ParseBool(req.TOTP)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.RootKeyVersion != "" {
+		if _, err = api.keys.Get(req.RootKeyVersion); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		api.migrateRootKey(service, req.RootKeyVersion, time.Now(), req.Immediate)
+	}
+
+	if req.RotationPeriod != "" {
+		if err = service.setRotationPeriod(req.RotationPeriod, time.Now()); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
 	}
 
 	err = api.services.Put(ctx, service.Kind, service.Name, service)
@@ -232,8 +345,15 @@ func (api *API) UpdateService(w http.ResponseWriter, r *http.Request) {
 }
 
 type UpdateServiceRequest struct {
-	RotateKey bool   `json:"rotate_key" usage:"set to rotate the key used to derive passwords for this service"`
-	Address   string `json:"address" usage:"the new address clients should connect to"`
+	RotateKey      bool           `json:"rotate_key" usage:"set to rotate the key used to derive passwords for this service"`
+	Immediate      bool           `json:"immediate" usage:"set to invalidate the previous credentials right away instead of after the grace period"`
+	Address        string         `json:"address" usage:"the new address clients should connect to"`
+	RootKeyVersion string         `json:"root_key_version" usage:"the version of the root key credentials should be derived from"`
+	RotationPeriod string         `json:"rotation_period" usage:"how frequently the service key is rotated automatically (e.g. 720h), 0 disables automatic rotation"`
+	PasswordPolicy PasswordPolicy `json:"password_policy"`
+	SSHKey         string         `json:"ssh_key" usage:"set to true or false to control whether an ssh key pair is derived for each user"`
+	SSHExtensions  string         `json:"ssh_extensions" usage:"comma separated list of extensions granted to ssh certificates"`
+	TOTP           string         `json:"totp" usage:"set to true or false to control whether a totp secret is derived for each user"`
 	Templates
 }
 
@@ -241,24 +361,109 @@ func (api *API) DeleteService(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := zaputil.Extract(ctx)
 
-	vars := mux.Vars(r)
-
-	service := &Service{
-		Kind: vars["kind"],
-		Name: vars["name"],
-	}
-
-	if service.Kind == "" || service.Name == "" {
-		http.Error(w, "", http.StatusBadRequest)
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
 		return
 	}
 
-	err := api.services.Delete(ctx, service.Kind, service.Name)
-	switch {
-	case errors.Is(err, badger.ErrKeyNotFound):
-		http.Error(w, "", http.StatusNotFound)
-	case err != nil:
+	err := api.purgeService(ctx, service)
+	if err != nil {
 		log.Error("failed to delete service", zap.Error(err))
 		http.Error(w, "", http.StatusInternalServerError)
 	}
 }
+
+// serviceRoles returns all the roles that were created for the service when rendering the service policy.
+func serviceRoles(service *Service) []string {
+	suffix := service.Kind + ":" + service.Name
+
+	roles := []string{
+		"admin:varys:services:" + suffix,
+		"update:varys:services:" + suffix,
+		"delete:varys:services:" + suffix,
+	}
+
+	for _, perm := range PermissionValues {
+		roles = append(roles, perm.String()+":"+suffix)
+	}
+
+	return roles
+}
+
+// purgeService removes the service along with everything that references it. This includes the policies rendered
+// when the service was created, any grants to those roles, pending access requests, and the counters users have for
+// the service. Without this, recreating a service with the same name would silently restore access to old grantees.
+// Policies are removed first and the service is removed last, allowing the operation to be retried if it fails part
+// way through.
+func (api *API) purgeService(ctx context.Context, service *Service) (err error) {
+	roles := make(map[string]bool)
+
+	for _, role := range serviceRoles(service) {
+		roles[role] = true
+
+		// removes the role's permissions and anything that's been assigned the role (including grants to users)
+		_, err = api.enforcer.DeleteRole(role)
+		if err != nil {
+			return err
+		}
+	}
+
+	grants, err := api.grants.List(ctx, Grant{})
+	if err != nil {
+		return err
+	}
+
+	requests, err := api.requests.List(ctx, AccessRequest{})
+	if err != nil {
+		return err
+	}
+
+	users, err := api.users.List(ctx, User{})
+	if err != nil {
+		return err
+	}
+
+	txn := &Txn{api.db.NewTransaction(true)}
+	defer txn.CommitOrDiscard(&err)
+
+	ctx = withTxn(ctx, txn)
+
+	for _, g := range grants {
+		grant := g.(*Grant)
+
+		if roles[grant.Role] {
+			if err = api.grants.Delete(ctx, grant.Role, grant.User); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, req := range requests {
+		req := req.(*AccessRequest)
+
+		if req.Kind == service.Kind && req.Name == service.Name {
+			if err = api.requests.Delete(ctx, requestKey(service), req.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, u := range users {
+		user := u.(*User)
+
+		_, hasCounter := user.SiteCounters[service.K()]
+		_, hasPrevious := user.PreviousSiteCounters[service.K()]
+
+		if hasCounter || hasPrevious {
+			delete(user.SiteCounters, service.K())
+			delete(user.PreviousSiteCounters, service.K())
+
+			if err = api.users.Put(ctx, user.Kind, user.ID, user); err != nil {
+				return err
+			}
+		}
+	}
+
+	return api.services.Delete(ctx, service.Kind, service.Name)
+}
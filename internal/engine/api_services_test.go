@@ -0,0 +1,116 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestDeleteServicePurgesReferences(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	creator := User{Kind: "basic", ID: "creator", Name: "creator"}
+	grantee := User{Kind: "basic", ID: "grantee", Name: "grantee", SiteCounters: map[string]uint32{}}
+	service := &Service{Kind: "postgres", Name: "prod"}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	create := func() {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(CreateServiceRequest{
+			Kind:    service.Kind,
+			Name:    service.Name,
+			Address: "localhost:5432",
+		}))
+
+		w := httptest.NewRecorder()
+		api.CreateService(w, httptest.NewRequest(http.MethodPost, "/api/v1/services", body).
+			WithContext(withUser(ctx, creator)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	hasAccess := func() bool {
+		allowed, err := api.enforcer.Enforce(grantee.K(), service.K(), "read")
+		require.NoError(t, err)
+		return allowed
+	}
+
+	create()
+
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, api.grant(ctx, grantee.K(), []string{"read:postgres:prod"}, &expiresAt))
+	require.True(t, hasAccess())
+
+	grantee.SiteCounters[service.K()] = 3
+	grantee.SiteCounters["/_service/postgres/other"] = 1
+	require.NoError(t, api.users.Put(ctx, grantee.Kind, grantee.ID, grantee))
+
+	require.NoError(t, api.requests.Put(ctx, requestKey(service), "request", AccessRequest{
+		ID:   "request",
+		Kind: service.Kind,
+		Name: service.Name,
+	}))
+
+	{
+		w := httptest.NewRecorder()
+		api.DeleteService(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/api/v1/services/postgres/prod", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	require.False(t, hasAccess())
+
+	// ensure the rules were removed from the database and not just the in-memory model
+	require.NoError(t, api.enforcer.LoadPolicy())
+
+	for _, rule := range append(api.enforcer.GetPolicy(), api.enforcer.GetGroupingPolicy()...) {
+		require.NotContains(t, strings.Join(rule, ","), "postgres:prod", "rule should have been removed: %v", rule)
+	}
+
+	grants, err := api.grants.List(ctx, Grant{})
+	require.NoError(t, err)
+	require.Len(t, grants, 0)
+
+	requests, err := api.requests.List(ctx, AccessRequest{})
+	require.NoError(t, err)
+	require.Len(t, requests, 0)
+
+	user := User{}
+	require.NoError(t, api.users.Get(ctx, grantee.Kind, grantee.ID, &user))
+	require.Equal(t, map[string]uint32{"/_service/postgres/other": 1}, user.SiteCounters)
+
+	// recreating the service must not restore access to the old grantee
+	create()
+	require.False(t, hasAccess())
+
+	{
+		w := httptest.NewRecorder()
+		api.DeleteService(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/api/v1/services/postgres/missing", nil),
+			map[string]string{"kind": "postgres", "name": "missing"}))
+		require.Equal(t, http.StatusNotFound, w.Code)
+	}
+}
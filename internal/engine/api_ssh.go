@@ -0,0 +1,271 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// servicePermissions returns the permissions the user holds on the service.
+func (api *API) servicePermissions(user *User, service Service) ([]Permission, error) {
+	permissions := make([]Permission, 0)
+
+	for _, perm := range []Permission{ReadPermission, WritePermission, UpdatePermission, DeletePermission, AdminPermission} {
+		allowed, err := api.enforce(user, service.K(), perm.String())
+		if err != nil {
+			return nil, err
+		} else if allowed {
+			permissions = append(permissions, perm)
+		}
+	}
+
+	return permissions, nil
+}
+
+type SSHCertificateAuthority struct {
+	// PublicKey contains the public key of the certificate authority, formatted for use with the TrustedUserCAKeys
+	// option of sshd.
+	PublicKey string `json:"public_key"`
+	// PreviousPublicKey contains the public key of the certificate authority that was in use before the service key
+	// was last rotated. It's only set during the grace period, while certificates signed by it remain valid.
+	PreviousPublicKey          string     `json:"previous_public_key,omitempty"`
+	PreviousPublicKeyExpiresAt *time.Time `json:"previous_public_key_expires_at,omitempty"`
+}
+
+// sshCertificateAuthorityKey returns the public key of the services' SSH certificate authority.
+func (api *API) sshCertificateAuthorityKey(service Service) (string, error) {
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := deriveSSHCAKey(root, service)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalAuthorizedKey(key, "varys:"+service.Kind+":"+service.Name)
+}
+
+// GetSSHCertificateAuthority returns the public key of the services' SSH certificate authority so it can be trusted by
+// the target hosts. Rotating the service key also rotates the certificate authority, so the previous public key is
+// returned alongside it during the grace period, giving hosts time to trust the new one.
+func (api *API) GetSSHCertificateAuthority(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	publicKey, err := api.sshCertificateAuthorityKey(*service)
+	if err != nil {
+		log.Error("failed to derive certificate authority", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	ca := SSHCertificateAuthority{PublicKey: publicKey}
+
+	if previous, ok := previousService(*service, time.Now()); ok {
+		ca.PreviousPublicKey, err = api.sshCertificateAuthorityKey(previous)
+		if err != nil {
+			log.Error("failed to derive previous certificate authority", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		ca.PreviousPublicKeyExpiresAt = service.PreviousKeyExpiresAt
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(ca)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type SignSSHKeyRequest struct {
+	// PublicKey is the users' public key, formatted as an authorized_keys line.
+	PublicKey string `json:"public_key"`
+	// TTL optionally shortens how long the certificate is valid for. It cannot exceed the configured maximum.
+	TTL string `json:"ttl,omitempty"`
+}
+
+type SSHCertificate struct {
+	// Certificate contains the signed certificate, formatted as an authorized_keys line.
+	Certificate string       `json:"certificate"`
+	Principals  []Permission `json:"principals"`
+	ValidBefore time.Time    `json:"valid_before"`
+}
+
+// SignSSHKey issues a short-lived certificate for the users' public key, signed by the services' certificate
+// authority. The certificate's principals are the permissions the user holds on the service, allowing target hosts
+// to map them to local accounts using AuthorizedPrincipalsFile.
+func (api *API) SignSSHKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+	user := extractUser(ctx)
+
+	req := SignSSHKeyRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := publicKey.(*ssh.Certificate); ok {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ttl, ok := certificateTTL(api.SSHCertificateTTL, req.TTL)
+	if !ok {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	principals, err := api.servicePermissions(user, *service)
+	if err != nil {
+		log.Error("failed to enforce credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if len(principals) == 0 {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		log.Error("failed to get root key", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := deriveSSHCAKey(root, *service)
+	if err != nil {
+		log.Error("failed to derive certificate authority", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		log.Error("failed to create signer", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	serial := make([]byte, 8)
+	if _, err = rand.Read(serial); err != nil {
+		log.Error("failed to generate serial", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	validBefore := now.Add(ttl)
+
+	certificate := &ssh.Certificate{
+		Key:         publicKey,
+		Serial:      binary.BigEndian.Uint64(serial),
+		CertType:    ssh.UserCert,
+		KeyId:       user.K(),
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()), // allow for some clock skew
+		ValidBefore: uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: service.certificateExtensions(),
+		},
+	}
+
+	for _, principal := range principals {
+		certificate.ValidPrincipals = append(certificate.ValidPrincipals, principal.String())
+	}
+
+	if err = certificate.SignCert(rand.Reader, signer); err != nil {
+		log.Error("failed to sign certificate", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("issued ssh certificate",
+		zap.String("user", user.K()),
+		zap.String("service", service.K()),
+		zap.Uint64("serial", certificate.Serial),
+		zap.Time("valid_before", validBefore))
+
+	response := SSHCertificate{
+		Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(certificate))),
+		Principals:  principals,
+		ValidBefore: validBefore,
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(response)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+// defaultCertificateTTL is used when the maximum lifetime of certificates has not been configured.
+const defaultCertificateTTL = time.Hour
+
+// certificateTTL returns how long a certificate should be valid for given the configured maximum and the lifetime
+// requested by the user, if any. Requests for longer lived certificates are capped. It returns false when the
+// requested lifetime is invalid.
+func certificateTTL(limit time.Duration, requested string) (time.Duration, bool) {
+	if limit <= 0 {
+		limit = defaultCertificateTTL
+	}
+
+	if requested == "" {
+		return limit, true
+	}
+
+	ttl, err := time.ParseDuration(requested)
+	if err != nil || ttl <= 0 {
+		return 0, false
+	} else if ttl > limit {
+		return limit, true
+	}
+
+	return ttl, true
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestSignSSHKey(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.SSHCertificateTTL = time.Hour
+
+	service := Service{Kind: "ssh", Name: "bastion", Address: "bastion.example.com", Key: []byte("key")}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	user := User{Kind: "basic", ID: "user", Name: "user"}
+	stranger := User{Kind: "basic", ID: "stranger", Name: "stranger"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"read:ssh:bastion", "admin:ssh:bastion"}, nil))
+	require.NoError(t, EnsurePolicy(api.enforcer, `
+p, read:ssh:bastion,  /_service/ssh/bastion, read
+p, admin:ssh:bastion, /_service/ssh/bastion, admin
+`))
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	publicKey, err := ssh.NewPublicKey(public)
+	require.NoError(t, err)
+
+	sign := func(user User, ttl string) (*httptest.ResponseRecorder, SSHCertificate) {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(SignSSHKeyRequest{
+			PublicKey: string(ssh.MarshalAuthorizedKey(publicKey)),
+			TTL:       ttl,
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/services/ssh/bastion/ssh/sign", body)
+		r = mux.SetURLVars(r.WithContext(withUser(ctx, user)), vars)
+
+		w := httptest.NewRecorder()
+		api.SignSSHKey(w, r)
+
+		certificate := SSHCertificate{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&certificate))
+		}
+
+		return w, certificate
+	}
+
+	// users without permissions on the service cannot obtain a certificate
+	w, _ := sign(stranger, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w, signed := sign(user, "10m")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []Permission{ReadPermission, AdminPermission}, signed.Principals)
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), signed.ValidBefore, time.Minute)
+
+	// the certificate must be signed by the services' certificate authority
+	w = httptest.NewRecorder()
+	api.GetSSHCertificateAuthority(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/ssh/bastion/ssh/ca", nil), vars))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	ca := SSHCertificateAuthority{}
+	require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&ca))
+
+	caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca.PublicKey))
+	require.NoError(t, err)
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.Certificate))
+	require.NoError(t, err)
+
+	certificate := parsed.(*ssh.Certificate)
+	require.Equal(t, publicKey.Marshal(), certificate.Key.Marshal())
+	require.Equal(t, map[string]string{"permit-pty": ""}, certificate.Extensions)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caKey.Marshal())
+		},
+	}
+
+	_, err = checker.Authenticate(connMetadata("admin"), certificate)
+	require.NoError(t, err)
+
+	_, err = checker.Authenticate(connMetadata("root"), certificate)
+	require.Error(t, err)
+
+	// requests for longer lived certificates are capped
+	w, signed = sign(user, "24h")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.WithinDuration(t, time.Now().Add(time.Hour), signed.ValidBefore, time.Minute)
+
+	// certificates must never be issued already expired when the lifetime has not been configured
+	api.SSHCertificateTTL = 0
+
+	w, signed = sign(user, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.WithinDuration(t, time.Now().Add(defaultCertificateTTL), signed.ValidBefore, time.Minute)
+}
+
+func TestSSHCertificateAuthorityRotation(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.RotationGracePeriod = time.Hour
+
+	service := Service{Kind: "ssh", Name: "bastion", Address: "bastion.example.com", Key: []byte("key")}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	authority := func() SSHCertificateAuthority {
+		w := httptest.NewRecorder()
+		api.GetSSHCertificateAuthority(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/ssh/bastion/ssh/ca", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		ca := SSHCertificateAuthority{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&ca))
+
+		return ca
+	}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	original := authority()
+	require.Empty(t, original.PreviousPublicKey)
+
+	// hosts continue to trust the previous certificate authority during the grace period
+	require.NoError(t, api.rotateServiceKey(&service, time.Now(), false))
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	rotated := authority()
+	require.NotEqual(t, original.PublicKey, rotated.PublicKey)
+	require.Equal(t, original.PublicKey, rotated.PreviousPublicKey)
+	require.NotNil(t, rotated.PreviousPublicKeyExpiresAt)
+
+	// immediate rotations stop serving the previous certificate authority
+	require.NoError(t, api.rotateServiceKey(&service, time.Now(), true))
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	rotated = authority()
+	require.Empty(t, rotated.PreviousPublicKey)
+}
+
+type connMetadata string
+
+func (c connMetadata) User() string          { return string(c) }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return nil }
+func (c connMetadata) LocalAddr() net.Addr   { return nil }
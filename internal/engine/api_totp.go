@@ -0,0 +1,98 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+type TOTP struct {
+	// Code contains the current code for the user.
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// URI contains the users' secret formatted as an otpauth:// URI, used to enroll the secret with the service.
+	URI string `json:"uri"`
+}
+
+// GetServiceTOTP returns the current TOTP code for the user along with the URI used to enroll their secret. The secret
+// is derived from the same chain as the users' password, so rotating the password requires the secret be re-enrolled.
+func (api *API) GetServiceTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+	user := extractUser(ctx)
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	allowed, err := api.canReadCredentials(user, *service)
+	if err != nil {
+		log.Error("failed to enforce credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if !allowed || !service.TOTP {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		log.Error("failed to get root key", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	counter := user.SiteCounters[service.K()]
+
+	username, err := derive(root, pass.Identification, *service, user.Name, counter)
+	if err != nil {
+		log.Error("failed to derive credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	siteKey, err := deriveSiteKey(root, pass.Authentication, *service, string(username), counter)
+	if err != nil {
+		log.Error("failed to derive credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	secret := deriveTOTPSecret(siteKey)
+	now := time.Now()
+
+	response := TOTP{
+		Code:      totpCode(secret, now),
+		ExpiresAt: totpExpiresAt(now),
+		URI:       totpURI(secret, totpIssuer(*service), string(username)),
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(response)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+)
+
+func TestGetServiceTOTP(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	service := Service{Kind: "console", Name: "admin", Address: "console.example.com", Key: []byte("key")}
+	service.Templates.UserTemplate = pass.Basic
+	service.Templates.PasswordTemplate = pass.Basic
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	user := User{Kind: "basic", ID: "user", Name: "user"}
+	stranger := User{Kind: "basic", ID: "stranger", Name: "stranger"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:console:admin"}, nil))
+	require.NoError(t, EnsurePolicy(api.enforcer, `
+p, admin:console:admin, /_service/console/admin, admin
+`))
+
+	get := func(user User) (*httptest.ResponseRecorder, TOTP) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/services/console/admin/totp", nil)
+		r = mux.SetURLVars(r.WithContext(withUser(ctx, user)), vars)
+
+		w := httptest.NewRecorder()
+		api.GetServiceTOTP(w, r)
+
+		totp := TOTP{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&totp))
+		}
+
+		return w, totp
+	}
+
+	// services must opt in to deriving totp secrets
+	w, _ := get(user)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	service.TOTP = true
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	// users without permissions on the service cannot obtain a code
+	w, _ = get(stranger)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w, totp := get(user)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, totp.Code, totpDigits)
+
+	uri, err := url.Parse(totp.URI)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "varys console/admin", uri.Query().Get("issuer"))
+	require.NotEmpty(t, uri.Query().Get("secret"))
+
+	{ // connectors obtain each users' secret alongside their credentials
+		require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/credentials/console/admin", nil)
+		w := httptest.NewRecorder()
+
+		api.ListCredentials(w, mux.SetURLVars(r, vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		credentials := make([]UserCredential, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&credentials))
+		require.Len(t, credentials, 1)
+		require.Equal(t, totp.URI, credentials[0].Credentials.TOTPURI)
+	}
+}
@@ -17,9 +17,14 @@
 package engine
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/dgraph-io/badger/v3"
 	"go.uber.org/zap"
 
 	"github.com/mjpitz/myago/auth"
@@ -27,25 +32,210 @@ import (
 	"github.com/mjpitz/myago/zaputil"
 )
 
-func (api *API) getUsersForRole(role string) ([]string, error) {
-	users, err := api.enforcer.GetUsersForRole(role)
+// getSubjectsForRole returns the subjects directly assigned the role whose keys start with the provided prefix. The
+// prefix is removed from the returned values.
+func (api *API) getSubjectsForRole(role, prefix string) ([]string, error) {
+	subjects, err := api.enforcer.GetUsersForRole(role)
 	if err != nil {
 		return nil, err
 	}
 
 	filtered := make([]string, 0)
-	for _, user := range users {
-		if !strings.HasPrefix(user, "/_user/") {
+	for _, subject := range subjects {
+		if !strings.HasPrefix(subject, prefix) {
 			continue
 		}
 
-		user = strings.TrimPrefix(user, "/_user/")
-		filtered = append(filtered, user)
+		filtered = append(filtered, strings.TrimPrefix(subject, prefix))
 	}
 
 	return filtered, nil
 }
 
+func (api *API) getUsersForRole(role string) ([]string, error) {
+	return api.getSubjectsForRole(role, "/_user/")
+}
+
+func (api *API) getGroupsForRole(role string) ([]string, error) {
+	return api.getSubjectsForRole(role, "/_group/")
+}
+
+// groupsExpired reports whether the groups recorded for the user are too old to determine which users receive roles
+// granted to a group. Users who left a group may never make another request, so their recorded groups can't be
+// trusted indefinitely.
+func (api *API) groupsExpired(user *User, now time.Time) bool {
+	if api.GroupMembershipTTL <= 0 {
+		return false
+	}
+
+	return user.GroupsUpdatedAt == nil || now.Sub(*user.GroupsUpdatedAt) > api.GroupMembershipTTL
+}
+
+// groupsStale reports whether the time the users' groups were recorded should be refreshed. Refreshing before the
+// groups expire keeps active users from dropping out of their groups between requests without writing on every one.
+func (api *API) groupsStale(user *User, now time.Time) bool {
+	if user.GroupsUpdatedAt == nil {
+		return true
+	}
+
+	return api.GroupMembershipTTL > 0 && now.Sub(*user.GroupsUpdatedAt) > api.GroupMembershipTTL/2
+}
+
+// getGroupMembers returns the users that belong to each group, using the groups reported on each users' most recent
+// request. Groups that have not been reported within the GroupMembershipTTL are ignored. Users are formatted the same
+// way as getUsersForRole.
+func (api *API) getGroupMembers(ctx context.Context, now time.Time) (map[string][]string, error) {
+	users, err := api.users.List(ctx, User{})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string][]string)
+	for _, u := range users {
+		user := u.(*User)
+		if api.groupsExpired(user, now) {
+			continue
+		}
+
+		for _, group := range user.Groups {
+			members[group] = append(members[group], user.Kind+"/"+user.ID)
+		}
+	}
+
+	return members, nil
+}
+
+// removeGroupRoles removes the roles named by the provided groups from the user. Earlier versions added these roles
+// to the user on their first login, where they remained after the user left the group. Since they're now evaluated on
+// each request, users keep the roles for as long as they remain in the group. The default read:varys role is kept.
+func (api *API) removeGroupRoles(user *User, groups []string) error {
+	for _, group := range groups {
+		if group == "read:varys" {
+			continue
+		}
+
+		_, err := api.enforcer.DeleteRoleForUser(user.K(), group)
+		if err != nil {
+			return err
+		}
+	}
+
+	user.GroupRolesRemoved = true
+	return nil
+}
+
+// RemoveGroupRoles removes the roles named by each users' recorded groups that were added on their first login by
+// earlier versions. Users whose groups have never been recorded are handled by the Middleware on their next request.
+func (api *API) RemoveGroupRoles(ctx context.Context) error {
+	users, err := api.users.List(ctx, User{})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		user := u.(*User)
+		if user.GroupRolesRemoved || len(user.Groups) == 0 {
+			continue
+		}
+
+		err = api.removeGroupRoles(user, user.Groups)
+		if err != nil {
+			return err
+		}
+
+		err = api.users.Put(ctx, user.Kind, user.ID, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrLegacyGroupRoles is returned by ResolveLegacyGroupRoles when roles that may have been added by earlier versions
+// are found and the operator has not decided how to handle them.
+var ErrLegacyGroupRoles = errors.New("roles that earlier versions may have added for identity provider groups must be reviewed")
+
+const (
+	// RemoveLegacyGroupRoles removes every role found by ResolveLegacyGroupRoles.
+	RemoveLegacyGroupRoles = "remove"
+	// KeepLegacyGroupRoles keeps every role found by ResolveLegacyGroupRoles. Any that should be removed can be
+	// unassigned using the API.
+	KeepLegacyGroupRoles = "keep"
+)
+
+// legacyGroupRoles returns the grouping rules that assign a role not managed by varys directly to a user. Earlier
+// versions added the roles named by a users' groups to the user on their first login. These are indistinguishable from
+// roles assigned by an administrator, so they're only reported.
+func (api *API) legacyGroupRoles() [][]string {
+	rules := make([][]string, 0)
+
+	for _, rule := range api.enforcer.GetGroupingPolicy() {
+		if strings.HasPrefix(rule[0], "/_user/") && !managedRole(rule[1]) {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// ResolveLegacyGroupRoles handles the roles that earlier versions may have added to users for groups that were never
+// recorded, and therefore can't be removed by RemoveGroupRoles. This only happens once. When such roles are found,
+// the resolution determines whether they're removed or kept. ErrLegacyGroupRoles is returned along with the roles
+// when no resolution is provided.
+func (api *API) ResolveLegacyGroupRoles(ctx context.Context, resolution string) ([][]string, error) {
+	resolved := false
+
+	err := api.settings.Get(ctx, "migrations", "legacy_group_roles", &resolved)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return nil, err
+	case resolved:
+		return nil, nil
+	}
+
+	rules := api.legacyGroupRoles()
+
+	switch {
+	case len(rules) == 0, resolution == KeepLegacyGroupRoles:
+	case resolution == RemoveLegacyGroupRoles:
+		lockout, err := api.removesLastAdministrator(ctx, rules)
+		if err != nil {
+			return rules, err
+		} else if lockout {
+			return rules, fmt.Errorf("removing the roles would leave no user holding %s", administratorRole)
+		}
+
+		for _, rule := range rules {
+			err = api.revoke(ctx, rule[0], rule[1])
+			if err != nil {
+				return rules, err
+			}
+		}
+	case resolution == "":
+		return rules, ErrLegacyGroupRoles
+	default:
+		return rules, fmt.Errorf("unknown resolution for legacy group roles: %s", resolution)
+	}
+
+	return rules, api.settings.Put(ctx, "migrations", "legacy_group_roles", true)
+}
+
+// enforce determines if the user is allowed to perform the action on the object, either directly or through one of
+// their groups. Groups are evaluated on every call, so users lose access granted to or named by a group as soon as the
+// identity provider stops reporting them as a member.
+func (api *API) enforce(user *User, obj, act string) (bool, error) {
+	for _, subject := range user.subjects() {
+		allowed, err := api.enforcer.Enforce(subject, obj, act)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+
+	return false, nil
+}
+
 func (api *API) ListUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := zaputil.Extract(ctx)
@@ -78,6 +268,9 @@ func (api *API) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 
 type UpdateUserRequest struct {
 	RotateService Service `json:"rotate_service"`
+	// Immediate invalidates the users' previous credentials for the service right away instead of after the grace
+	// period.
+	Immediate bool `json:"immediate,omitempty"`
 }
 
 func (api *API) UpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
@@ -94,7 +287,7 @@ func (api *API) UpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
 	user := extractUser(ctx)
 
 	if req.RotateService.Kind != "" && req.RotateService.Name != "" {
-		user.SiteCounters[req.RotateService.K()]++
+		api.rotateSiteCounter(user, req.RotateService, time.Now(), req.Immediate)
 	}
 
 	err = api.users.Put(ctx, user.Kind, user.ID, user)
@@ -0,0 +1,239 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+type CertificateAuthority struct {
+	// Certificate contains the PEM encoded certificate of the services' certificate authority. Services should trust
+	// client certificates issued by it.
+	Certificate string `json:"certificate"`
+	// PreviousCertificate contains the PEM encoded certificate of the authority that was in use before the service key
+	// was last rotated. It's only set during the grace period, while client certificates issued by it remain valid.
+	PreviousCertificate          string     `json:"previous_certificate,omitempty"`
+	PreviousCertificateExpiresAt *time.Time `json:"previous_certificate_expires_at,omitempty"`
+}
+
+// certificateAuthority returns the certificate and key of the authority that issues client certificates for the
+// service.
+func (api *API) certificateAuthority(service Service) (*x509.Certificate, ed25519.PrivateKey, error) {
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := deriveCAKey(root, service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := newCACertificate(service, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
+
+// GetCertificateAuthority returns the certificate of the authority that issues client certificates for the service so
+// it can be installed by the connector. Rotating the service key also rotates the certificate authority, so the
+// previous certificate is returned alongside it during the grace period, giving services time to trust the new one.
+func (api *API) GetCertificateAuthority(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	ca, _, err := api.certificateAuthority(*service)
+	if err != nil {
+		log.Error("failed to create certificate authority", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	response := CertificateAuthority{Certificate: encodeCertificate(ca)}
+
+	if previous, ok := previousService(*service, time.Now()); ok {
+		ca, _, err = api.certificateAuthority(previous)
+		if err != nil {
+			log.Error("failed to create previous certificate authority", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		response.PreviousCertificate = encodeCertificate(ca)
+		response.PreviousCertificateExpiresAt = service.PreviousKeyExpiresAt
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(response)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+type IssueCertificateRequest struct {
+	// PublicKey is the PEM encoded public key the certificate is issued for. The private key never leaves the client.
+	PublicKey string `json:"public_key"`
+	// TTL optionally shortens how long the certificate is valid for. It cannot exceed the configured maximum.
+	TTL string `json:"ttl,omitempty"`
+}
+
+type ClientCertificate struct {
+	// Certificate contains the PEM encoded client certificate.
+	Certificate string `json:"certificate"`
+	// CA contains the PEM encoded certificate of the authority that issued the client certificate.
+	CA          string    `json:"ca"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+// IssueCertificate issues a short-lived client certificate for the provided public key. The certificate's common name
+// is the users' derived username for the service, allowing services that authenticate using mTLS to map it to the
+// same account a password would.
+func (api *API) IssueCertificate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zaputil.Extract(ctx)
+	user := extractUser(ctx)
+
+	req := IssueCertificateRequest{}
+	err := encoding.JSON.Decoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	block, _ := pem.Decode([]byte(req.PublicKey))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ttl, ok := certificateTTL(api.CertificateTTL, req.TTL)
+	if !ok {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	service, code := api.getService(r)
+	if code > 0 {
+		http.Error(w, "", code)
+		return
+	}
+
+	permissions, err := api.servicePermissions(user, *service)
+	if err != nil {
+		log.Error("failed to enforce credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if len(permissions) == 0 {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	root, err := api.keys.Get(service.RootKeyVersion)
+	if err != nil {
+		log.Error("failed to get root key", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := derive(root, pass.Identification, *service, user.Name, user.SiteCounters[service.K()])
+	if err != nil {
+		log.Error("failed to derive credentials", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	ca, key, err := api.certificateAuthority(*service)
+	if err != nil {
+		log.Error("failed to create certificate authority", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Error("failed to generate serial", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	validBefore := now.Add(ttl)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: string(username),
+		},
+		NotBefore:      now.Add(-time.Minute), // allow for some clock skew
+		NotAfter:       validBefore,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		AuthorityKeyId: ca.SubjectKeyId,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, publicKey, key)
+	if err != nil {
+		log.Error("failed to issue certificate", zap.Error(err))
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("issued client certificate",
+		zap.String("user", user.K()),
+		zap.String("service", service.K()),
+		zap.String("serial", serial.String()),
+		zap.Time("valid_before", validBefore))
+
+	response := ClientCertificate{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CA:          encodeCertificate(ca),
+		ValidBefore: validBefore,
+	}
+
+	err = encoding.JSON.Encoder(w).Encode(response)
+	if err != nil {
+		log.Error("failed to marshal json", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
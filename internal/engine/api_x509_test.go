@@ -0,0 +1,190 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+)
+
+func TestIssueCertificate(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.CertificateTTL = time.Hour
+
+	service := Service{Kind: "postgres", Name: "primary", Address: "db.example.com:5432", Key: []byte("key")}
+	service.Templates.UserTemplate = pass.Basic
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	user := User{Kind: "basic", ID: "user", Name: "user"}
+	stranger := User{Kind: "basic", ID: "stranger", Name: "stranger"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"read:postgres:primary"}, nil))
+	require.NoError(t, EnsurePolicy(api.enforcer, `
+p, read:postgres:primary, /_service/postgres/primary, read
+`))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+
+	issue := func(user User, ttl string) (*httptest.ResponseRecorder, ClientCertificate) {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(IssueCertificateRequest{
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+			TTL:       ttl,
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/services/postgres/primary/x509/sign", body)
+		r = mux.SetURLVars(r.WithContext(withUser(ctx, user)), vars)
+
+		w := httptest.NewRecorder()
+		api.IssueCertificate(w, r)
+
+		certificate := ClientCertificate{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&certificate))
+		}
+
+		return w, certificate
+	}
+
+	// users without permissions on the service cannot obtain a certificate
+	w, _ := issue(stranger, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w, issued := issue(user, "24h")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.WithinDuration(t, time.Now().Add(time.Hour), issued.ValidBefore, time.Minute)
+
+	// the published certificate authority matches the one that issued the certificate
+	w = httptest.NewRecorder()
+	api.GetCertificateAuthority(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/primary/x509/ca", nil), vars))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	ca := CertificateAuthority{}
+	require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&ca))
+
+	parse := func(data string) *x509.Certificate {
+		block, _ := pem.Decode([]byte(data))
+		require.NotNil(t, block)
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+
+		return certificate
+	}
+
+	// the certificate authority is identical across requests so it can be compared byte for byte
+	require.Equal(t, ca.Certificate, issued.CA)
+
+	authority := parse(ca.Certificate)
+	require.True(t, authority.IsCA)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority)
+
+	certificate := parse(issued.Certificate)
+	require.Equal(t, authority.SubjectKeyId, certificate.AuthorityKeyId)
+
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(t, err)
+	require.True(t, key.PublicKey.Equal(certificate.PublicKey))
+
+	// the common name is the users' derived username
+	root, err := api.keys.Get(service.RootKeyVersion)
+	require.NoError(t, err)
+
+	username, err := derive(root, pass.Identification, service, user.Name, 0)
+	require.NoError(t, err)
+	require.Equal(t, string(username), certificate.Subject.CommonName)
+
+	// invalid public keys are rejected
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/services/postgres/primary/x509/sign", bytes.NewBufferString(`{"public_key":"nope"}`))
+	w = httptest.NewRecorder()
+	api.IssueCertificate(w, mux.SetURLVars(r.WithContext(withUser(ctx, user)), vars))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// certificates must never be issued already expired when the lifetime has not been configured
+	api.CertificateTTL = 0
+
+	w, issued = issue(user, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.WithinDuration(t, time.Now().Add(defaultCertificateTTL), issued.ValidBefore, time.Minute)
+}
+
+func TestCertificateAuthorityRotation(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.RotationGracePeriod = time.Hour
+
+	service := Service{Kind: "postgres", Name: "primary", Address: "localhost:5432", Key: []byte("key")}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	authority := func() CertificateAuthority {
+		w := httptest.NewRecorder()
+		api.GetCertificateAuthority(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/primary/x509/ca", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		ca := CertificateAuthority{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&ca))
+
+		return ca
+	}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	original := authority()
+	require.Empty(t, original.PreviousCertificate)
+
+	// services continue to trust the previous certificate authority during the grace period
+	require.NoError(t, api.rotateServiceKey(&service, time.Now(), false))
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	rotated := authority()
+	require.NotEqual(t, original.Certificate, rotated.Certificate)
+	require.Equal(t, original.Certificate, rotated.PreviousCertificate)
+	require.NotNil(t, rotated.PreviousCertificateExpiresAt)
+
+	// immediate rotations stop serving the previous certificate authority
+	require.NoError(t, api.rotateServiceKey(&service, time.Now(), true))
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+
+	rotated = authority()
+	require.Empty(t, rotated.PreviousCertificate)
+}
@@ -0,0 +1,423 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago"
+	"github.com/mjpitz/myago/auth"
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+const (
+	auditPrefix  = "varys/audit/"
+	auditHeadKey = "varys/audit-head"
+
+	auditContextKey = myago.ContextKey("varys.audit")
+)
+
+// ErrAuditChainBroken is returned when the audit log fails verification.
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// AuditEntry records a single action taken against varys. Entries are chained together by including the hash of the
+// previous entry in the hash of the next, so modifying or removing an entry breaks the chain. Hashes are keyed using
+// the root key, preventing anyone without it from recomputing the chain.
+type AuditEntry struct {
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	SourceIP  string    `json:"source_ip"`
+	Outcome   string    `json:"outcome"`
+	Status    int       `json:"status"`
+	// Details describes the change that was requested, such as the roles granted to a user or group.
+	Details  json.RawMessage `json:"details,omitempty"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+// AuditGrant describes the roles granted to, or revoked from, a user or group.
+type AuditGrant struct {
+	Subject   string     `json:"subject"`
+	Roles     []string   `json:"roles"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// auditDetails holds the details handlers attach to the audit entry for the current request.
+type auditDetails struct {
+	details json.RawMessage
+}
+
+// annotateAudit attaches details to the audit entry recorded for the request. Requests that aren't audited are left
+// unchanged.
+func annotateAudit(ctx context.Context, details interface{}) {
+	holder, ok := ctx.Value(auditContextKey).(*auditDetails)
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(details)
+	if err != nil {
+		zaputil.Extract(ctx).Error("failed to marshal audit details", zap.Error(err))
+		return
+	}
+
+	holder.details = data
+}
+
+// auditMACKey derives the key used to authenticate audit entries from the root key.
+func auditMACKey(root string) []byte {
+	mac := hmac.New(sha256.New, []byte(root))
+	mac.Write([]byte("varys.audit"))
+
+	return mac.Sum(nil)
+}
+
+// ComputeHash returns the HMAC of the entry using the provided key, which covers every field except the hash itself.
+func (e AuditEntry) ComputeHash(key []byte) string {
+	h := hmac.New(sha256.New, key)
+
+	write := func(value string) {
+		_ = binary.Write(h, binary.BigEndian, uint64(len(value)))
+		_, _ = h.Write([]byte(value))
+	}
+
+	write(strconv.FormatUint(e.Sequence, 10))
+	write(strconv.FormatInt(e.Timestamp.UnixNano(), 10))
+	write(e.Actor)
+	write(e.Action)
+	write(e.Target)
+	write(e.SourceIP)
+	write(e.Outcome)
+	write(strconv.Itoa(e.Status))
+	write(e.PrevHash)
+
+	// entries recorded before details were introduced never have them, so their hashes are unchanged
+	if len(e.Details) > 0 {
+		write(string(e.Details))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditHead identifies the most recent entry in the audit log. The head is stored alongside the log so that entries
+// removed from the end are detected. Exporting the head and providing it during later verifications also detects the
+// log being rolled back to an earlier state.
+type AuditHead struct {
+	Sequence uint64 `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+// verifyAuditChain checks that the provided entries form a complete chain, starting from the first entry in the log.
+func verifyAuditChain(entries []AuditEntry, key []byte) error {
+	prev := ""
+
+	for i, entry := range entries {
+		switch {
+		case entry.Sequence != uint64(i+1):
+			return fmt.Errorf("%w: expected sequence %d, got %d", ErrAuditChainBroken, i+1, entry.Sequence)
+		case entry.PrevHash != prev:
+			return fmt.Errorf("%w: entry %d does not follow the previous entry", ErrAuditChainBroken, entry.Sequence)
+		case !hmac.Equal([]byte(entry.ComputeHash(key)), []byte(entry.Hash)):
+			return fmt.Errorf("%w: entry %d has been modified", ErrAuditChainBroken, entry.Sequence)
+		}
+
+		prev = entry.Hash
+	}
+
+	return nil
+}
+
+// AuditFilter restricts which entries are returned from the audit log.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	Actor string
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	switch {
+	case !f.Since.IsZero() && entry.Timestamp.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && entry.Timestamp.After(f.Until):
+		return false
+	case f.Actor != "" && entry.Actor != f.Actor:
+		return false
+	}
+
+	return true
+}
+
+// AuditLog is an append-only log of actions stored within badger.
+type AuditLog struct {
+	db  *badger.DB
+	key []byte
+	mu  sync.Mutex
+}
+
+func auditKey(sequence uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", auditPrefix, sequence))
+}
+
+// last returns the most recent entry in the log, or nil if the log is empty.
+func (l *AuditLog) last(txn *badger.Txn) (*AuditEntry, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(auditPrefix)
+	opts.Reverse = true
+
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	// reverse iteration starts from the largest key less than or equal to the seek key
+	iter.Seek(append([]byte(auditPrefix), 0xff))
+	if !iter.ValidForPrefix(opts.Prefix) {
+		return nil, nil
+	}
+
+	entry := &AuditEntry{}
+	err := iter.Item().Value(func(val []byte) error {
+		return encoding.MsgPack.Decoder(bytes.NewReader(val)).Decode(entry)
+	})
+
+	return entry, err
+}
+
+// Append adds the entry to the end of the log, filling in its sequence and hashes.
+func (l *AuditLog) Append(entry AuditEntry) (AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.db.Update(func(txn *badger.Txn) error {
+		last, err := l.last(txn)
+		if err != nil {
+			return err
+		}
+
+		entry.Sequence = 1
+		entry.PrevHash = ""
+
+		if last != nil {
+			entry.Sequence = last.Sequence + 1
+			entry.PrevHash = last.Hash
+		}
+
+		entry.Timestamp = entry.Timestamp.UTC()
+		entry.Hash = entry.ComputeHash(l.key)
+
+		value := bytes.NewBuffer(nil)
+		err = encoding.MsgPack.Encoder(value).Encode(entry)
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set(auditKey(entry.Sequence), value.Bytes())
+		if err != nil {
+			return err
+		}
+
+		head := bytes.NewBuffer(nil)
+		err = encoding.MsgPack.Encoder(head).Encode(AuditHead{Sequence: entry.Sequence, Hash: entry.Hash})
+		if err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(auditHeadKey), head.Bytes())
+	})
+
+	return entry, err
+}
+
+// head returns the head recorded by the most recent call to Append, or nil if nothing has been appended.
+func (l *AuditLog) head() (*AuditHead, error) {
+	var head *AuditHead
+
+	err := l.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(auditHeadKey))
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		head = &AuditHead{}
+		return item.Value(func(val []byte) error {
+			return encoding.MsgPack.Decoder(bytes.NewReader(val)).Decode(head)
+		})
+	})
+
+	return head, err
+}
+
+// Verify checks the entire log and returns its head along with the number of entries. When expected is provided, it
+// must be a head exported by an earlier verification, and the log must still contain that entry.
+func (l *AuditLog) Verify(expected *AuditHead) (AuditHead, int, error) {
+	entries, err := l.List(AuditFilter{})
+	if err != nil {
+		return AuditHead{}, 0, err
+	}
+
+	recorded, err := l.head()
+	if err != nil {
+		return AuditHead{}, 0, err
+	}
+
+	head := AuditHead{}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		head = AuditHead{Sequence: last.Sequence, Hash: last.Hash}
+	}
+
+	switch err = verifyAuditChain(entries, l.key); {
+	case err != nil:
+		return head, len(entries), err
+	case recorded != nil && *recorded != head:
+		return head, len(entries), fmt.Errorf("%w: entries after %d have been removed", ErrAuditChainBroken, head.Sequence)
+	case expected != nil && (expected.Sequence == 0 || expected.Sequence > uint64(len(entries)) ||
+		entries[expected.Sequence-1].Hash != expected.Hash):
+		return head, len(entries), fmt.Errorf("%w: entry %d does not match the expected head", ErrAuditChainBroken,
+			expected.Sequence)
+	}
+
+	return head, len(entries), nil
+}
+
+// List returns the entries in the log that match the filter, in the order they were appended.
+func (l *AuditLog) List(filter AuditFilter) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+
+	err := l.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(auditPrefix)
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Seek(opts.Prefix); iter.ValidForPrefix(opts.Prefix); iter.Next() {
+			entry := AuditEntry{}
+
+			err := iter.Item().Value(func(val []byte) error {
+				return encoding.MsgPack.Decoder(bytes.NewReader(val)).Decode(&entry)
+			})
+			if err != nil {
+				return err
+			}
+
+			if filter.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(data)
+}
+
+// AuditMiddleware returns an HTTP middleware that records requests made to named routes in the audit log. The route
+// name is used as the action. It's installed ahead of the access check so denied requests are recorded as well.
+// Handlers may describe the change they made using annotateAudit.
+func AuditMiddleware(handler http.Handler, api *API, authKind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || route.GetName() == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		details := &auditDetails{}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey, details))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		outcome := "success"
+		if recorder.status >= 400 {
+			outcome = "failure"
+		}
+
+		actor := ""
+		if userInfo := auth.Extract(r.Context()); userInfo != nil {
+			actor = User{Kind: authKind, ID: userInfo.Subject}.K()
+		}
+
+		sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			sourceIP = r.RemoteAddr
+		}
+
+		_, err = api.audit.Append(AuditEntry{
+			Timestamp: time.Now(),
+			Actor:     actor,
+			Action:    route.GetName(),
+			Target:    r.URL.Path,
+			SourceIP:  sourceIP,
+			Outcome:   outcome,
+			Status:    recorder.status,
+			Details:   details.details,
+		})
+
+		if err != nil {
+			zaputil.Extract(r.Context()).Error("failed to append audit entry", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/auth"
+	"github.com/mjpitz/myago/encoding"
+)
+
+func TestAuditLog(t *testing.T) {
+	api := newTestAPI(t)
+	start := time.Now()
+
+	for i, actor := range []string{"alice", "bob", "alice"} {
+		entry, err := api.audit.Append(AuditEntry{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Actor:     actor,
+			Action:    "services.credentials.get",
+			Target:    "/api/v1/services/postgres/prod/credentials",
+			SourceIP:  "127.0.0.1",
+			Outcome:   "success",
+			Status:    http.StatusOK,
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), entry.Sequence)
+	}
+
+	entries, err := api.audit.List(AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.NoError(t, verifyAuditChain(entries, api.audit.key))
+
+	filtered, err := api.audit.List(AuditFilter{Actor: "alice", Since: start.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, uint64(3), filtered[0].Sequence)
+
+	// a verified chain must start at the beginning of the log
+	require.ErrorIs(t, verifyAuditChain(entries[1:], api.audit.key), ErrAuditChainBroken)
+
+	head, count, err := api.audit.Verify(nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.Equal(t, AuditHead{Sequence: 3, Hash: entries[2].Hash}, head)
+
+	put := func(entry AuditEntry) {
+		value := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.MsgPack.Encoder(value).Encode(entry))
+		require.NoError(t, api.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(auditKey(entry.Sequence), value.Bytes())
+		}))
+	}
+
+	// modify an entry in place
+	modified := entries[1]
+	modified.Actor = "mallory"
+	put(modified)
+
+	_, _, err = api.audit.Verify(nil)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	// hashes cannot be recomputed without the root key
+	modified.Hash = modified.ComputeHash(auditMACKey("guess"))
+	put(modified)
+
+	_, _, err = api.audit.Verify(nil)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	put(entries[1])
+
+	// removing entries from the end is detected using the recorded head
+	require.NoError(t, api.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(auditKey(3))
+	}))
+
+	_, _, err = api.audit.Verify(nil)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	// as is rolling back the recorded head, given a head exported by an earlier verification
+	rolledBack := bytes.NewBuffer(nil)
+	require.NoError(t, encoding.MsgPack.Encoder(rolledBack).Encode(AuditHead{Sequence: 2, Hash: entries[1].Hash}))
+	require.NoError(t, api.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(auditHeadKey), rolledBack.Bytes())
+	}))
+
+	_, _, err = api.audit.Verify(nil)
+	require.NoError(t, err)
+
+	_, _, err = api.audit.Verify(&head)
+	require.ErrorIs(t, err, ErrAuditChainBroken)
+
+	{ // failures are reported by the api
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/audit/verify?sequence=3&hash="+head.Hash, nil)
+		w := httptest.NewRecorder()
+
+		api.VerifyAuditEntries(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		verification := AuditVerification{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&verification))
+		require.Equal(t, 2, verification.Entries)
+		require.NotEmpty(t, verification.Error)
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	api := newTestAPI(t)
+
+	router := mux.NewRouter()
+	router.Use(func(handler http.Handler) http.Handler {
+		handler = Middleware(handler, api, "basic")
+		handler = AuditMiddleware(handler, api, "basic")
+
+		return handler
+	})
+
+	router.HandleFunc("/api/v1/audit", api.ListAuditEntries).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/services/{kind}/{name}/credentials", api.GetServiceCredentials).
+		Methods(http.MethodGet).Name("services.credentials.get")
+	router.HandleFunc("/api/v1/services/{kind}/{name}/grants", api.PutGrant).
+		Methods(http.MethodPut).Name("services.grants.update")
+
+	ctx := auth.ToContext(context.Background(), auth.UserInfo{Subject: "user"})
+
+	{ // unnamed routes are not recorded
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil).WithContext(ctx))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	{ // failed requests are recorded
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/prod/credentials", nil).WithContext(ctx)
+		r.RemoteAddr = "10.0.0.1:5678"
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	entries, err := api.audit.List(AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	entry := entries[0]
+	require.Equal(t, "/_user/basic/user", entry.Actor)
+	require.Equal(t, "services.credentials.get", entry.Action)
+	require.Equal(t, "/api/v1/services/postgres/prod/credentials", entry.Target)
+	require.Equal(t, "10.0.0.1", entry.SourceIP)
+	require.Equal(t, "failure", entry.Outcome)
+	require.Equal(t, http.StatusNotFound, entry.Status)
+	require.Empty(t, entry.Details)
+
+	{ // changes to grants record who was granted which roles
+		service := Service{Kind: "postgres", Name: "prod"}
+		require.NoError(t, api.services.Put(context.Background(), service.Kind, service.Name, service))
+		require.NoError(t, api.grant(context.Background(), "/_user/basic/user", []string{"admin:varys:services"}, nil))
+
+		body := bytes.NewBufferString(`{"user":{"kind":"basic","id":"other"},"roles":["read:postgres:prod","admin:varys"],"duration":"1h"}`)
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/services/postgres/prod/grants", body).WithContext(ctx)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	entries, err = api.audit.List(AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NoError(t, verifyAuditChain(entries, api.audit.key))
+
+	grant := AuditGrant{}
+	require.NoError(t, encoding.JSON.Decoder(bytes.NewReader(entries[1].Details)).Decode(&grant))
+	require.Equal(t, "/_user/basic/other", grant.Subject)
+	require.Equal(t, []string{"read:postgres:prod"}, grant.Roles)
+	require.NotNil(t, grant.ExpiresAt)
+	require.WithinDuration(t, time.Now().Add(time.Hour), *grant.ExpiresAt, time.Minute)
+
+	// details are covered by the hash
+	modified := entries[1]
+	modified.Details = []byte(`{"subject":"/_user/basic/mallory","roles":["read:postgres:prod"]}`)
+	require.NotEqual(t, entries[1].Hash, modified.ComputeHash(api.audit.key))
+}
@@ -196,35 +196,44 @@ func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldOffset int
 
 	prefix := []byte(strings.Join([]string{rulePrefix, ptype}, "/") + "/")
 
-	iter := txn.NewIterator(badger.IteratorOptions{
-		Prefix:       prefix,
-		PrefetchSize: 100,
-	})
-	defer iter.Close()
+	// the iterator must be closed before the transaction is committed
+	err := func() error {
+		iter := txn.NewIterator(badger.IteratorOptions{
+			Prefix:       prefix,
+			PrefetchSize: 100,
+		})
+		defer iter.Close()
 
-	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-		item := iter.Item()
-		var err error
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			item := iter.Item()
+			var err error
 
-		if fieldOffset == -1 {
-			err = txn.Delete(item.Key())
-		} else {
-			rule := make([]string, 0)
+			if fieldOffset == -1 {
+				err = txn.Delete(item.KeyCopy(nil))
+			} else {
+				rule := make([]string, 0)
 
-			err = item.Value(func(val []byte) error {
-				return encoding.MsgPack.Decoder(bytes.NewReader(val)).Decode(&rule)
-			})
+				err = item.Value(func(val []byte) error {
+					return encoding.MsgPack.Decoder(bytes.NewReader(val)).Decode(&rule)
+				})
 
-			if err == nil && matches(q, rule) {
-				err = txn.Delete(item.Key())
+				if err == nil && matches(q, rule) {
+					err = txn.Delete(item.KeyCopy(nil))
+				}
 			}
-		}
 
-		switch {
-		case errors.Is(err, badger.ErrKeyNotFound):
-		case err != nil:
-			return err
+			switch {
+			case errors.Is(err, badger.ErrKeyNotFound):
+			case err != nil:
+				return err
+			}
 		}
+
+		return nil
+	}()
+
+	if err != nil {
+		return err
 	}
 
 	return txn.Commit()
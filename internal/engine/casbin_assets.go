@@ -55,5 +55,6 @@ func renderServicePolicy(policy policyTemplate) (string, error) {
 
 type policyTemplate struct {
 	Service Service
+	// Creator is granted additional permissions on the service. When empty, only the service's roles are rendered.
 	Creator User
 }
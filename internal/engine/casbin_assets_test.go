@@ -17,6 +17,8 @@
 package engine
 
 import (
+	"context"
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -26,6 +28,7 @@ var expectedTestPolicy = `
 # - Roles that grant a user additional capabilities on the service being created.
 p, system:crdb:test,                /api/v1/credentials/crdb/test,     GET
 p, admin:varys:services:crdb:test,  /api/v1/services/crdb/test/grants, (GET)|(PUT)|(DELETE)
+p, admin:varys:services:crdb:test,  /api/v1/services/crdb/test/requests/{id}, PUT
 p, update:varys:services:crdb:test, /api/v1/services/crdb/test,        PUT
 p, delete:varys:services:crdb:test, /api/v1/services/crdb/test,        DELETE
 
@@ -70,3 +73,41 @@ func TestRenderServicePolicy(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expectedTestPolicy, rendered)
 }
+
+// baselineServicePolicy is the service policy rendered by earlier versions, which lacked the rule allowing service
+// administrators to review access requests.
+const baselineServicePolicy = `
+p, admin:varys:services:crdb:test,  /api/v1/services/crdb/test/grants, (GET)|(PUT)|(DELETE)
+p, admin:crdb:test,  /_service/crdb/test, admin
+g, /_user/basic/creator, admin:varys:services:crdb:test
+`
+
+func TestEnsureServicePolicies(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	service := Service{Kind: "crdb", Name: "test"}
+	creator := User{Kind: "basic", ID: "creator"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, EnsurePolicy(api.enforcer, baselineServicePolicy))
+
+	allowed, err := api.enforce(&creator, "/api/v1/services/crdb/test/requests/id", http.MethodPut)
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	require.NoError(t, api.EnsureServicePolicies(ctx))
+
+	allowed, err = api.enforce(&creator, "/api/v1/services/crdb/test/requests/id", http.MethodPut)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// only the service's roles are added, never a creator
+	assigned, err := api.getUsersForRole("admin:varys:services:crdb:test")
+	require.NoError(t, err)
+	require.Equal(t, []string{"basic/creator"}, assigned)
+
+	rendered, err := renderServicePolicy(policyTemplate{Service: service})
+	require.NoError(t, err)
+	require.NotContains(t, rendered, "/_user/")
+}
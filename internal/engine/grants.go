@@ -0,0 +1,191 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// getGrantExpiration returns when the role granted to the user expires, or nil if the grant does not expire.
+func (api *API) getGrantExpiration(ctx context.Context, userKey, role string) (*time.Time, error) {
+	grant := Grant{}
+
+	err := api.grants.Get(ctx, role, userKey, &grant)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &grant.ExpiresAt, nil
+}
+
+// grant adds the roles to the user. When expiresAt is provided, the roles are removed by the reaper once the time has
+// passed. Roles the user already holds indefinitely are left as they are. Otherwise, any existing expiration is cleared
+// and the roles are granted indefinitely.
+func (api *API) grant(ctx context.Context, userKey string, roles []string, expiresAt *time.Time) (err error) {
+	// record expirations before adding roles so a failure never leaves behind a grant that doesn't expire
+	func() {
+		txn := &Txn{api.db.NewTransaction(true)}
+		defer txn.CommitOrDiscard(&err)
+
+		ctx := withTxn(ctx, txn)
+
+		for _, role := range roles {
+			if expiresAt == nil {
+				err = api.grants.Delete(ctx, role, userKey)
+			} else {
+				var permanent bool
+
+				permanent, err = api.heldIndefinitely(ctx, userKey, role)
+				if err != nil {
+					return
+				} else if permanent {
+					// recording an expiration would cause the reaper to revoke the existing grant
+					continue
+				}
+
+				err = api.grants.Put(ctx, role, userKey, Grant{
+					User:      userKey,
+					Role:      role,
+					ExpiresAt: *expiresAt,
+				})
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		// added individually since batches are rejected when any of the roles are already held
+		_, err = api.enforcer.AddRoleForUser(userKey, role)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// heldIndefinitely reports whether the role has been granted to the user without an expiration.
+func (api *API) heldIndefinitely(ctx context.Context, userKey, role string) (bool, error) {
+	held, err := api.enforcer.HasRoleForUser(userKey, role)
+	if err != nil || !held {
+		return false, err
+	}
+
+	expiresAt, err := api.getGrantExpiration(ctx, userKey, role)
+	if err != nil {
+		return false, err
+	}
+
+	return expiresAt == nil, nil
+}
+
+// revoke removes the role from the user along with any expiration.
+func (api *API) revoke(ctx context.Context, userKey, role string) error {
+	_, err := api.enforcer.DeleteRoleForUser(userKey, role)
+	if err != nil {
+		return err
+	}
+
+	return api.grants.Delete(ctx, role, userKey)
+}
+
+// ReapExpiredGrants removes all grants that expired before the provided time.
+func (api *API) ReapExpiredGrants(ctx context.Context, now time.Time) error {
+	log := zaputil.Extract(ctx)
+
+	grants, err := api.grants.List(ctx, Grant{})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		grant := g.(*Grant)
+
+		// the grant may have been extended since it was listed
+		expiresAt, err := api.getGrantExpiration(ctx, grant.User, grant.Role)
+		if err != nil {
+			return err
+		} else if expiresAt == nil || expiresAt.After(now) {
+			continue
+		}
+
+		log.Info("revoking expired grant",
+			zap.String("user", grant.User),
+			zap.String("role", grant.Role),
+			zap.Time("expires_at", *expiresAt))
+
+		err = api.revoke(ctx, grant.User, grant.Role)
+
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+
+		_, auditErr := api.audit.Append(AuditEntry{
+			Timestamp: time.Now(),
+			Actor:     "varys",
+			Action:    "grants.expire",
+			Target:    grant.User + "#" + grant.Role,
+			Outcome:   outcome,
+		})
+		if auditErr != nil {
+			log.Error("failed to append audit entry", zap.Error(auditErr))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunGrantReaper periodically removes expired grants until the provided context is canceled.
+func (api *API) RunGrantReaper(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := api.ReapExpiredGrants(ctx, time.Now())
+		if err != nil {
+			zaputil.Extract(ctx).Error("failed to reap expired grants", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/auth"
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+)
+
+func newTestAPI(t *testing.T) *API {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = db.Close() })
+
+	m, err := model.NewModelFromString(Model)
+	require.NoError(t, err)
+
+	enforcer, _ := casbin.NewEnforcer()
+	enforcer.SetModel(m)
+	enforcer.SetAdapter(NewCasbinAdapter(db))
+	enforcer.EnableAutoSave(true)
+	enforcer.EnableAutoBuildRoleLinks(true)
+
+	require.NoError(t, enforcer.LoadPolicy())
+	require.NoError(t, EnsurePolicy(enforcer, DefaultPolicy))
+
+	return NewAPI(db, enforcer, KeyRing{DefaultRootKeyVersion: "root"})
+}
+
+func TestGrantExpiration(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	user := User{Kind: "basic", ID: "user"}
+	expiresAt := time.Now().Add(time.Hour)
+
+	require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+	require.NoError(t, api.services.Put(ctx, "postgres", "prod", Service{Kind: "postgres", Name: "prod"}))
+
+	require.NoError(t, api.grant(ctx, user.K(), []string{"read:postgres:prod"}, nil))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:postgres:prod"}, &expiresAt))
+
+	{ // grants are grouped by their expiration
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/prod/grants", nil),
+			map[string]string{"kind": "postgres", "name": "prod"})
+		w := httptest.NewRecorder()
+
+		api.ListGrants(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := ListGrantsResponse{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Grants, 2)
+
+		for _, grant := range resp.Grants {
+			require.Equal(t, user.ID, grant.User.ID)
+
+			if grant.ExpiresAt == nil {
+				require.Equal(t, []string{"read:postgres:prod"}, grant.Roles)
+			} else {
+				require.Equal(t, []string{"admin:postgres:prod"}, grant.Roles)
+				require.True(t, expiresAt.Equal(*grant.ExpiresAt))
+			}
+		}
+	}
+
+	require.NoError(t, api.ReapExpiredGrants(ctx, expiresAt.Add(-time.Minute)))
+
+	ok, err := api.enforcer.HasRoleForUser(user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, api.ReapExpiredGrants(ctx, expiresAt.Add(time.Minute)))
+
+	ok, err = api.enforcer.HasRoleForUser(user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = api.enforcer.HasRoleForUser(user.K(), "read:postgres:prod")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	expiration, err := api.getGrantExpiration(ctx, user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.Nil(t, expiration)
+}
+
+func TestGrantWithoutExpirationClearsExpiration(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	user := User{Kind: "basic", ID: "user"}
+	expiresAt := time.Now().Add(time.Hour)
+
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:postgres:prod"}, &expiresAt))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:postgres:prod"}, nil))
+
+	require.NoError(t, api.ReapExpiredGrants(ctx, expiresAt.Add(time.Minute)))
+
+	ok, err := api.enforcer.HasRoleForUser(user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestGrantWithExpirationKeepsPermanentGrant(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	user := User{Kind: "basic", ID: "user"}
+	expiresAt := time.Now().Add(time.Hour)
+
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:postgres:prod"}, nil))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"admin:postgres:prod"}, &expiresAt))
+
+	expiration, err := api.getGrantExpiration(ctx, user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.Nil(t, expiration)
+
+	require.NoError(t, api.ReapExpiredGrants(ctx, expiresAt.Add(time.Minute)))
+
+	ok, err := api.enforcer.HasRoleForUser(user.K(), "admin:postgres:prod")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestUserGrantExpiration(t *testing.T) {
+	now := time.Now()
+
+	expiresAt, err := UserGrant{}.expiration(now)
+	require.NoError(t, err)
+	require.Nil(t, expiresAt)
+
+	expiresAt, err = UserGrant{Duration: "2h"}.expiration(now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(2*time.Hour), *expiresAt)
+
+	_, err = UserGrant{Duration: "-2h"}.expiration(now)
+	require.Error(t, err)
+
+	past := now.Add(-time.Hour)
+	_, err = UserGrant{ExpiresAt: &past}.expiration(now)
+	require.Error(t, err)
+}
+
+func TestGroupGrants(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	service := Service{Kind: "postgres", Name: "prod", Address: "localhost:5432", Key: []byte("key")}
+	service.Templates.UserTemplate = pass.Basic
+	service.Templates.PasswordTemplate = pass.Basic
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	member := User{Kind: "basic", ID: "member", Name: "member", Groups: []string{"dba"}}
+	outsider := User{Kind: "basic", ID: "outsider", Name: "outsider"}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.users.Put(ctx, member.Kind, member.ID, member))
+	require.NoError(t, api.users.Put(ctx, outsider.Kind, outsider.ID, outsider))
+	require.NoError(t, EnsurePolicy(api.enforcer, `
+p, read:postgres:prod, /_service/postgres/prod, read
+`))
+
+	{ // grant the role to the group
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UserGrant{
+			Group: "dba",
+			Roles: []string{"read:postgres:prod"},
+		}))
+
+		w := httptest.NewRecorder()
+		api.PutGrant(w, mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/api/v1/services/postgres/prod/grants", body), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// membership is evaluated using the groups on the current request
+	allowed, err := api.enforce(&member, service.K(), "read")
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = api.enforce(&outsider, service.K(), "read")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	removed := member
+	removed.Groups = nil
+
+	allowed, err = api.enforce(&removed, service.K(), "read")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	{ // group grants are listed alongside user grants
+		w := httptest.NewRecorder()
+		api.ListGrants(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/services/postgres/prod/grants", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := ListGrantsResponse{}
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Grants, 1)
+		require.Equal(t, "dba", resp.Grants[0].Group)
+		require.Equal(t, []string{"read:postgres:prod"}, resp.Grants[0].Roles)
+	}
+
+	{ // credentials are listed for each member of the group
+		w := httptest.NewRecorder()
+		api.ListCredentials(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/credentials/postgres/prod", nil), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		credentials := make([]UserCredential, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&credentials))
+		require.Len(t, credentials, 1)
+		require.Equal(t, []Permission{ReadPermission}, credentials[0].Permission)
+
+		root, err := api.keys.Get(service.RootKeyVersion)
+		require.NoError(t, err)
+
+		username, err := derive(root, pass.Identification, service, member.Name, 0)
+		require.NoError(t, err)
+		require.Equal(t, string(username), credentials[0].Credentials.Username)
+	}
+
+	{ // revoking the grant removes access from the group
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UserGrant{
+			Group: "dba",
+			Roles: []string{"read:postgres:prod"},
+		}))
+
+		w := httptest.NewRecorder()
+		api.DeleteGrant(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/api/v1/services/postgres/prod/grants", body), vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		allowed, err = api.enforce(&member, service.K(), "read")
+		require.NoError(t, err)
+		require.False(t, allowed)
+	}
+}
+
+func TestGroupMembershipExpires(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.GroupMembershipTTL = time.Hour
+
+	now := time.Now()
+	recent := now.Add(-time.Minute)
+	expired := now.Add(-2 * time.Hour)
+
+	users := []User{
+		{Kind: "basic", ID: "active", Name: "active", Groups: []string{"dba"}, GroupsUpdatedAt: &recent},
+		{Kind: "basic", ID: "departed", Name: "departed", Groups: []string{"dba"}, GroupsUpdatedAt: &expired},
+		{Kind: "basic", ID: "legacy", Name: "legacy", Groups: []string{"dba"}},
+	}
+
+	for _, user := range users {
+		require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+	}
+
+	// only groups reported within the ttl are trusted
+	members, err := api.getGroupMembers(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"dba": {"basic/active"}}, members)
+
+	// requests refresh the recorded groups before they expire
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), api, "basic")
+
+	for _, id := range []string{"departed", "legacy"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/users/self", nil)
+		r = r.WithContext(auth.ToContext(ctx, auth.UserInfo{Subject: id, Profile: id, Groups: []string{"dba"}}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	members, err = api.getGroupMembers(ctx, time.Now())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"basic/active", "basic/departed", "basic/legacy"}, members["dba"])
+
+	// without a ttl, recorded groups are always used
+	api.GroupMembershipTTL = 0
+
+	members, err = api.getGroupMembers(ctx, now.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, members["dba"], 3)
+}
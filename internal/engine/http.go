@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"go.uber.org/zap"
@@ -52,6 +53,7 @@ func Middleware(handler http.Handler, api *API, authKind string) http.Handler {
 
 		var err error
 
+		now := time.Now()
 		userInfo := auth.Extract(reqCtx)
 		user := User{
 			Kind:         authKind,
@@ -67,19 +69,56 @@ func Middleware(handler http.Handler, api *API, authKind string) http.Handler {
 			ctx := withTxn(reqCtx, txn)
 
 			err = api.users.Get(ctx, user.Kind, user.ID, &user)
-			if errors.Is(err, badger.ErrKeyNotFound) {
+			switch {
+			case errors.Is(err, badger.ErrKeyNotFound):
+				user.Groups = userInfo.Groups
+				user.GroupsUpdatedAt = &now
+				user.GroupRolesRemoved = true
+
 				err = api.users.Put(ctx, user.Kind, user.ID, user)
 				if err != nil {
 					log.Error("failed to create user", zap.Error(err))
 					return
 				}
 
-				roles := append([]string{"read:varys"}, userInfo.Groups...)
-
-				_, err = api.enforcer.AddRolesForUser(user.K(), roles)
+				// roles named by the users' groups are evaluated on each request rather than being added to the user,
+				// keeping them separate from explicit grants
+				_, err = api.enforcer.AddRoleForUser(user.K(), "read:varys")
 				if err != nil {
 					log.Error("failed to add default roles for user", zap.Error(err))
 				}
+			case err != nil:
+				log.Error("failed to get user", zap.Error(err))
+			default:
+				update := false
+
+				if !user.GroupRolesRemoved {
+					// users created by earlier versions may have had roles added for groups they've since left
+					groups := append(append([]string{}, user.Groups...), userInfo.Groups...)
+
+					err = api.removeGroupRoles(&user, groups)
+					if err != nil {
+						log.Error("failed to remove group roles", zap.Error(err))
+						return
+					}
+
+					update = true
+				}
+
+				if !equalStrings(user.Groups, userInfo.Groups) || api.groupsStale(&user, now) {
+					// record the users' current groups so roles granted to or named by a group can be attributed to
+					// its members
+					user.Groups = userInfo.Groups
+					user.GroupsUpdatedAt = &now
+					update = true
+				}
+
+				if update {
+					err = api.users.Put(ctx, user.Kind, user.ID, user)
+					if err != nil {
+						log.Error("failed to update user", zap.Error(err))
+					}
+				}
 			}
 		}()
 
@@ -88,7 +127,7 @@ func Middleware(handler http.Handler, api *API, authKind string) http.Handler {
 			return
 		}
 
-		allowed, err := api.enforcer.Enforce(user.K(), r.URL.Path, r.Method)
+		allowed, err := api.enforce(&user, r.URL.Path, r.Method)
 		if err != nil {
 			log.Error("failed to enforce access", zap.Error(err))
 			http.Error(w, "", http.StatusInternalServerError)
@@ -101,3 +140,17 @@ func Middleware(handler http.Handler, api *API, authKind string) http.Handler {
 		handler.ServeHTTP(w, r.WithContext(withUser(reqCtx, user)))
 	})
 }
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
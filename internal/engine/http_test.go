@@ -0,0 +1,216 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/auth"
+)
+
+func TestMiddlewareSyncsGroups(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), api, "oidc")
+
+	request := func(groups ...string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+		r = r.WithContext(auth.ToContext(ctx, auth.UserInfo{
+			Subject: "user",
+			Profile: "user",
+			Groups:  groups,
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	groups := func() []string {
+		user := User{}
+		require.NoError(t, api.users.Get(ctx, "oidc", "user", &user))
+		return user.Groups
+	}
+
+	// roles named by the users' groups are granted on first login
+	require.Equal(t, http.StatusOK, request("admin:varys"))
+	require.Equal(t, []string{"admin:varys"}, groups())
+
+	// and revoked as soon as the identity provider stops reporting the group
+	require.Equal(t, http.StatusUnauthorized, request("dba"))
+	require.Equal(t, []string{"dba"}, groups())
+
+	ok, err := api.enforcer.HasRoleForUser(User{Kind: "oidc", ID: "user"}.K(), "admin:varys")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// added groups grant access without affecting explicit grants
+	require.NoError(t, api.grant(ctx, User{Kind: "oidc", ID: "user"}.K(), []string{"read:varys:audit"}, nil))
+	require.Equal(t, http.StatusOK, request())
+	require.Equal(t, http.StatusOK, request("admin:varys"))
+	require.Equal(t, http.StatusOK, request())
+}
+
+func TestMiddlewareRemovesGroupRoles(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), api, "oidc")
+
+	// earlier versions added the roles named by the users' groups on first login without recording the groups
+	user := User{Kind: "oidc", ID: "user", Name: "user"}
+	require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+	_, err := api.enforcer.AddRolesForUser(user.K(), []string{"read:varys", "admin:varys"})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+	r = r.WithContext(auth.ToContext(ctx, auth.UserInfo{
+		Subject: user.ID,
+		Profile: user.Name,
+		Groups:  []string{"admin:varys"},
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the role is removed from the user and only granted while they remain in the group
+	ok, err := api.enforcer.HasRoleForUser(user.K(), "admin:varys")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = api.enforcer.HasRoleForUser(user.K(), "read:varys")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, api.users.Get(ctx, user.Kind, user.ID, &user))
+	require.True(t, user.GroupRolesRemoved)
+
+	// roles explicitly assigned once the migration has run are left alone
+	_, err = api.enforcer.AddRoleForUser(user.K(), "admin:varys")
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	ok, err = api.enforcer.HasRoleForUser(user.K(), "admin:varys")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestRemoveGroupRoles(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	// users whose groups were recorded by earlier versions are migrated on startup
+	member := User{Kind: "oidc", ID: "member", Groups: []string{"dba"}}
+	require.NoError(t, api.users.Put(ctx, member.Kind, member.ID, member))
+	_, err := api.enforcer.AddRolesForUser(member.K(), []string{"read:varys", "dba"})
+	require.NoError(t, err)
+
+	// users without recorded groups are left for the middleware
+	unknown := User{Kind: "oidc", ID: "unknown"}
+	require.NoError(t, api.users.Put(ctx, unknown.Kind, unknown.ID, unknown))
+	_, err = api.enforcer.AddRolesForUser(unknown.K(), []string{"read:varys", "dba"})
+	require.NoError(t, err)
+
+	require.NoError(t, api.RemoveGroupRoles(ctx))
+
+	roles, err := api.enforcer.GetRolesForUser(member.K())
+	require.NoError(t, err)
+	require.Equal(t, []string{"read:varys"}, roles)
+
+	require.NoError(t, api.users.Get(ctx, member.Kind, member.ID, &member))
+	require.True(t, member.GroupRolesRemoved)
+
+	roles, err = api.enforcer.GetRolesForUser(unknown.K())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"read:varys", "dba"}, roles)
+
+	require.NoError(t, api.users.Get(ctx, unknown.Kind, unknown.ID, &unknown))
+	require.False(t, unknown.GroupRolesRemoved)
+}
+
+func TestResolveLegacyGroupRoles(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func() (*API, User) {
+		api := newTestAPI(t)
+
+		// the user left the group before their groups were ever recorded
+		user := User{Kind: "oidc", ID: "user", GroupRolesRemoved: true}
+		require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+		_, err := api.enforcer.AddRolesForUser(user.K(), []string{"read:varys", "admin:varys", "dba"})
+		require.NoError(t, err)
+
+		return api, user
+	}
+
+	{ // operators must decide how to handle the roles before starting
+		api, user := setup()
+
+		rules, err := api.ResolveLegacyGroupRoles(ctx, "")
+		require.ErrorIs(t, err, ErrLegacyGroupRoles)
+		require.Equal(t, [][]string{{user.K(), "dba"}}, rules)
+
+		rules, err = api.ResolveLegacyGroupRoles(ctx, RemoveLegacyGroupRoles)
+		require.NoError(t, err)
+		require.Len(t, rules, 1)
+
+		roles, err := api.enforcer.GetRolesForUser(user.K())
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"read:varys", "admin:varys"}, roles)
+
+		// roles assigned once resolved are never reported
+		_, err = api.enforcer.AddRoleForUser(user.K(), "dba")
+		require.NoError(t, err)
+
+		rules, err = api.ResolveLegacyGroupRoles(ctx, "")
+		require.NoError(t, err)
+		require.Empty(t, rules)
+	}
+
+	{ // or keep them
+		api, user := setup()
+
+		_, err := api.ResolveLegacyGroupRoles(ctx, KeepLegacyGroupRoles)
+		require.NoError(t, err)
+
+		ok, err := api.enforcer.HasRoleForUser(user.K(), "dba")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		_, err = api.ResolveLegacyGroupRoles(ctx, "")
+		require.NoError(t, err)
+	}
+
+	{ // installs without any are resolved immediately
+		api := newTestAPI(t)
+
+		rules, err := api.ResolveLegacyGroupRoles(ctx, "")
+		require.NoError(t, err)
+		require.Empty(t, rules)
+	}
+}
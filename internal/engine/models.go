@@ -17,6 +17,9 @@
 package engine
 
 import (
+	"strings"
+	"time"
+
 	"github.com/mjpitz/myago/pass"
 )
 
@@ -65,6 +68,15 @@ var PermissionValues = []Permission{
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// PublicKey contains the users' derived SSH public key, formatted for use in an authorized_keys file. It's only
+	// set for services that derive SSH keys.
+	PublicKey string `json:"public_key,omitempty"`
+	// PrivateKey contains the users' derived SSH private key in the OpenSSH format. It's only returned to the user
+	// the key belongs to.
+	PrivateKey string `json:"private_key,omitempty"`
+	// TOTPURI contains the users' TOTP secret formatted as an otpauth:// URI. It's only set for services that require
+	// a second factor, allowing connectors to enroll the secret on the users' behalf.
+	TOTPURI string `json:"totp_uri,omitempty"`
 }
 
 // Templates define a set of templates used for generating usernames and passwords.
@@ -85,6 +97,31 @@ type Service struct {
 	Address   string           `json:"address"`
 	Key       []byte           `json:"-"`
 	Templates ServiceTemplates `json:"templates"`
+	// PasswordPolicy, when set, is used to generate passwords in place of the password template.
+	PasswordPolicy *PasswordPolicy `json:"password_policy,omitempty"`
+	// SSHKey configures the service to derive an ed25519 SSH key pair for each user alongside their password.
+	SSHKey bool `json:"ssh_key,omitempty"`
+	// SSHExtensions lists the extensions granted to SSH certificates issued for the service. When empty, certificates
+	// only receive the DefaultSSHExtensions.
+	SSHExtensions []string `json:"ssh_extensions,omitempty"`
+	// TOTP configures the service to derive a TOTP secret for each user, for services that require a second factor.
+	TOTP bool `json:"totp,omitempty"`
+	// RootKeyVersion identifies which version of the root key credentials are derived from. Services created before
+	// root keys were versioned use the DefaultRootKeyVersion.
+	RootKeyVersion string `json:"root_key_version,omitempty"`
+	// PreviousKey holds the key that was in use before the last rotation. Credentials derived from it remain valid
+	// until PreviousKeyExpiresAt, giving running workloads time to pick up their new credentials.
+	PreviousKey          []byte     `json:"-"`
+	PreviousKeyExpiresAt *time.Time `json:"previous_key_expires_at,omitempty"`
+	// PreviousRootKeyVersion holds the version of the root key that was in use before the service was migrated to
+	// another version. Like the PreviousKey, it remains valid until PreviousKeyExpiresAt. When empty, the previous
+	// credentials were derived from the current RootKeyVersion.
+	PreviousRootKeyVersion string `json:"previous_root_key_version,omitempty"`
+	// RotationPeriod configures how frequently the service key is rotated automatically. When empty, the key is only
+	// rotated manually.
+	RotationPeriod string     `json:"rotation_period,omitempty"`
+	LastRotatedAt  *time.Time `json:"last_rotated_at,omitempty"`
+	NextRotationAt *time.Time `json:"next_rotation_at,omitempty"`
 }
 
 // K returns a unique key for the service. Useful for caching in maps.
@@ -98,9 +135,90 @@ type User struct {
 	ID           string            `json:"id"`
 	Name         string            `json:"name"`
 	SiteCounters map[string]uint32 `json:"-"`
+	// PreviousSiteCounters holds the counters that were in use before the user last rotated their credentials for a
+	// service, keyed the same way as SiteCounters.
+	PreviousSiteCounters map[string]PreviousCounter `json:"-"`
+	// Groups contains the groups reported by the identity provider on the users' most recent request. It's used to
+	// determine which users receive roles granted to a group.
+	Groups []string `json:"groups,omitempty"`
+	// GroupsUpdatedAt records when the identity provider last reported the users' groups. Groups older than the
+	// configured GroupMembershipTTL are no longer used to determine which users receive roles granted to a group.
+	GroupsUpdatedAt *time.Time `json:"groups_updated_at,omitempty"`
+	// GroupRolesRemoved is set once the roles named by the users' groups, which earlier versions added to the user on
+	// their first login, have been removed.
+	GroupRolesRemoved bool `json:"-"`
+}
+
+// PreviousCounter records the value of a site counter before it was rotated and when it stops being valid.
+type PreviousCounter struct {
+	Counter   uint32    `json:"counter"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // K returns a unique key for the user. Useful for caching or referencing in maps.
 func (u User) K() string {
 	return "/_user/" + u.Kind + "/" + u.ID
 }
+
+// subjects returns the subjects used to evaluate the users' permissions. This includes the user, the roles granted to
+// each of their groups, and the roles named by their groups. Group names that could be mistaken for another subjects'
+// key are ignored as roles.
+func (u User) subjects() []string {
+	subjects := []string{u.K()}
+	for _, group := range u.Groups {
+		subjects = append(subjects, Group{Name: group}.K())
+
+		if !strings.HasPrefix(group, "/_") {
+			subjects = append(subjects, group)
+		}
+	}
+
+	return subjects
+}
+
+// Group represents a group of users managed by the identity provider.
+type Group struct {
+	Name string `json:"name"`
+}
+
+// K returns a unique key for the group. Useful for caching or referencing in maps.
+func (g Group) K() string {
+	return "/_group/" + g.Name
+}
+
+// Grant records when a role that was granted to a user or group expires. Roles granted without an expiration have no
+// record.
+type Grant struct {
+	User      string    `json:"user"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AccessRequestStatus describes where an access request is in the review process.
+type AccessRequestStatus string
+
+const (
+	// PendingAccessRequest indicates the request is waiting for review.
+	PendingAccessRequest AccessRequestStatus = "pending"
+	// ApprovedAccessRequest indicates the request was approved and the permissions were granted.
+	ApprovedAccessRequest AccessRequestStatus = "approved"
+	// DeniedAccessRequest indicates the request was denied.
+	DeniedAccessRequest AccessRequestStatus = "denied"
+)
+
+// AccessRequest records a users' request for temporary access to a service. Once approved, the requested permissions
+// are granted for the requested duration.
+type AccessRequest struct {
+	ID            string              `json:"id"`
+	Kind          string              `json:"kind"`
+	Name          string              `json:"name"`
+	User          User                `json:"user"`
+	Permissions   []Permission        `json:"permissions"`
+	Duration      string              `json:"duration"`
+	Justification string              `json:"justification"`
+	Status        AccessRequestStatus `json:"status"`
+	CreatedAt     time.Time           `json:"created_at"`
+	Reviewer      *User               `json:"reviewer,omitempty"`
+	ReviewedAt    *time.Time          `json:"reviewed_at,omitempty"`
+	ExpiresAt     *time.Time          `json:"expires_at,omitempty"`
+}
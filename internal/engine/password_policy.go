@@ -0,0 +1,242 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CharacterClass identifies a set of characters that may appear in a password.
+type CharacterClass string
+
+const (
+	// LowerClass contains lowercase letters.
+	LowerClass CharacterClass = "lower"
+	// UpperClass contains uppercase letters.
+	UpperClass CharacterClass = "upper"
+	// DigitClass contains the digits 0 through 9.
+	DigitClass CharacterClass = "digit"
+	// SymbolClass contains punctuation and other symbols.
+	SymbolClass CharacterClass = "symbol"
+)
+
+// CharacterClassValues defines the character classes in the order they're applied.
+var CharacterClassValues = []CharacterClass{LowerClass, UpperClass, DigitClass, SymbolClass}
+
+var characterClasses = map[CharacterClass]string{
+	LowerClass:  "abcdefghijklmnopqrstuvwxyz",
+	UpperClass:  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	DigitClass:  "0123456789",
+	SymbolClass: "!#$%&()*+,-./:;<=>?@[]^_{|}~",
+}
+
+const (
+	// defaultPolicyLength is used when a password policy doesn't specify a maximum length. It matches the length of
+	// passwords produced by the max template class.
+	defaultPolicyLength = 20
+	// maxPolicyLength bounds the length of passwords produced by a policy.
+	maxPolicyLength = 128
+)
+
+// PasswordPolicy describes the rules passwords for a service must follow. It's used in place of a template class
+// when the target system has requirements the template classes are unable to meet. Passwords are always generated at
+// the maximum length allowed by the policy.
+type PasswordPolicy struct {
+	Classes   string `json:"classes"    usage:"comma separated list of character classes passwords may contain [options: lower,upper,digit,symbol] (default: all)"`
+	Required  string `json:"required"   usage:"comma separated list of character classes passwords must contain at least one character from"`
+	MinLength int    `json:"min_length" usage:"the minimum length of the password"`
+	MaxLength int    `json:"max_length" usage:"the maximum length of the password (default: 20)"`
+	Exclude   string `json:"exclude"    usage:"characters that must never appear in the password (e.g. @:)"`
+}
+
+// IsZero returns true when no rules have been configured.
+func (p PasswordPolicy) IsZero() bool {
+	return p == PasswordPolicy{}
+}
+
+func parseCharacterClasses(value string) ([]CharacterClass, error) {
+	classes := make([]CharacterClass, 0)
+	seen := make(map[CharacterClass]bool)
+
+	for _, part := range strings.Split(value, ",") {
+		class := CharacterClass(strings.TrimSpace(part))
+
+		switch {
+		case class == "":
+			continue
+		case characterClasses[class] == "":
+			return nil, fmt.Errorf("unknown character class: %s", class)
+		case seen[class]:
+			continue
+		}
+
+		seen[class] = true
+		classes = append(classes, class)
+	}
+
+	return classes, nil
+}
+
+// compiledPolicy contains the character sets and length derived from a validated PasswordPolicy.
+type compiledPolicy struct {
+	length   int
+	allowed  string
+	required []string
+}
+
+func (p PasswordPolicy) compile() (*compiledPolicy, error) {
+	allowedClasses, err := parseCharacterClasses(p.Classes)
+	if err != nil {
+		return nil, err
+	} else if len(allowedClasses) == 0 {
+		allowedClasses = CharacterClassValues
+	}
+
+	requiredClasses, err := parseCharacterClasses(p.Required)
+	if err != nil {
+		return nil, err
+	}
+
+	charsets := make(map[CharacterClass]string)
+	compiled := &compiledPolicy{
+		length: p.MaxLength,
+	}
+
+	for _, class := range allowedClasses {
+		charset := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(p.Exclude, r) {
+				return -1
+			}
+			return r
+		}, characterClasses[class])
+
+		charsets[class] = charset
+		compiled.allowed += charset
+	}
+
+	for _, class := range requiredClasses {
+		charset, ok := charsets[class]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("required character class %s is not allowed", class)
+		case charset == "":
+			return nil, fmt.Errorf("all characters in required class %s are excluded", class)
+		}
+
+		compiled.required = append(compiled.required, charset)
+	}
+
+	if compiled.length == 0 {
+		compiled.length = defaultPolicyLength
+		if p.MinLength > compiled.length {
+			compiled.length = p.MinLength
+		}
+	}
+
+	switch {
+	case compiled.allowed == "":
+		return nil, fmt.Errorf("all allowed characters are excluded")
+	case p.MinLength < 0 || p.MaxLength < 0:
+		return nil, fmt.Errorf("lengths must not be negative")
+	case p.MinLength > compiled.length:
+		return nil, fmt.Errorf("min_length must not exceed max_length")
+	case compiled.length > maxPolicyLength:
+		return nil, fmt.Errorf("passwords may not be longer than %d characters", maxPolicyLength)
+	case len(compiled.required) > compiled.length:
+		return nil, fmt.Errorf("passwords are too short to contain every required character class")
+	}
+
+	return compiled, nil
+}
+
+// Validate ensures the policy is able to produce passwords.
+func (p PasswordPolicy) Validate() error {
+	_, err := p.compile()
+	return err
+}
+
+// Generate deterministically produces a password that satisfies the policy from the provided site key.
+func (p PasswordPolicy) Generate(siteKey []byte) ([]byte, error) {
+	compiled, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &keyStream{key: siteKey}
+	password := make([]byte, 0, compiled.length)
+
+	// start with a character from each required class, then fill the rest from any allowed class
+	for _, charset := range compiled.required {
+		password = append(password, charset[stream.intn(len(charset))])
+	}
+
+	for len(password) < compiled.length {
+		password = append(password, compiled.allowed[stream.intn(len(compiled.allowed))])
+	}
+
+	// shuffle so required characters don't always lead the password
+	for i := len(password) - 1; i > 0; i-- {
+		j := stream.intn(i + 1)
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return password, nil
+}
+
+// keyStream expands a site key into an arbitrarily long sequence of bytes using HMAC-SHA256 in counter mode. Since
+// policies may require more characters than the site key contains, the site key cannot be consumed directly the way
+// template classes do.
+type keyStream struct {
+	key   []byte
+	block uint32
+	buf   []byte
+}
+
+func (s *keyStream) next() byte {
+	if len(s.buf) == 0 {
+		seed := bytes.NewBuffer(nil)
+		seed.WriteString("varys.password_policy")
+		_ = binary.Write(seed, binary.BigEndian, s.block)
+
+		sig := hmac.New(sha256.New, s.key)
+		sig.Write(seed.Bytes())
+
+		s.buf = sig.Sum(nil)
+		s.block++
+	}
+
+	b := s.buf[0]
+	s.buf = s.buf[1:]
+
+	return b
+}
+
+// intn returns a uniformly distributed value in [0, n) for n <= 256, rejecting values that would bias the result.
+func (s *keyStream) intn(n int) int {
+	limit := 256 - (256 % n)
+
+	for {
+		if v := int(s.next()); v < limit {
+			return v % n
+		}
+	}
+}
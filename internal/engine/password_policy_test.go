@@ -0,0 +1,124 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/pass"
+)
+
+func siteKey(i uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, i)
+
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy PasswordPolicy
+		valid  bool
+	}{
+		{"defaults", PasswordPolicy{MaxLength: 16}, true},
+		{"unknown class", PasswordPolicy{Classes: "lower,emoji"}, false},
+		{"required class not allowed", PasswordPolicy{Classes: "lower", Required: "upper"}, false},
+		{"required class excluded", PasswordPolicy{Classes: "lower,digit", Required: "digit", Exclude: "0123456789"}, false},
+		{"min exceeds max", PasswordPolicy{MinLength: 20, MaxLength: 16}, false},
+		{"too long", PasswordPolicy{MaxLength: 1024}, false},
+		{"too short for required", PasswordPolicy{Required: "lower,upper,digit", MaxLength: 2}, false},
+		{"negative", PasswordPolicy{MinLength: -1}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.policy.Validate()
+			if testCase.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyGenerate(t *testing.T) {
+	policy := PasswordPolicy{
+		Classes:   "lower,upper,digit",
+		Required:  "upper,digit",
+		MaxLength: 16,
+		Exclude:   "@:0O",
+	}
+
+	for i := uint32(0); i < 256; i++ {
+		password, err := policy.Generate(siteKey(i))
+		require.NoError(t, err)
+
+		require.Len(t, password, 16)
+		require.True(t, strings.ContainsAny(string(password), characterClasses[UpperClass]), string(password))
+		require.True(t, strings.ContainsAny(string(password), characterClasses[DigitClass]), string(password))
+		require.False(t, strings.ContainsAny(string(password), characterClasses[SymbolClass]+"@:0O"), string(password))
+
+		// derivation must be deterministic
+		again, err := policy.Generate(siteKey(i))
+		require.NoError(t, err)
+		require.Equal(t, password, again)
+	}
+
+	// passwords default to the length of the max template class
+	password, err := PasswordPolicy{Classes: "lower"}.Generate(siteKey(0))
+	require.NoError(t, err)
+	require.Len(t, password, defaultPolicyLength)
+}
+
+func TestDeriveWithPasswordPolicy(t *testing.T) {
+	service := Service{
+		Kind:    "postgres",
+		Name:    "prod",
+		Address: "localhost:5432",
+		Key:     []byte("key"),
+		Templates: ServiceTemplates{
+			UserTemplate:     pass.Basic,
+			PasswordTemplate: pass.MaximumSecurity,
+		},
+	}
+
+	// services using template classes continue to derive the same passwords
+	withTemplate, err := derive("root", pass.Authentication, service, "user", 0)
+	require.NoError(t, err)
+	require.Equal(t, "E6]ScB4VTuajKnd4wfOX", string(withTemplate))
+
+	service.PasswordPolicy = &PasswordPolicy{Classes: "lower,digit", MaxLength: 12}
+
+	withPolicy, err := derive("root", pass.Authentication, service, "user", 0)
+	require.NoError(t, err)
+
+	require.Len(t, withPolicy, 12)
+	require.NotEqual(t, withTemplate, withPolicy)
+
+	// usernames continue to use the user template
+	username, err := derive("root", pass.Identification, service, "user", 0)
+	require.NoError(t, err)
+	require.Len(t, username, 8)
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// DefaultRootKeyVersion is the version assigned to the root key provided by --credential-root-key. Services created
+// before root keys were versioned derive their credentials from this version.
+const DefaultRootKeyVersion = "default"
+
+var (
+	// ErrEmptyRootKey is returned when the server is started without a root key.
+	ErrEmptyRootKey = errors.New("a root key is required to derive credentials")
+
+	// ErrRootKeyChanged is returned when the root key does not match the one the database was initialized with.
+	ErrRootKeyChanged = errors.New("root key does not match the one previously used by this database, all derived " +
+		"credentials would change")
+
+	// ErrUnknownRootKeyVersion is returned when a root key version is not present in the key ring.
+	ErrUnknownRootKeyVersion = errors.New("unknown root key version")
+)
+
+// KeyRing maps root key versions to the root key. Multiple versions allow credentials to be rolled over gradually by
+// re-pointing services from one version to another.
+type KeyRing map[string]string
+
+// ParseKeyRing builds a key ring from the default root key and additional versions formatted as version=key.
+func ParseKeyRing(root string, versions []string) (KeyRing, error) {
+	ring := KeyRing{DefaultRootKeyVersion: root}
+
+	for _, entry := range versions {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("root keys must be formatted as version=key")
+		}
+
+		if _, ok := ring[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate root key version: %s", parts[0])
+		}
+
+		ring[parts[0]] = parts[1]
+	}
+
+	return ring, nil
+}
+
+// Versions returns the sorted list of versions in the key ring.
+func (ring KeyRing) Versions() []string {
+	versions := make([]string, 0, len(ring))
+	for version := range ring {
+		versions = append(versions, version)
+	}
+
+	sort.Strings(versions)
+	return versions
+}
+
+// Get returns the root key for the provided version. An empty version refers to the DefaultRootKeyVersion.
+func (ring KeyRing) Get(version string) (string, error) {
+	if version == "" {
+		version = DefaultRootKeyVersion
+	}
+
+	key, ok := ring[version]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRootKeyVersion, version)
+	}
+
+	return key, nil
+}
+
+// rootKeyCanary is persisted on first boot and used to verify the root key on later boots. It holds a keyed
+// fingerprint of the root key rather than the key itself.
+type rootKeyCanary struct {
+	Salt        []byte `json:"salt"`
+	Fingerprint []byte `json:"fingerprint"`
+}
+
+func fingerprint(root string, salt []byte) []byte {
+	h := hmac.New(sha256.New, []byte(root))
+	_, _ = h.Write(salt)
+	return h.Sum(nil)
+}
+
+func newRootKeyCanary(root string) (*rootKeyCanary, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &rootKeyCanary{
+		Salt:        salt,
+		Fingerprint: fingerprint(root, salt),
+	}, nil
+}
+
+// VerifyRootKeys ensures each version in the key ring holds the same key it did previously. The first time a version
+// is seen, a fingerprint of its key is persisted. On later calls, ErrRootKeyChanged is returned if a key does not match
+// its fingerprint unless allowChange is set, in which case the fingerprint is replaced. The versions whose
+// fingerprints were replaced are returned.
+func VerifyRootKeys(db *badger.DB, ring KeyRing, allowChange bool) (changed []string, err error) {
+	store := &Store{db: db, prefix: "varys/canary"}
+
+	txn := &Txn{db.NewTransaction(true)}
+	defer txn.CommitOrDiscard(&err)
+
+	ctx := withTxn(context.Background(), txn)
+
+	for _, version := range ring.Versions() {
+		root := ring[version]
+		canary := &rootKeyCanary{}
+
+		err = store.Get(ctx, "root_key", version, canary)
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+		case err != nil:
+			return nil, err
+		case hmac.Equal(canary.Fingerprint, fingerprint(root, canary.Salt)):
+			continue
+		case !allowChange:
+			return nil, fmt.Errorf("%w (version: %s)", ErrRootKeyChanged, version)
+		default:
+			changed = append(changed, version)
+		}
+
+		canary, err = newRootKeyCanary(root)
+		if err != nil {
+			return nil, err
+		}
+
+		err = store.Put(ctx, "root_key", version, canary)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changed, nil
+}
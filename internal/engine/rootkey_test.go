@@ -0,0 +1,267 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+)
+
+func TestParseKeyRing(t *testing.T) {
+	ring, err := ParseKeyRing("root", []string{"v2=second", "v3=with=equals"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"default", "v2", "v3"}, ring.Versions())
+
+	key, err := ring.Get("")
+	require.NoError(t, err)
+	require.Equal(t, "root", key)
+
+	key, err = ring.Get("v3")
+	require.NoError(t, err)
+	require.Equal(t, "with=equals", key)
+
+	_, err = ring.Get("v4")
+	require.ErrorIs(t, err, ErrUnknownRootKeyVersion)
+
+	_, err = ParseKeyRing("root", []string{"v2"})
+	require.Error(t, err)
+
+	_, err = ParseKeyRing("root", []string{"default=other"})
+	require.Error(t, err)
+}
+
+func TestVerifyRootKeys(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// first boot persists the fingerprint
+	changed, err := VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "root"}, false)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	changed, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "root"}, false)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	_, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "wrong"}, false)
+	require.ErrorIs(t, err, ErrRootKeyChanged)
+
+	_, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: ""}, false)
+	require.ErrorIs(t, err, ErrRootKeyChanged)
+
+	// new versions are recorded as they're added
+	changed, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "root", "v2": "second"}, false)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	_, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "root", "v2": "wrong"}, false)
+	require.ErrorIs(t, err, ErrRootKeyChanged)
+
+	// explicitly allowing the change replaces the fingerprint
+	changed, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "new"}, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultRootKeyVersion}, changed)
+
+	_, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "root"}, false)
+	require.ErrorIs(t, err, ErrRootKeyChanged)
+
+	changed, err = VerifyRootKeys(db, KeyRing{DefaultRootKeyVersion: "new"}, false)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+}
+
+func TestRootKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.keys["v2"] = "second"
+
+	user := &User{Kind: "basic", ID: "user", Name: "user"}
+
+	for _, service := range []Service{
+		{Kind: "postgres", Name: "a"},
+		{Kind: "postgres", Name: "b"},
+		{Kind: "redis", Name: "c"},
+	} {
+		service.Address = service.Name
+		service.Key = []byte(service.Name)
+		service.Templates = ServiceTemplates{UserTemplate: pass.Basic, PasswordTemplate: pass.MaximumSecurity}
+
+		require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	}
+
+	require.NoError(t, api.CheckRootKeys(ctx))
+
+	version := func(kind, name string) string {
+		service := Service{}
+		require.NoError(t, api.services.Get(ctx, kind, name, &service))
+
+		return service.RootKeyVersion
+	}
+
+	derive := func(kind, name string) string {
+		service := Service{}
+		require.NoError(t, api.services.Get(ctx, kind, name, &service))
+
+		root, err := api.keys.Get(service.RootKeyVersion)
+		require.NoError(t, err)
+
+		credentials, err := Derive(root, service, user)
+		require.NoError(t, err)
+
+		return credentials.Password
+	}
+
+	before := derive("postgres", "a")
+
+	put := func(handler http.HandlerFunc, path string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+		data := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(data).Encode(body))
+
+		w := httptest.NewRecorder()
+		handler(w, mux.SetURLVars(httptest.NewRequest(http.MethodPut, path, data), vars))
+
+		return w
+	}
+
+	{ // activating a version does not change existing services
+		w := put(api.UpdateActiveRootKey, "/api/v1/root-keys/active", nil, UpdateActiveRootKeyRequest{Version: "v2"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = put(api.UpdateActiveRootKey, "/api/v1/root-keys/active", nil, UpdateActiveRootKeyRequest{Version: "v3"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		active, err := api.activeRootKeyVersion(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "v2", active)
+
+		require.Equal(t, "", version("postgres", "a"))
+	}
+
+	{ // migrate a single kind of service
+		w := put(api.MigrateServices, "/api/v1/root-keys/v2/services", map[string]string{"version": "v2"},
+			MigrateServicesRequest{Kind: "postgres"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		migrated := make([]Service, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&migrated))
+		require.Len(t, migrated, 2)
+
+		require.Equal(t, "v2", version("postgres", "a"))
+		require.Equal(t, "v2", version("postgres", "b"))
+		require.Equal(t, "", version("redis", "c"))
+
+		// credentials are now derived from the new version of the root key
+		require.NotEqual(t, before, derive("postgres", "a"))
+	}
+
+	{ // list
+		w := httptest.NewRecorder()
+		api.ListRootKeys(w, httptest.NewRequest(http.MethodGet, "/api/v1/root-keys", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		versions := make([]RootKeyVersion, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&versions))
+		require.Equal(t, []RootKeyVersion{
+			{Version: DefaultRootKeyVersion, Services: 1},
+			{Version: "v2", Active: true, Services: 2},
+		}, versions)
+	}
+
+	// retiring a version that's still in use is caught at startup
+	delete(api.keys, DefaultRootKeyVersion)
+	require.ErrorIs(t, api.CheckRootKeys(ctx), ErrUnknownRootKeyVersion)
+}
+
+func TestRootKeyMigrationGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.keys["v2"] = "second"
+	api.RotationGracePeriod = time.Hour
+
+	user := User{Kind: "basic", ID: "user", Name: "user"}
+	service := Service{
+		Kind:      "postgres",
+		Name:      "prod",
+		Address:   "localhost:5432",
+		Key:       []byte("key"),
+		Templates: ServiceTemplates{UserTemplate: pass.Basic, PasswordTemplate: pass.MaximumSecurity},
+	}
+	vars := map[string]string{"kind": service.Kind, "name": service.Name}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"read:postgres:prod"}, nil))
+
+	list := func() []UserCredential {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/credentials/postgres/prod", nil)
+		api.ListCredentials(w, mux.SetURLVars(r, vars))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		credentials := make([]UserCredential, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&credentials))
+
+		return credentials
+	}
+
+	migrate := func(version string, req MigrateServicesRequest) {
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(req))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/root-keys/"+version+"/services", body)
+		api.MigrateServices(w, mux.SetURLVars(r, map[string]string{"version": version}))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	before := list()
+	require.Len(t, before, 1)
+
+	migrate("v2", MigrateServicesRequest{})
+
+	// credentials derived from the previous version remain valid for the grace period
+	after := list()
+	require.Len(t, after, 2)
+	require.Nil(t, after[0].ExpiresAt)
+	require.NotEqual(t, before[0].Credentials, after[0].Credentials)
+	require.NotNil(t, after[1].ExpiresAt)
+	require.Equal(t, before[0].Credentials, after[1].Credentials)
+
+	// so the previous version can't be retired until the grace period ends
+	delete(api.keys, DefaultRootKeyVersion)
+	require.ErrorIs(t, api.CheckRootKeys(ctx), ErrUnknownRootKeyVersion)
+	api.keys[DefaultRootKeyVersion] = "root"
+
+	// unless the migration is immediate
+	migrate(DefaultRootKeyVersion, MigrateServicesRequest{Immediate: true})
+
+	immediate := list()
+	require.Len(t, immediate, 1)
+	require.Equal(t, before[0].Credentials, immediate[0].Credentials)
+}
@@ -0,0 +1,338 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// credentialVersion identifies a service key and counter pair that credentials are derived from.
+type credentialVersion struct {
+	service Service
+	counter uint32
+	// expiresAt is set for previous versions, indicating when they stop being valid.
+	expiresAt *time.Time
+}
+
+// credentialVersions returns the versions of the users' credentials for the service that are currently valid. The
+// current version is always returned first. When the service key or the users' counter were rotated recently, the
+// versions that were in use before the rotation follow it until their grace period ends.
+func credentialVersions(service Service, user *User, now time.Time) []credentialVersion {
+	counter := user.SiteCounters[service.K()]
+
+	versions := []credentialVersion{
+		{service: service, counter: counter},
+	}
+
+	var previousKey *time.Time
+
+	previous, ok := previousService(service, now)
+	if ok {
+		previousKey = service.PreviousKeyExpiresAt
+	}
+
+	var previousCounter *PreviousCounter
+	if prev, ok := user.PreviousSiteCounters[service.K()]; ok && now.Before(prev.ExpiresAt) {
+		previousCounter = &prev
+	}
+
+	switch {
+	case previousKey != nil && previousCounter != nil:
+		// both were rotated, so only include the combinations that were in use at some point in time
+		if previousKey.After(previousCounter.ExpiresAt) {
+			versions = append(versions,
+				credentialVersion{service: previous, counter: counter, expiresAt: previousKey},
+				credentialVersion{service: previous, counter: previousCounter.Counter, expiresAt: &previousCounter.ExpiresAt},
+			)
+		} else {
+			versions = append(versions,
+				credentialVersion{service: service, counter: previousCounter.Counter, expiresAt: &previousCounter.ExpiresAt},
+				credentialVersion{service: previous, counter: previousCounter.Counter, expiresAt: previousKey},
+			)
+		}
+	case previousKey != nil:
+		versions = append(versions, credentialVersion{service: previous, counter: counter, expiresAt: previousKey})
+	case previousCounter != nil:
+		versions = append(versions, credentialVersion{service: service, counter: previousCounter.Counter, expiresAt: &previousCounter.ExpiresAt})
+	}
+
+	return versions
+}
+
+// previousService returns the service as it was before its key was last rotated or its root key was last migrated.
+// It's only returned while the previous version is within its grace period.
+func previousService(service Service, now time.Time) (Service, bool) {
+	if service.PreviousKey == nil || service.PreviousKeyExpiresAt == nil || !now.Before(*service.PreviousKeyExpiresAt) {
+		return Service{}, false
+	}
+
+	previous := service
+	previous.Key = service.PreviousKey
+
+	if service.PreviousRootKeyVersion != "" {
+		previous.RootKeyVersion = service.PreviousRootKeyVersion
+	}
+
+	return previous, true
+}
+
+// gracePeriod returns how long the previous credentials remain valid after a rotation. Immediate rotations, such as
+// those made after a credential has leaked, invalidate the previous credentials right away.
+func (api *API) gracePeriod(immediate bool) time.Duration {
+	if immediate {
+		return 0
+	}
+
+	return api.RotationGracePeriod
+}
+
+// rotateServiceKey generates a new key for the service. Unless the rotation is immediate, the current key is retained
+// for the rotation grace period so credentials derived from it remain valid while workloads pick up their new
+// credentials. Rotating again before the grace period ends invalidates the previous key immediately.
+func (api *API) rotateServiceKey(service *Service, now time.Time, immediate bool) error {
+	key := make([]byte, len(service.Key))
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	api.retainPreviousVersion(service, now, immediate)
+
+	service.Key = key
+	service.LastRotatedAt = &now
+
+	return service.scheduleRotation(now)
+}
+
+// migrateRootKey re-points the service to derive credentials from the provided version of the root key. Like a
+// rotation of the service key, the current version is retained for the rotation grace period unless the migration is
+// immediate.
+func (api *API) migrateRootKey(service *Service, version string, now time.Time, immediate bool) {
+	current := service.RootKeyVersion
+	if current == "" {
+		current = DefaultRootKeyVersion
+	}
+
+	if current == version {
+		return
+	}
+
+	api.retainPreviousVersion(service, now, immediate)
+
+	if service.PreviousKey != nil {
+		service.PreviousRootKeyVersion = current
+	}
+
+	service.RootKeyVersion = version
+}
+
+// retainPreviousVersion records the key the service currently derives credentials from as its previous key, replacing
+// any earlier one, for the rotation grace period.
+func (api *API) retainPreviousVersion(service *Service, now time.Time, immediate bool) {
+	service.PreviousKey = nil
+	service.PreviousKeyExpiresAt = nil
+	service.PreviousRootKeyVersion = ""
+
+	if grace := api.gracePeriod(immediate); grace > 0 {
+		expiresAt := now.Add(grace)
+
+		service.PreviousKey = service.Key
+		service.PreviousKeyExpiresAt = &expiresAt
+	}
+}
+
+// rotateSiteCounter increments the users' counter for the service. Unless the rotation is immediate, the current
+// counter is retained for the rotation grace period.
+func (api *API) rotateSiteCounter(user *User, service Service, now time.Time, immediate bool) {
+	k := service.K()
+
+	if user.SiteCounters == nil {
+		user.SiteCounters = make(map[string]uint32)
+	}
+
+	if user.PreviousSiteCounters == nil {
+		user.PreviousSiteCounters = make(map[string]PreviousCounter)
+	}
+
+	delete(user.PreviousSiteCounters, k)
+
+	if grace := api.gracePeriod(immediate); grace > 0 {
+		user.PreviousSiteCounters[k] = PreviousCounter{
+			Counter:   user.SiteCounters[k],
+			ExpiresAt: now.Add(grace),
+		}
+	}
+
+	user.SiteCounters[k]++
+}
+
+// setRotationPeriod configures how frequently the service key is rotated automatically. An empty or zero period
+// disables automatic rotation.
+func (s *Service) setRotationPeriod(period string, now time.Time) error {
+	s.RotationPeriod = ""
+
+	if period != "" {
+		duration, err := time.ParseDuration(period)
+		switch {
+		case err != nil:
+			return err
+		case duration < 0:
+			return fmt.Errorf("rotation period must be positive")
+		case duration > 0:
+			s.RotationPeriod = duration.String()
+		}
+	}
+
+	since := now
+	if s.LastRotatedAt != nil {
+		since = *s.LastRotatedAt
+	}
+
+	return s.scheduleRotation(since)
+}
+
+// scheduleRotation computes when the service key should next be rotated, relative to the provided time.
+func (s *Service) scheduleRotation(since time.Time) error {
+	s.NextRotationAt = nil
+
+	if s.RotationPeriod == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(s.RotationPeriod)
+	if err != nil {
+		return err
+	}
+
+	next := since.Add(duration)
+	s.NextRotationAt = &next
+
+	return nil
+}
+
+// rotateService rotates the key of the service if it's due, returning whether the key was rotated.
+func (api *API) rotateService(ctx context.Context, kind, name string, now time.Time) (rotated bool, err error) {
+	txn := &Txn{api.db.NewTransaction(true)}
+	defer txn.CommitOrDiscard(&err)
+
+	ctx = withTxn(ctx, txn)
+
+	service := &Service{}
+
+	err = api.services.Get(ctx, kind, name, service)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		// deleted since it was listed
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	// the rotation may have been rescheduled since it was listed
+	if service.NextRotationAt == nil || now.Before(*service.NextRotationAt) {
+		return false, nil
+	}
+
+	if err = api.rotateServiceKey(service, now, false); err != nil {
+		return false, err
+	}
+
+	if err = api.services.Put(ctx, service.Kind, service.Name, service); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RotateServices rotates the key of every service whose rotation period has elapsed. Credentials derived from the
+// previous key remain valid for the rotation grace period.
+func (api *API) RotateServices(ctx context.Context, now time.Time) error {
+	log := zaputil.Extract(ctx)
+
+	services, err := api.services.List(ctx, Service{})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		service := s.(*Service)
+
+		if service.NextRotationAt == nil || now.Before(*service.NextRotationAt) {
+			continue
+		}
+
+		rotated, err := api.rotateService(ctx, service.Kind, service.Name, now)
+		if err == nil && !rotated {
+			continue
+		}
+
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		} else {
+			log.Info("rotated service key",
+				zap.String("kind", service.Kind),
+				zap.String("name", service.Name),
+				zap.String("rotation_period", service.RotationPeriod))
+		}
+
+		_, auditErr := api.audit.Append(AuditEntry{
+			Timestamp: time.Now(),
+			Actor:     "varys",
+			Action:    "services.rotate",
+			Target:    service.K(),
+			Outcome:   outcome,
+		})
+		if auditErr != nil {
+			log.Error("failed to append audit entry", zap.Error(auditErr))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunRotationScheduler periodically rotates the keys of services with a rotation period until the provided context is
+// canceled.
+func (api *API) RunRotationScheduler(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := api.RotateServices(ctx, time.Now())
+		if err != nil {
+			zaputil.Extract(ctx).Error("failed to rotate services", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/myago/encoding"
+	"github.com/mjpitz/myago/pass"
+)
+
+func TestCredentialVersions(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(time.Hour)
+	later := now.Add(2 * time.Hour)
+	past := now.Add(-time.Hour)
+
+	current := []byte("current")
+	previous := []byte("previous")
+
+	type version struct {
+		key     string
+		counter uint32
+	}
+
+	testCases := []struct {
+		name            string
+		keyExpiresAt    *time.Time
+		previousCounter *PreviousCounter
+		expected        []version
+	}{
+		{
+			name:     "no rotation",
+			expected: []version{{"current", 2}},
+		},
+		{
+			name:         "key rotated",
+			keyExpiresAt: &soon,
+			expected:     []version{{"current", 2}, {"previous", 2}},
+		},
+		{
+			name:            "counter rotated",
+			previousCounter: &PreviousCounter{Counter: 1, ExpiresAt: soon},
+			expected:        []version{{"current", 2}, {"current", 1}},
+		},
+		{
+			name:            "counter rotated then key rotated",
+			keyExpiresAt:    &later,
+			previousCounter: &PreviousCounter{Counter: 1, ExpiresAt: soon},
+			expected:        []version{{"current", 2}, {"previous", 2}, {"previous", 1}},
+		},
+		{
+			name:            "key rotated then counter rotated",
+			keyExpiresAt:    &soon,
+			previousCounter: &PreviousCounter{Counter: 1, ExpiresAt: later},
+			expected:        []version{{"current", 2}, {"current", 1}, {"previous", 1}},
+		},
+		{
+			name:            "grace period ended",
+			keyExpiresAt:    &past,
+			previousCounter: &PreviousCounter{Counter: 1, ExpiresAt: past},
+			expected:        []version{{"current", 2}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := Service{Kind: "postgres", Name: "prod", Key: current}
+			user := &User{SiteCounters: map[string]uint32{service.K(): 2}}
+
+			if testCase.keyExpiresAt != nil {
+				service.PreviousKey = previous
+				service.PreviousKeyExpiresAt = testCase.keyExpiresAt
+			}
+
+			if testCase.previousCounter != nil {
+				user.PreviousSiteCounters = map[string]PreviousCounter{service.K(): *testCase.previousCounter}
+			}
+
+			actual := make([]version, 0)
+			for i, v := range credentialVersions(service, user, now) {
+				require.Equal(t, i > 0, v.expiresAt != nil)
+				actual = append(actual, version{string(v.service.Key), v.counter})
+			}
+
+			require.Equal(t, testCase.expected, actual)
+		})
+	}
+}
+
+func TestRotateWithoutGracePeriod(t *testing.T) {
+	api := &API{}
+	now := time.Now()
+
+	service := &Service{Kind: "postgres", Name: "prod", Key: []byte("current")}
+	require.NoError(t, api.rotateServiceKey(service, now, false))
+	require.NotEqual(t, []byte("current"), service.Key)
+	require.Nil(t, service.PreviousKey)
+
+	user := &User{}
+	api.rotateSiteCounter(user, *service, now, false)
+	require.Equal(t, uint32(1), user.SiteCounters[service.K()])
+	require.Len(t, user.PreviousSiteCounters, 0)
+}
+
+func TestListCredentialsDuringGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.RotationGracePeriod = time.Hour
+
+	user := User{Kind: "basic", ID: "user", Name: "user", SiteCounters: map[string]uint32{}}
+	service := Service{
+		Kind:    "postgres",
+		Name:    "prod",
+		Address: "localhost:5432",
+		Key:     []byte("key"),
+		Templates: ServiceTemplates{
+			UserTemplate:     pass.Basic,
+			PasswordTemplate: pass.MaximumSecurity,
+		},
+	}
+
+	require.NoError(t, api.services.Put(ctx, service.Kind, service.Name, service))
+	require.NoError(t, api.users.Put(ctx, user.Kind, user.ID, user))
+	require.NoError(t, api.grant(ctx, user.K(), []string{"read:postgres:prod"}, nil))
+
+	list := func() []UserCredential {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/credentials/postgres/prod", nil)
+		api.ListCredentials(w, mux.SetURLVars(r, map[string]string{"kind": service.Kind, "name": service.Name}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		credentials := make([]UserCredential, 0)
+		require.NoError(t, encoding.JSON.Decoder(w.Body).Decode(&credentials))
+
+		return credentials
+	}
+
+	before := list()
+	require.Len(t, before, 1)
+	require.Nil(t, before[0].ExpiresAt)
+
+	{
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UpdateUserRequest{RotateService: service}))
+
+		w := httptest.NewRecorder()
+		api.UpdateCurrentUser(w, httptest.NewRequest(http.MethodPut, "/api/v1/users/self", body).
+			WithContext(withUser(ctx, user)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	after := list()
+	require.Len(t, after, 2)
+
+	// the new credential is returned first, followed by the previous one until the grace period ends
+	require.Nil(t, after[0].ExpiresAt)
+	require.NotEqual(t, before[0].Credentials, after[0].Credentials)
+
+	require.NotNil(t, after[1].ExpiresAt)
+	require.Equal(t, before[0].Credentials, after[1].Credentials)
+	require.Equal(t, before[0].Permission, after[1].Permission)
+
+	// immediate rotations invalidate the previous credentials right away
+	{
+		require.NoError(t, api.users.Get(ctx, user.Kind, user.ID, &user))
+
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UpdateUserRequest{RotateService: service, Immediate: true}))
+
+		w := httptest.NewRecorder()
+		api.UpdateCurrentUser(w, httptest.NewRequest(http.MethodPut, "/api/v1/users/self", body).
+			WithContext(withUser(ctx, user)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	rotated := list()
+	require.Len(t, rotated, 1)
+	require.Nil(t, rotated[0].ExpiresAt)
+	require.NotEqual(t, after[0].Credentials, rotated[0].Credentials)
+
+	{
+		body := bytes.NewBuffer(nil)
+		require.NoError(t, encoding.JSON.Encoder(body).Encode(UpdateServiceRequest{RotateKey: true, Immediate: true}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/services/postgres/prod", body)
+		api.UpdateService(w, mux.SetURLVars(r, map[string]string{"kind": service.Kind, "name": service.Name}))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	final := list()
+	require.Len(t, final, 1)
+	require.Nil(t, final[0].ExpiresAt)
+	require.NotEqual(t, rotated[0].Credentials, final[0].Credentials)
+}
+
+func TestRotateServices(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	api.RotationGracePeriod = time.Hour
+
+	now := time.Now()
+
+	scheduled := &Service{Kind: "postgres", Name: "scheduled", Key: []byte("scheduled")}
+	require.NoError(t, scheduled.setRotationPeriod("720h", now))
+	require.Equal(t, "720h0m0s", scheduled.RotationPeriod)
+	require.Equal(t, now.Add(720*time.Hour), *scheduled.NextRotationAt)
+
+	manual := &Service{Kind: "postgres", Name: "manual", Key: []byte("manual")}
+	require.NoError(t, manual.setRotationPeriod("", now))
+	require.Nil(t, manual.NextRotationAt)
+
+	require.Error(t, manual.setRotationPeriod("-1h", now))
+
+	require.NoError(t, api.services.Put(ctx, scheduled.Kind, scheduled.Name, scheduled))
+	require.NoError(t, api.services.Put(ctx, manual.Kind, manual.Name, manual))
+
+	get := func(service *Service) Service {
+		actual := Service{}
+		require.NoError(t, api.services.Get(ctx, service.Kind, service.Name, &actual))
+		return actual
+	}
+
+	// nothing is due yet
+	require.NoError(t, api.RotateServices(ctx, now.Add(24*time.Hour)))
+	require.Equal(t, []byte("scheduled"), get(scheduled).Key)
+
+	rotatedAt := now.Add(721 * time.Hour)
+	require.NoError(t, api.RotateServices(ctx, rotatedAt))
+
+	actual := get(scheduled)
+	require.NotEqual(t, []byte("scheduled"), actual.Key)
+	require.Equal(t, []byte("scheduled"), actual.PreviousKey)
+	require.True(t, rotatedAt.Equal(*actual.LastRotatedAt))
+	require.True(t, rotatedAt.Add(720*time.Hour).Equal(*actual.NextRotationAt))
+
+	require.Equal(t, []byte("manual"), get(manual).Key)
+
+	entries, err := api.audit.List(AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "services.rotate", entries[0].Action)
+	require.Equal(t, scheduled.K(), entries[0].Target)
+}
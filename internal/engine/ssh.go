@@ -0,0 +1,175 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mjpitz/myago/pass"
+)
+
+// deriveSSHKey deterministically produces an ed25519 key pair from the provided site key. Keys are derived from the
+// same site key as the password, so rotating the password also rotates the key pair.
+func deriveSSHKey(siteKey []byte) ed25519.PrivateKey {
+	sig := hmac.New(sha256.New, siteKey)
+	sig.Write([]byte("varys.ssh_key"))
+
+	return ed25519.NewKeyFromSeed(sig.Sum(nil))
+}
+
+// marshalAuthorizedKey formats the public key as a single authorized_keys line.
+func marshalAuthorizedKey(key ed25519.PrivateKey, comment string) (string, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	if comment != "" {
+		line += " " + comment
+	}
+
+	return line, nil
+}
+
+// marshalOpenSSHPrivateKey encodes the private key using the unencrypted openssh-key-v1 format, which is what
+// ssh-keygen produces by default and what ssh and ssh-add expect to load.
+func marshalOpenSSHPrivateKey(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// check bytes are normally random, but are derived from the key so the output stays deterministic
+	check := binary.BigEndian.Uint32(key.Seed())
+
+	block := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		Check1:  check,
+		Check2:  check,
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     key.Public().(ed25519.PublicKey),
+		Priv:    key,
+		Comment: comment,
+	})
+
+	for i := byte(1); len(block)%8 != 0; i++ {
+		block = append(block, i)
+	}
+
+	data := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       publicKey.Marshal(),
+		PrivKeyBlock: block,
+	})
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), data...),
+	}), nil
+}
+
+// DefaultSSHExtensions are the extensions granted to SSH certificates when the service doesn't configure any.
+var DefaultSSHExtensions = []string{"permit-pty"}
+
+// sshExtensions contains the certificate extensions understood by OpenSSH.
+var sshExtensions = map[string]bool{
+	"permit-X11-forwarding":   true,
+	"permit-agent-forwarding": true,
+	"permit-port-forwarding":  true,
+	"permit-pty":              true,
+	"permit-user-rc":          true,
+}
+
+// parseSSHExtensions parses a comma separated list of certificate extensions, rejecting any that OpenSSH doesn't
+// understand.
+func parseSSHExtensions(value string) ([]string, error) {
+	extensions := make([]string, 0)
+
+	for _, extension := range strings.Split(value, ",") {
+		extension = strings.TrimSpace(extension)
+		if extension == "" {
+			continue
+		}
+
+		if !sshExtensions[extension] {
+			return nil, fmt.Errorf("unsupported ssh extension: %s", extension)
+		}
+
+		extensions = append(extensions, extension)
+	}
+
+	if len(extensions) == 0 {
+		return nil, fmt.Errorf("no ssh extensions provided")
+	}
+
+	return extensions, nil
+}
+
+// certificateExtensions returns the extensions granted to SSH certificates issued for the service.
+func (s Service) certificateExtensions() map[string]string {
+	extensions := s.SSHExtensions
+	if len(extensions) == 0 {
+		extensions = DefaultSSHExtensions
+	}
+
+	permissions := make(map[string]string, len(extensions))
+	for _, extension := range extensions {
+		permissions[extension] = ""
+	}
+
+	return permissions
+}
+
+// deriveSSHCAKey deterministically produces the key used to sign SSH certificates for the service. The key is derived
+// from the root key and the service key, so rotating the service key also rotates the certificate authority. Hosts
+// need to trust the new certificate authority before the previous one stops being served at the end of the grace
+// period.
+func deriveSSHCAKey(root string, service Service) (ed25519.PrivateKey, error) {
+	key, err := pass.Identity(pass.Authentication, service.Key, root)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := hmac.New(sha256.New, key)
+	sig.Write([]byte("varys.ssh_ca"))
+
+	return ed25519.NewKeyFromSeed(sig.Sum(nil)), nil
+}
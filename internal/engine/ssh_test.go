@@ -0,0 +1,98 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mjpitz/myago/pass"
+)
+
+func TestSSHKeyEncoding(t *testing.T) {
+	key := deriveSSHKey(siteKey(0))
+	require.Equal(t, key, deriveSSHKey(siteKey(0)))
+	require.NotEqual(t, key, deriveSSHKey(siteKey(1)))
+
+	privateKey, err := marshalOpenSSHPrivateKey(key, "user")
+	require.NoError(t, err)
+
+	parsed, err := ssh.ParseRawPrivateKey(privateKey)
+	require.NoError(t, err)
+	require.Equal(t, key, *parsed.(*ed25519.PrivateKey))
+
+	authorizedKey, err := marshalAuthorizedKey(key, "user")
+	require.NoError(t, err)
+
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	require.NoError(t, err)
+	require.Equal(t, "user", comment)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey().Marshal(), publicKey.Marshal())
+}
+
+func TestDeriveSSHKey(t *testing.T) {
+	service := Service{
+		Kind:    "ssh",
+		Name:    "bastion",
+		Address: "bastion.example.com",
+		Key:     []byte("key"),
+		Templates: ServiceTemplates{
+			UserTemplate:     pass.Basic,
+			PasswordTemplate: pass.MaximumSecurity,
+		},
+	}
+
+	credentials, err := deriveCredentials("root", service, "user", 0)
+	require.NoError(t, err)
+	require.Empty(t, credentials.PublicKey)
+	require.Empty(t, credentials.PrivateKey)
+
+	service.SSHKey = true
+
+	withKey, err := deriveCredentials("root", service, "user", 0)
+	require.NoError(t, err)
+	require.Equal(t, credentials.Username, withKey.Username)
+	require.Equal(t, credentials.Password, withKey.Password)
+
+	key, err := ssh.ParsePrivateKey([]byte(withKey.PrivateKey))
+	require.NoError(t, err)
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(withKey.PublicKey))
+	require.NoError(t, err)
+	require.Equal(t, key.PublicKey().Marshal(), publicKey.Marshal())
+}
+
+func TestParseSSHExtensions(t *testing.T) {
+	extensions, err := parseSSHExtensions("permit-pty, permit-port-forwarding")
+	require.NoError(t, err)
+	require.Equal(t, []string{"permit-pty", "permit-port-forwarding"}, extensions)
+
+	_, err = parseSSHExtensions("permit-everything")
+	require.Error(t, err)
+
+	_, err = parseSSHExtensions(",")
+	require.Error(t, err)
+
+	require.Equal(t, map[string]string{"permit-pty": ""}, Service{}.certificateExtensions())
+	require.Equal(t, map[string]string{"permit-user-rc": ""}, Service{SSHExtensions: []string{"permit-user-rc"}}.certificateExtensions())
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// totpDigits and totpPeriod use the defaults from RFC 6238, which are the only values supported by most
+	// authenticator apps.
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+)
+
+// deriveTOTPSecret deterministically produces a TOTP secret from the provided site key. Secrets are derived from the
+// same site key as the password, so rotating the password also rotates the secret.
+func deriveTOTPSecret(siteKey []byte) []byte {
+	sig := hmac.New(sha256.New, siteKey)
+	sig.Write([]byte("varys.totp"))
+
+	// RFC 4226 recommends 160 bit secrets
+	return sig.Sum(nil)[:20]
+}
+
+// totpCode computes the code for the time step containing t as described by RFC 6238.
+func totpCode(secret []byte, t time.Time) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/int64(totpPeriod.Seconds())))
+
+	sig := hmac.New(sha1.New, secret)
+	sig.Write(counter)
+	sum := sig.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// totpExpiresAt returns when the code for the time step containing t stops being valid.
+func totpExpiresAt(t time.Time) time.Time {
+	return t.Truncate(totpPeriod).Add(totpPeriod)
+}
+
+// totpIssuer returns the issuer that authenticator apps display alongside codes for the service.
+func totpIssuer(service Service) string {
+	return "varys " + service.Kind + "/" + service.Name
+}
+
+// totpURI formats the secret as an otpauth:// URI which authenticator apps and connectors can use to enroll.
+func totpURI(secret []byte, issuer, account string) string {
+	params := url.Values{}
+	params.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+
+	// the label is built manually so slashes within the issuer and account are escaped
+	return "otpauth://totp/" + url.PathEscape(issuer) + ":" + url.PathEscape(account) + "?" + params.Encode()
+}
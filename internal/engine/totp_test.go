@@ -0,0 +1,62 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238, truncated to six digits
+	secret := []byte("12345678901234567890")
+
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, testCase := range testCases {
+		require.Equal(t, testCase.code, totpCode(secret, time.Unix(testCase.unix, 0)))
+	}
+
+	require.Equal(t, time.Unix(60, 0), totpExpiresAt(time.Unix(59, 0)))
+	require.Equal(t, time.Unix(90, 0), totpExpiresAt(time.Unix(60, 0)))
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(totpURI([]byte("12345678901234567890"), "varys postgres/primary", "user"))
+	require.NoError(t, err)
+
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/varys%20postgres%2Fprimary:user", uri.EscapedPath())
+	require.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	require.Equal(t, "varys postgres/primary", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+	require.Equal(t, "30", uri.Query().Get("period"))
+}
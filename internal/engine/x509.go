@@ -0,0 +1,89 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/mjpitz/myago/pass"
+)
+
+// deriveCAKey deterministically produces the ed25519 key used to issue client certificates for the service. The key is
+// derived from the root key and the service key, so rotating the service key also rotates the certificate authority.
+// Services need to trust the new certificate authority before the previous one stops being served at the end of the
+// grace period.
+func deriveCAKey(root string, service Service) (ed25519.PrivateKey, error) {
+	key, err := pass.Identity(pass.Authentication, service.Key, root)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := hmac.New(sha256.New, key)
+	sig.Write([]byte("varys.x509_ca"))
+
+	return ed25519.NewKeyFromSeed(sig.Sum(nil)), nil
+}
+
+// subjectKeyID computes the subject key identifier for the public key using the method described in RFC 5280.
+func subjectKeyID(pub ed25519.PublicKey) []byte {
+	sum := sha1.Sum(pub)
+	return sum[:]
+}
+
+// newCACertificate produces the self-signed certificate for the services' certificate authority. Every field is
+// derived from the service and ed25519 signatures are deterministic, so every request produces the same certificate.
+func newCACertificate(service Service, key ed25519.PrivateKey) (*x509.Certificate, error) {
+	public := key.Public().(ed25519.PublicKey)
+	ski := subjectKeyID(public)
+
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(ski),
+		Subject: pkix.Name{
+			Organization:       []string{"varys"},
+			OrganizationalUnit: []string{service.Kind},
+			CommonName:         service.Kind + "/" + service.Name,
+		},
+		// certificate authorities are valid until their key is rotated
+		NotBefore:             time.Unix(0, 0).UTC(),
+		NotAfter:              time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          ski,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+func encodeCertificate(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
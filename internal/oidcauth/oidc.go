@@ -0,0 +1,113 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package oidcauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/auth"
+	myagooidc "github.com/mjpitz/myago/auth/oidc"
+	"github.com/mjpitz/myago/headers"
+	"github.com/mjpitz/myago/lazy"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// Config defines the options used to validate OIDC bearer tokens issued to clients of varys.
+type Config struct {
+	Issuer   myagooidc.Issuer `json:"issuer"`
+	ClientID string           `json:"client_id" usage:"the client_id (audience) that bearer tokens must be issued to"`
+}
+
+// claims defines the additional claims we fall back on when the standard profile claim is not present on the token.
+type claims struct {
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Handler returns an auth.HandlerFunc that verifies OIDC bearer tokens. Issuer discovery happens lazily on the first
+// request, allowing the server to start while the identity provider is unavailable. Signing keys are cached and
+// refreshed when a token is presented with an unrecognized key id, allowing the issuer to rotate keys freely.
+func Handler(ctx context.Context, cfg Config) (auth.HandlerFunc, error) {
+	if cfg.Issuer.ServerURL == "" {
+		return nil, fmt.Errorf("missing oidc issuer server_url")
+	}
+
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("missing oidc client_id")
+	}
+
+	verifierOnce := &lazy.Once{
+		Loader: func() (*oidc.IDTokenVerifier, error) {
+			// use the long-lived context here since the provider uses it to refresh keys
+			provider, err := cfg.Issuer.Provider(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return provider.Verifier(&oidc.Config{
+				ClientID: cfg.ClientID,
+			}), nil
+		},
+	}
+
+	return func(ctx context.Context) (context.Context, error) {
+		header := headers.Extract(ctx)
+		log := zaputil.Extract(ctx)
+
+		token, err := auth.Get(header, "bearer")
+		if err != nil {
+			return ctx, nil
+		}
+
+		verifier, err := verifierOnce.Get(ctx)
+		if err != nil {
+			log.Error("failed to discover oidc issuer", zap.Error(err))
+			return nil, fmt.Errorf("failed to discover oidc issuer")
+		}
+
+		idToken, err := verifier.(*oidc.IDTokenVerifier).Verify(ctx, token)
+		if err != nil {
+			log.Debug("failed to verify bearer token", zap.Error(err))
+			return nil, auth.ErrUnauthorized
+		}
+
+		userInfo := auth.UserInfo{}
+		extra := claims{}
+
+		if err = idToken.Claims(&userInfo); err != nil {
+			return nil, auth.ErrUnauthorized
+		}
+
+		if err = idToken.Claims(&extra); err != nil {
+			return nil, auth.ErrUnauthorized
+		}
+
+		if userInfo.Profile == "" {
+			userInfo.Profile = extra.PreferredUsername
+		}
+
+		if userInfo.Subject == "" || userInfo.Profile == "" {
+			log.Debug("bearer token missing required claims")
+			return nil, auth.ErrUnauthorized
+		}
+
+		return auth.ToContext(ctx, userInfo), nil
+	}, nil
+}
@@ -0,0 +1,208 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package oidcauth_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/mjpitz/myago/auth"
+	myagooidc "github.com/mjpitz/myago/auth/oidc"
+	"github.com/mjpitz/myago/headers"
+	"github.com/mjpitz/varys/internal/oidcauth"
+)
+
+// issuer is a local stand-in for an OIDC identity provider. It supports discovery, serves its public keys, and can
+// rotate the key used to sign tokens.
+type issuer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+}
+
+func newIssuer(t *testing.T) *issuer {
+	i := &issuer{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                i.URL,
+			"authorization_endpoint":                i.URL + "/authorize",
+			"token_endpoint":                        i.URL + "/token",
+			"jwks_uri":                              i.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		set := jose.JSONWebKeySet{}
+		for _, key := range i.keys {
+			set.Keys = append(set.Keys, key.Public())
+		}
+
+		_ = json.NewEncoder(w).Encode(set)
+	})
+
+	i.Server = httptest.NewServer(mux)
+	t.Cleanup(i.Server.Close)
+
+	i.rotate(t, "key-1")
+	return i
+}
+
+func (i *issuer) rotate(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keys = []jose.JSONWebKey{{Key: key, KeyID: kid, Algorithm: "RS256", Use: "sig"}}
+}
+
+func (i *issuer) sign(t *testing.T, claims map[string]interface{}) string {
+	i.mu.Lock()
+	key := i.keys[0]
+	i.mu.Unlock()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	require.NoError(t, err)
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func (i *issuer) claims(audience string, expiry time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":     i.URL,
+		"aud":     audience,
+		"sub":     "CACF1875-7B44-4B77-BF52-51A06E52FFDF",
+		"profile": "jane",
+		"groups":  []string{"admin:varys"},
+		"iat":     time.Now().Unix(),
+		"exp":     expiry.Unix(),
+	}
+}
+
+func authenticate(t *testing.T, handler auth.HandlerFunc, token string) (*auth.UserInfo, error) {
+	header := headers.New()
+	if token != "" {
+		header.Set("authorization", "Bearer "+token)
+	}
+
+	ctx, err := handler(headers.ToContext(context.Background(), header))
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.Extract(ctx), nil
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newIssuer(t)
+
+	handler, err := oidcauth.Handler(context.Background(), oidcauth.Config{
+		Issuer: myagooidc.Issuer{
+			ServerURL: idp.URL,
+		},
+		ClientID: "varys",
+	})
+	require.NoError(t, err)
+
+	t.Run("missing token", func(t *testing.T) {
+		userInfo, err := authenticate(t, handler, "")
+		require.NoError(t, err)
+		require.Nil(t, userInfo)
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		token := idp.sign(t, idp.claims("varys", time.Now().Add(time.Hour)))
+
+		userInfo, err := authenticate(t, handler, token)
+		require.NoError(t, err)
+		require.NotNil(t, userInfo)
+		require.Equal(t, "CACF1875-7B44-4B77-BF52-51A06E52FFDF", userInfo.Subject)
+		require.Equal(t, "jane", userInfo.Profile)
+		require.Equal(t, []string{"admin:varys"}, userInfo.Groups)
+	})
+
+	t.Run("preferred username", func(t *testing.T) {
+		claims := idp.claims("varys", time.Now().Add(time.Hour))
+		delete(claims, "profile")
+		claims["preferred_username"] = "jane.doe"
+
+		userInfo, err := authenticate(t, handler, idp.sign(t, claims))
+		require.NoError(t, err)
+		require.Equal(t, "jane.doe", userInfo.Profile)
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		token := idp.sign(t, idp.claims("not-varys", time.Now().Add(time.Hour)))
+
+		_, err := authenticate(t, handler, token)
+		require.ErrorIs(t, err, auth.ErrUnauthorized)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		token := idp.sign(t, idp.claims("varys", time.Now().Add(-time.Minute)))
+
+		_, err := authenticate(t, handler, token)
+		require.ErrorIs(t, err, auth.ErrUnauthorized)
+	})
+
+	t.Run("wrong issuer", func(t *testing.T) {
+		claims := idp.claims("varys", time.Now().Add(time.Hour))
+		claims["iss"] = "https://example.com"
+
+		_, err := authenticate(t, handler, idp.sign(t, claims))
+		require.ErrorIs(t, err, auth.ErrUnauthorized)
+	})
+
+	t.Run("rotated keys", func(t *testing.T) {
+		old := idp.sign(t, idp.claims("varys", time.Now().Add(time.Hour)))
+		idp.rotate(t, "key-2")
+
+		token := idp.sign(t, idp.claims("varys", time.Now().Add(time.Hour)))
+
+		userInfo, err := authenticate(t, handler, token)
+		require.NoError(t, err)
+		require.Equal(t, "jane", userInfo.Profile)
+
+		_, err = authenticate(t, handler, old)
+		require.ErrorIs(t, err, auth.ErrUnauthorized)
+	})
+}
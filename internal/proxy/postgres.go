@@ -0,0 +1,410 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/mjpitz/varys/internal/drivers"
+	"github.com/mjpitz/varys/internal/scram"
+)
+
+const (
+	pgProtocolVersion = 196608
+	pgCancelRequest   = 80877102
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+
+	pgAuthOK                = 0
+	pgAuthCleartextPassword = 3
+	pgAuthMD5Password       = 5
+	pgAuthSASL              = 10
+	pgAuthSASLContinue      = 11
+	pgAuthSASLFinal         = 12
+
+	pgMaxStartupLength = 10000
+)
+
+// Postgres proxies connections using the PostgreSQL wire protocol. The user provided by the client is replaced with
+// the upstream username, and the proxy completes the cleartext, md5, or SCRAM-SHA-256 authentication exchange on the
+// clients' behalf. When a token is required, the client must provide it as their password first. Encryption is not
+// offered to the client (which is expected to be local), but is required with the upstream unless the services'
+// address sets sslmode=disable. Otherwise, an attacker could downgrade the connection to observe the password.
+type Postgres struct {
+	// TLSConfig is used when the upstream supports encryption. When nil, the certificate is verified against the
+	// system roots using the upstreams' host name.
+	TLSConfig *tls.Config
+}
+
+func (p Postgres) Handle(ctx context.Context, client net.Conn, upstream Upstream) error {
+	code, body, err := readStartup(client)
+	if err != nil {
+		return err
+	}
+
+	// the client may ask to negotiate encryption multiple times before sending the startup message
+	for code == pgSSLRequest || code == pgGSSENCRequest {
+		if _, err = client.Write([]byte{'N'}); err != nil {
+			return err
+		}
+
+		if code, body, err = readStartup(client); err != nil {
+			return err
+		}
+	}
+
+	switch code {
+	case pgCancelRequest:
+		conn, _, err := p.dial(ctx, upstream)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(startupMessage(code, body))
+		return err
+	case pgProtocolVersion:
+	default:
+		return fmt.Errorf("postgres: unsupported protocol version %d", code)
+	}
+
+	params, err := parseParams(body)
+	if err != nil {
+		return err
+	}
+
+	params = setParam(params, "user", upstream.Username)
+
+	if err = authenticateClient(client, upstream); err != nil {
+		return err
+	}
+
+	conn, reader, err := p.dial(ctx, upstream)
+	if err != nil {
+		_ = writeError(client, "08006", "failed to connect to upstream: "+err.Error())
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(startupMessage(pgProtocolVersion, encodeParams(params))); err != nil {
+		return err
+	}
+
+	if err = authenticate(conn, reader, client, upstream); err != nil {
+		return err
+	}
+
+	return pipe(client, reader, conn)
+}
+
+// sslDisabled reports whether the address explicitly disables encryption using the sslmode parameter.
+func sslDisabled(address string) bool {
+	if !strings.Contains(address, "://") {
+		return false
+	}
+
+	u, err := url.Parse(address)
+	return err == nil && u.Query().Get("sslmode") == "disable"
+}
+
+// dial connects to the upstream and upgrades the connection to TLS, failing if the server does not support it.
+func (p Postgres) dial(ctx context.Context, upstream Upstream) (net.Conn, *bufio.Reader, error) {
+	host, port, _ := drivers.ParseAddress(upstream.Address, "5432")
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sslDisabled(upstream.Address) {
+		return conn, bufio.NewReader(conn), nil
+	}
+
+	if _, err = conn.Write(startupMessage(pgSSLRequest, nil)); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	resp := make([]byte, 1)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	if resp[0] != 'S' {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("postgres: upstream does not support encryption (set sslmode=disable to allow it)")
+	}
+
+	config := p.TLSConfig
+	if config == nil {
+		config = &tls.Config{ServerName: host}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return tlsConn, bufio.NewReader(tlsConn), nil
+}
+
+// authenticateClient requests a cleartext password from the client and ensures it matches the token required by the
+// upstream. Nothing is requested when no token is required.
+func authenticateClient(client net.Conn, upstream Upstream) error {
+	if upstream.Token == "" {
+		return nil
+	}
+
+	request := make([]byte, 4)
+	binary.BigEndian.PutUint32(request, pgAuthCleartextPassword)
+
+	if _, err := client.Write(message('R', request)); err != nil {
+		return err
+	}
+
+	kind, msg, err := readMessage(client)
+	if err != nil {
+		return err
+	}
+
+	if kind != 'p' || !upstream.validToken(strings.TrimSuffix(string(msg), "\x00")) {
+		_ = writeError(client, "28P01", "invalid token")
+		return fmt.Errorf("postgres: client provided an invalid token")
+	}
+
+	return nil
+}
+
+// authenticate completes the authentication exchange with the upstream. Once authenticated, the AuthenticationOk
+// message is relayed to the client. Errors reported by the upstream are relayed as well.
+func authenticate(conn net.Conn, reader *bufio.Reader, client net.Conn, upstream Upstream) error {
+	var sasl *scram.Client
+
+	for {
+		kind, msg, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case 'E':
+			_, _ = client.Write(message(kind, msg))
+			return fmt.Errorf("postgres: upstream rejected authentication")
+		case 'R':
+		default:
+			_ = writeError(client, "08P01", fmt.Sprintf("unexpected message from upstream: %q", kind))
+			return fmt.Errorf("postgres: unexpected message %q", kind)
+		}
+
+		if len(msg) < 4 {
+			return fmt.Errorf("postgres: malformed authentication message")
+		}
+
+		method := binary.BigEndian.Uint32(msg)
+		data := msg[4:]
+
+		var reply []byte
+
+		switch method {
+		case pgAuthOK:
+			_, err = client.Write(message(kind, msg))
+			return err
+		case pgAuthCleartextPassword:
+			reply = append([]byte(upstream.Password), 0)
+		case pgAuthMD5Password:
+			reply = append([]byte(md5Password(upstream.Username, upstream.Password, data)), 0)
+		case pgAuthSASL:
+			if !bytes.Contains(data, []byte("SCRAM-SHA-256\x00")) {
+				_ = writeError(client, "28000", "upstream does not support SCRAM-SHA-256")
+				return fmt.Errorf("postgres: unsupported sasl mechanisms")
+			}
+
+			// postgres ignores the username provided during the exchange in favor of the one in the startup message
+			if sasl, err = scram.NewClient("", upstream.Password); err != nil {
+				return err
+			}
+
+			first := sasl.First()
+
+			reply = append([]byte("SCRAM-SHA-256\x00"), 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(reply[len(reply)-4:], uint32(len(first)))
+			reply = append(reply, first...)
+		case pgAuthSASLContinue:
+			if sasl == nil {
+				return fmt.Errorf("postgres: unexpected sasl continue")
+			}
+
+			final, err := sasl.Final(string(data))
+			if err != nil {
+				_ = writeError(client, "28000", err.Error())
+				return err
+			}
+
+			reply = []byte(final)
+		case pgAuthSASLFinal:
+			if sasl == nil {
+				return fmt.Errorf("postgres: unexpected sasl final")
+			}
+
+			if err = sasl.Verify(string(data)); err != nil {
+				_ = writeError(client, "28000", err.Error())
+				return err
+			}
+
+			continue
+		default:
+			_ = writeError(client, "28000", fmt.Sprintf("unsupported authentication method %d", method))
+			return fmt.Errorf("postgres: unsupported authentication method %d", method)
+		}
+
+		if _, err = conn.Write(message('p', reply)); err != nil {
+			return err
+		}
+	}
+}
+
+func md5Password(username, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + username))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// readStartup reads an untyped startup packet sent by the client, returning the request code and remaining body.
+func readStartup(r io.Reader) (uint32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < 8 || length > pgMaxStartupLength {
+		return 0, nil, fmt.Errorf("postgres: invalid startup packet length %d", length)
+	}
+
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return binary.BigEndian.Uint32(header[4:]), body, nil
+}
+
+func startupMessage(code uint32, body []byte) []byte {
+	msg := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], code)
+
+	return append(msg, body...)
+}
+
+// readMessage reads a typed message from the server or client.
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 {
+		return 0, nil, fmt.Errorf("postgres: invalid message length %d", length)
+	}
+
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], body, nil
+}
+
+func message(kind byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+
+	return append(msg, body...)
+}
+
+// writeError sends a fatal ErrorResponse to the client.
+func writeError(w io.Writer, code, text string) error {
+	body := []byte{}
+	body = append(append(append(body, 'S'), "FATAL"...), 0)
+	body = append(append(append(body, 'V'), "FATAL"...), 0)
+	body = append(append(append(body, 'C'), code...), 0)
+	body = append(append(append(body, 'M'), "varys: "+text...), 0)
+	body = append(body, 0)
+
+	_, err := w.Write(message('E', body))
+	return err
+}
+
+// parseParams parses the null-terminated key value pairs sent in the startup message.
+func parseParams(body []byte) ([][2]string, error) {
+	parts := bytes.Split(body, []byte{0})
+
+	// the list is terminated by an empty key, leaving two empty parts after the split
+	if len(parts) < 2 || len(parts[len(parts)-1]) != 0 || len(parts[len(parts)-2]) != 0 {
+		return nil, fmt.Errorf("postgres: malformed startup message")
+	}
+
+	parts = parts[:len(parts)-2]
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("postgres: malformed startup message")
+	}
+
+	params := make([][2]string, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		params = append(params, [2]string{string(parts[i]), string(parts[i+1])})
+	}
+
+	return params, nil
+}
+
+func setParam(params [][2]string, key, value string) [][2]string {
+	for i := range params {
+		if params[i][0] == key {
+			params[i][1] = value
+			return params
+		}
+	}
+
+	return append(params, [2]string{key, value})
+}
+
+func encodeParams(params [][2]string) []byte {
+	body := make([]byte, 0)
+	for _, param := range params {
+		body = append(append(body, param[0]...), 0)
+		body = append(append(body, param[1]...), 0)
+	}
+
+	return append(body, 0)
+}
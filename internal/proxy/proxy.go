@@ -0,0 +1,130 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package proxy provides local proxies that authenticate with upstream services on behalf of a client. Clients
+// connect to the proxy without a password and the proxy injects the credentials while performing the handshake for
+// the services' wire protocol.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// Upstream describes the service being proxied along with the credentials used to authenticate with it.
+type Upstream struct {
+	Address  string
+	Username string
+	Password string
+	// Token, when set, must be provided by clients as their password before the proxy authenticates on their behalf.
+	// The proxy listens on the loopback interface, which any local user can connect to, so the token limits the use
+	// of the upstream credentials to the program the proxy was started for.
+	Token string
+}
+
+// validToken reports whether the token provided by the client matches the one required by the upstream.
+func (u Upstream) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(u.Token)) == 1
+}
+
+// bufferedConn reads from a buffer that may hold data the client sent while authenticating.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Protocol authenticates with the upstream on behalf of the client before relaying traffic between the two.
+type Protocol interface {
+	// Handle services a single client connection. Implementations are responsible for closing the upstream
+	// connection, but not the client.
+	Handle(ctx context.Context, client net.Conn, upstream Upstream) error
+}
+
+var registry = map[string]Protocol{
+	"postgres":   Postgres{},
+	"postgresql": Postgres{},
+	"redis":      Redis{},
+}
+
+// Lookup returns the protocol used to proxy the provided kind of service.
+func Lookup(kind string) (Protocol, bool) {
+	protocol, ok := registry[strings.ToLower(kind)]
+	return protocol, ok
+}
+
+// Serve accepts connections from the listener until it's closed or the context is canceled. Each connection is
+// handled in its own goroutine.
+func Serve(ctx context.Context, listener net.Listener, protocol Protocol, upstream Upstream) error {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			if err := protocol.Handle(ctx, conn, upstream); err != nil {
+				zaputil.Extract(ctx).Debug("proxied connection closed", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// pipe relays traffic between the client and upstream until either side closes the connection.
+func pipe(client net.Conn, upstreamReader io.Reader, upstream net.Conn) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(upstream, client)
+		errs <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(client, upstreamReader)
+		errs <- err
+	}()
+
+	err := <-errs
+
+	// unblock the other side
+	_ = client.Close()
+	_ = upstream.Close()
+
+	return err
+}
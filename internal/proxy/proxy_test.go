@@ -0,0 +1,423 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/varys/internal/proxy"
+	"github.com/mjpitz/varys/internal/resp"
+	"github.com/mjpitz/varys/internal/scram"
+)
+
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func startProxy(t *testing.T, kind string, upstream proxy.Upstream) string {
+	protocol, ok := proxy.Lookup(kind)
+	require.True(t, ok)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() { _ = proxy.Serve(ctx, listener, protocol, upstream) }()
+
+	return listener.Addr().String()
+}
+
+func TestLookup(t *testing.T) {
+	_, ok := proxy.Lookup("PostgreSQL")
+	require.True(t, ok)
+
+	_, ok = proxy.Lookup("mysql")
+	require.False(t, ok)
+}
+
+func redisServer(t *testing.T, username, password string) string {
+	return listen(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		authenticated := false
+
+		for {
+			args, err := resp.ReadCommand(reader)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case strings.EqualFold(args[0], "AUTH"):
+				if len(args) == 3 && args[1] == username && args[2] == password {
+					authenticated = true
+					_ = resp.WriteStatus(conn, "OK")
+				} else {
+					_ = resp.WriteValue(conn, resp.Error("WRONGPASS invalid username-password pair"))
+				}
+			case !authenticated:
+				_ = resp.WriteValue(conn, resp.Error("NOAUTH Authentication required."))
+			default:
+				_ = resp.WriteStatus(conn, "PONG")
+			}
+		}
+	})
+}
+
+func TestRedis(t *testing.T) {
+	upstream := redisServer(t, "derived", "secret")
+
+	address := startProxy(t, "redis", proxy.Upstream{
+		Address:  "redis://" + upstream,
+		Username: "derived",
+		Password: "secret",
+		Token:    "token",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := resp.NewClient(conn)
+
+	// the client must provide the token before any commands are relayed
+	reply, err := client.Do(context.Background(), "AUTH", "someone", "token")
+	require.NoError(t, err)
+	require.Equal(t, "OK", reply)
+
+	reply, err = client.Do(context.Background(), "PING")
+	require.NoError(t, err)
+	require.Equal(t, "PONG", reply)
+}
+
+func TestRedisInvalidToken(t *testing.T) {
+	upstream := redisServer(t, "derived", "secret")
+
+	address := startProxy(t, "redis", proxy.Upstream{
+		Address:  upstream,
+		Username: "derived",
+		Password: "secret",
+		Token:    "token",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = resp.NewClient(conn).Do(context.Background(), "PING")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid token")
+}
+
+func TestRedisInvalidCredentials(t *testing.T) {
+	upstream := redisServer(t, "derived", "secret")
+
+	address := startProxy(t, "redis", proxy.Upstream{
+		Address:  upstream,
+		Username: "derived",
+		Password: "wrong",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reply, err := resp.ReadValue(bufio.NewReader(conn))
+	require.NoError(t, err)
+	require.IsType(t, resp.Error(""), reply)
+	require.Contains(t, string(reply.(resp.Error)), "WRONGPASS")
+}
+
+func writeMessage(t *testing.T, w io.Writer, kind byte, body []byte) {
+	msg := []byte{kind, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+
+	_, err := w.Write(append(msg, body...))
+	require.NoError(t, err)
+}
+
+func readMessage(t *testing.T, r io.Reader) (byte, []byte) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+
+	return header[0], body
+}
+
+func writeStartup(t *testing.T, w io.Writer, code uint32, params ...string) {
+	body := make([]byte, 0)
+	for _, param := range params {
+		body = append(append(body, param...), 0)
+	}
+
+	if len(params) > 0 {
+		body = append(body, 0)
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], code)
+
+	_, err := w.Write(append(msg, body...))
+	require.NoError(t, err)
+}
+
+func readStartup(t *testing.T, r io.Reader) (uint32, []byte) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+
+	body := make([]byte, binary.BigEndian.Uint32(header)-8)
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+
+	return binary.BigEndian.Uint32(header[4:]), body
+}
+
+func authMethod(method uint32, data string) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, method)
+
+	return append(body, data...)
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// postgresServer is a stand-in for a PostgreSQL server that requires SCRAM-SHA-256 authentication. Once authenticated,
+// it reports the user and database from the startup message through ParameterStatus messages.
+func postgresServer(t *testing.T, username, password string) string {
+	salt := []byte("0123456789abcdef")
+	storedKey, serverKey := scram.Keys(scram.SaltedPassword(password, salt, scram.DefaultIterations))
+
+	return listen(t, func(conn net.Conn) {
+		code, body := readStartup(t, conn)
+		if code == 80877103 {
+			_, _ = conn.Write([]byte{'N'})
+
+			code, body = readStartup(t, conn)
+		}
+
+		require.Equal(t, uint32(196608), code)
+
+		parts := strings.Split(strings.TrimRight(string(body), "\x00"), "\x00")
+		params := make(map[string]string)
+		for i := 0; i+1 < len(parts); i += 2 {
+			params[parts[i]] = parts[i+1]
+		}
+
+		writeMessage(t, conn, 'R', authMethod(10, "SCRAM-SHA-256\x00\x00"))
+
+		kind, msg := readMessage(t, conn)
+		require.Equal(t, byte('p'), kind)
+		require.True(t, bytes.HasPrefix(msg, []byte("SCRAM-SHA-256\x00")))
+
+		clientFirst := string(msg[len("SCRAM-SHA-256\x00")+4:])
+		clientFirstBare := strings.TrimPrefix(clientFirst, "n,,")
+		clientNonce := clientFirstBare[strings.Index(clientFirstBare, "r=")+2:]
+
+		serverFirst := "r=" + clientNonce + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		writeMessage(t, conn, 'R', authMethod(11, serverFirst))
+
+		kind, msg = readMessage(t, conn)
+		require.Equal(t, byte('p'), kind)
+
+		clientFinal := string(msg)
+		withoutProof := clientFinal[:strings.Index(clientFinal, ",p=")]
+		proof, err := base64.StdEncoding.DecodeString(clientFinal[strings.Index(clientFinal, ",p=")+3:])
+		require.NoError(t, err)
+
+		authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+
+		clientSignature := hmacSum(storedKey, authMessage)
+		clientKey := make([]byte, len(proof))
+		for i := range proof {
+			clientKey[i] = proof[i] ^ clientSignature[i]
+		}
+
+		sum := sha256.Sum256(clientKey)
+		if params["user"] != username || !hmac.Equal(sum[:], storedKey) {
+			writeMessage(t, conn, 'E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+
+		serverSignature := base64.StdEncoding.EncodeToString(hmacSum(serverKey, authMessage))
+		writeMessage(t, conn, 'R', authMethod(12, "v="+serverSignature))
+		writeMessage(t, conn, 'R', authMethod(0, ""))
+		writeMessage(t, conn, 'S', []byte("user\x00"+params["user"]+"\x00"))
+		writeMessage(t, conn, 'S', []byte("database\x00"+params["database"]+"\x00"))
+		writeMessage(t, conn, 'Z', []byte{'I'})
+
+		// wait for the client to terminate
+		_, _ = io.Copy(io.Discard, conn)
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	upstream := postgresServer(t, "derived", "secret")
+
+	address := startProxy(t, "postgres", proxy.Upstream{
+		Address:  "postgres://" + upstream + "/app?sslmode=disable",
+		Username: "derived",
+		Password: "secret",
+		Token:    "token",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// clients typically request encryption first, which the proxy declines
+	writeStartup(t, conn, 80877103)
+
+	resp := make([]byte, 1)
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+	require.Equal(t, byte('N'), resp[0])
+
+	writeStartup(t, conn, 196608, "user", "someone", "database", "app")
+
+	// the client must provide the token before the proxy authenticates with the upstream
+	kind, body := readMessage(t, conn)
+	require.Equal(t, byte('R'), kind)
+	require.Equal(t, authMethod(3, ""), body)
+
+	writeMessage(t, conn, 'p', []byte("token\x00"))
+
+	kind, body = readMessage(t, conn)
+	require.Equal(t, byte('R'), kind)
+	require.Equal(t, authMethod(0, ""), body)
+
+	kind, body = readMessage(t, conn)
+	require.Equal(t, byte('S'), kind)
+	require.Equal(t, "user\x00derived\x00", string(body))
+
+	kind, body = readMessage(t, conn)
+	require.Equal(t, byte('S'), kind)
+	require.Equal(t, "database\x00app\x00", string(body))
+
+	kind, _ = readMessage(t, conn)
+	require.Equal(t, byte('Z'), kind)
+
+	writeMessage(t, conn, 'X', nil)
+}
+
+func TestPostgresInvalidCredentials(t *testing.T) {
+	upstream := postgresServer(t, "derived", "secret")
+
+	address := startProxy(t, "postgres", proxy.Upstream{
+		Address:  "postgres://" + upstream + "?sslmode=disable",
+		Username: "derived",
+		Password: "wrong",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	writeStartup(t, conn, 196608, "user", "someone")
+
+	kind, body := readMessage(t, conn)
+	require.Equal(t, byte('E'), kind)
+	require.Contains(t, string(body), "password authentication failed")
+}
+
+func TestPostgresInvalidToken(t *testing.T) {
+	upstream := postgresServer(t, "derived", "secret")
+
+	address := startProxy(t, "postgres", proxy.Upstream{
+		Address:  "postgres://" + upstream + "?sslmode=disable",
+		Username: "derived",
+		Password: "secret",
+		Token:    "token",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	writeStartup(t, conn, 196608, "user", "someone")
+
+	kind, _ := readMessage(t, conn)
+	require.Equal(t, byte('R'), kind)
+
+	writeMessage(t, conn, 'p', []byte("guess\x00"))
+
+	kind, body := readMessage(t, conn)
+	require.Equal(t, byte('E'), kind)
+	require.Contains(t, string(body), "invalid token")
+}
+
+func TestPostgresRequiresEncryption(t *testing.T) {
+	upstream := postgresServer(t, "derived", "secret")
+
+	// the upstream declines encryption, so the password must not be sent
+	address := startProxy(t, "postgres", proxy.Upstream{
+		Address:  upstream,
+		Username: "derived",
+		Password: "secret",
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	writeStartup(t, conn, 196608, "user", "someone")
+
+	kind, body := readMessage(t, conn)
+	require.Equal(t, byte('E'), kind)
+	require.Contains(t, string(body), "does not support encryption")
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mjpitz/varys/internal/drivers"
+	"github.com/mjpitz/varys/internal/resp"
+)
+
+// Redis proxies connections using the Redis serialization protocol. The proxy issues an AUTH command using the
+// upstream credentials before relaying any traffic from the client. When a token is required, the clients' first
+// command must be an AUTH command that provides it as the password.
+type Redis struct{}
+
+func (Redis) Handle(ctx context.Context, client net.Conn, upstream Upstream) error {
+	host, port, _ := drivers.ParseAddress(upstream.Address, "6379")
+
+	if upstream.Token != "" {
+		buffered := &bufferedConn{Conn: client, reader: bufio.NewReader(client)}
+		client = buffered
+
+		args, err := resp.ReadCommand(buffered.reader)
+		if err != nil {
+			return err
+		}
+
+		if len(args) < 2 || len(args) > 3 || !strings.EqualFold(args[0], "AUTH") ||
+			!upstream.validToken(args[len(args)-1]) {
+			_ = resp.WriteValue(client, resp.Error("WRONGPASS varys: invalid token"))
+			return fmt.Errorf("redis: client provided an invalid token")
+		}
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		_ = resp.WriteValue(client, resp.Error("ERR varys: failed to connect to upstream"))
+		return err
+	}
+	defer conn.Close()
+
+	args := []string{"AUTH", upstream.Password}
+	if upstream.Username != "" {
+		args = []string{"AUTH", upstream.Username, upstream.Password}
+	}
+
+	if err = resp.WriteCommand(conn, args...); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	reply, err := resp.ReadValue(reader)
+	if err != nil {
+		return err
+	}
+
+	if e, ok := reply.(resp.Error); ok {
+		_ = resp.WriteValue(client, resp.Error("ERR varys: "+string(e)))
+		return fmt.Errorf("redis: upstream rejected authentication: %w", e)
+	}
+
+	if upstream.Token != "" {
+		// reply to the clients' AUTH command
+		if err = resp.WriteStatus(client, "OK"); err != nil {
+			return err
+		}
+	}
+
+	return pipe(client, reader, conn)
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package resp provides a minimal implementation of the Redis serialization protocol (RESP2). It supports just enough
+// of the protocol for varys to administer and authenticate with Redis.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is returned when Redis replies with an error.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// WriteCommand writes the command as an array of bulk strings.
+func WriteCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// WriteValue writes the provided value. Supported types include string (as a bulk string), int64, Error, nil, and
+// []interface{} containing any of the above.
+func WriteValue(w io.Writer, value interface{}) (err error) {
+	switch v := value.(type) {
+	case nil:
+		_, err = io.WriteString(w, "$-1\r\n")
+	case Error:
+		_, err = io.WriteString(w, "-"+string(v)+"\r\n")
+	case int64:
+		_, err = io.WriteString(w, ":"+strconv.FormatInt(v, 10)+"\r\n")
+	case string:
+		_, err = io.WriteString(w, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n")
+	case []interface{}:
+		_, err = io.WriteString(w, "*"+strconv.Itoa(len(v))+"\r\n")
+		for i := 0; err == nil && i < len(v); i++ {
+			err = WriteValue(w, v[i])
+		}
+	default:
+		err = fmt.Errorf("unsupported type: %T", value)
+	}
+
+	return err
+}
+
+// WriteStatus writes a simple string reply (e.g. +OK).
+func WriteStatus(w io.Writer, status string) error {
+	_, err := io.WriteString(w, "+"+status+"\r\n")
+	return err
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("resp: malformed line")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// ReadValue reads a single value from the reader. Simple and bulk strings are returned as strings, integers as int64,
+// arrays as []interface{}, and errors as Error. Null values are returned as nil.
+func ReadValue(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = ReadValue(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("resp: unrecognized type: %q", line[0])
+}
+
+// ReadCommand reads a command sent by a client as an array of bulk strings.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	value, err := ReadValue(r)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("resp: expected array")
+	}
+
+	args := make([]string, len(values))
+	for i, v := range values {
+		if args[i], ok = v.(string); !ok {
+			return nil, errors.New("resp: expected bulk string")
+		}
+	}
+
+	return args, nil
+}
+
+// Dial connects to the Redis server at the provided address.
+func Dial(ctx context.Context, address string) (*Client, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// NewClient wraps the provided connection with a client.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Client issues commands to a Redis server, one at a time.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Do issues the command and returns the reply. Error replies are returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+		defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+	}
+
+	if err := WriteCommand(c.conn, args...); err != nil {
+		return nil, err
+	}
+
+	value, err := ReadValue(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if e, ok := value.(Error); ok {
+		return nil, e
+	}
+
+	return value, nil
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
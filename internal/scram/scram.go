@@ -0,0 +1,179 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package scram implements the portions of SCRAM-SHA-256 (RFC 7677) used by varys. This includes computing verifiers,
+// allowing credentials to be provisioned without handing systems the plaintext password, and the client side of the
+// exchange used to authenticate with upstream systems.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// DefaultIterations defines the default number of iterations used when salting a password.
+const DefaultIterations = 4096
+
+func hmacSum(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
+
+// SaltedPassword computes the SaltedPassword value for the provided password.
+func SaltedPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+// Keys computes the StoredKey and ServerKey for the provided salted password.
+func Keys(saltedPassword []byte) (storedKey, serverKey []byte) {
+	clientKey := hmacSum(saltedPassword, []byte("Client Key"))
+	stored := sha256.Sum256(clientKey)
+
+	return stored[:], hmacSum(saltedPassword, []byte("Server Key"))
+}
+
+// Verifier computes a SCRAM-SHA-256 verifier for the provided password using a random salt. The returned value is
+// formatted the way PostgreSQL stores verifiers in pg_authid, allowing it to be provided in place of a plaintext
+// password.
+func Verifier(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	return VerifierWithSalt(password, salt, DefaultIterations), nil
+}
+
+// VerifierWithSalt computes a SCRAM-SHA-256 verifier for the provided password using the provided salt and iterations.
+func VerifierWithSalt(password string, salt []byte, iterations int) string {
+	storedKey, serverKey := Keys(SaltedPassword(password, salt, iterations))
+
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey),
+		base64.StdEncoding.EncodeToString(serverKey),
+	)
+}
+
+func escapeUsername(username string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+}
+
+// NewClient returns a Client that authenticates using the provided username and password.
+func NewClient(username, password string) (*Client, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return newClient(username, password, base64.StdEncoding.EncodeToString(nonce)), nil
+}
+
+func newClient(username, password, nonce string) *Client {
+	return &Client{
+		password:        password,
+		nonce:           nonce,
+		clientFirstBare: "n=" + escapeUsername(username) + ",r=" + nonce,
+	}
+}
+
+// Client performs the client side of a SCRAM-SHA-256 exchange. Channel binding is not supported.
+type Client struct {
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// First returns the client-first-message.
+func (c *Client) First() string {
+	return "n,," + c.clientFirstBare
+}
+
+func attributes(message string) map[byte]string {
+	attrs := make(map[byte]string)
+
+	for _, part := range strings.Split(message, ",") {
+		if len(part) > 2 && part[1] == '=' {
+			attrs[part[0]] = part[2:]
+		}
+	}
+
+	return attrs
+}
+
+// Final processes the server-first-message and returns the client-final-message.
+func (c *Client) Final(serverFirst string) (string, error) {
+	attrs := attributes(serverFirst)
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", fmt.Errorf("scram: invalid server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return "", fmt.Errorf("scram: invalid salt: %w", err)
+	}
+
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("scram: invalid iteration count")
+	}
+
+	saltedPassword := SaltedPassword(c.password, salt, iterations)
+	clientKey := hmacSum(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	clientSignature := hmacSum(storedKey[:], []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := hmacSum(saltedPassword, []byte("Server Key"))
+	c.serverSignature = hmacSum(serverKey, []byte(authMessage))
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Verify checks the signature provided by the server in the server-final-message, ensuring the server knows the
+// password as well.
+func (c *Client) Verify(serverFinal string) error {
+	attrs := attributes(serverFinal)
+
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("scram: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || c.serverSignature == nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("scram: invalid server signature")
+	}
+
+	return nil
+}
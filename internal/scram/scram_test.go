@@ -0,0 +1,67 @@
+// Copyright (C) 2022  Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package scram_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mjpitz/varys/internal/scram"
+)
+
+// The values below come from the example exchange in RFC 7677, section 3.
+const (
+	rfcPassword        = "pencil"
+	rfcSalt            = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfcAuthMessage     = "n=user,r=rOprNGfwEbeRWgbNEkqO,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096,c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfcServerSignature = "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func TestVerifierWithSalt(t *testing.T) {
+	salt, err := base64.StdEncoding.DecodeString(rfcSalt)
+	require.NoError(t, err)
+
+	verifier := scram.VerifierWithSalt(rfcPassword, salt, 4096)
+	require.True(t, strings.HasPrefix(verifier, "SCRAM-SHA-256$4096:"+rfcSalt+"$"))
+
+	keys := strings.Split(strings.SplitN(verifier, "$", 3)[2], ":")
+	require.Len(t, keys, 2)
+
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	require.NoError(t, err)
+
+	h := hmac.New(sha256.New, serverKey)
+	_, _ = h.Write([]byte(rfcAuthMessage))
+
+	require.Equal(t, rfcServerSignature, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+func TestVerifier(t *testing.T) {
+	a, err := scram.Verifier(rfcPassword)
+	require.NoError(t, err)
+
+	b, err := scram.Verifier(rfcPassword)
+	require.NoError(t, err)
+
+	// salts are random
+	require.NotEqual(t, a, b)
+}